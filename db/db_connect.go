@@ -3,20 +3,33 @@ package db
 import (
 	"database/sql"
 	"fmt"
+	"sync/atomic"
+	"time"
 
+	"github.com/composer22/docker-deploy-server/logger"
 	_ "github.com/go-sql-driver/mysql"
 )
 
+// mysqlDateTime is the layout of a MySQL DATETIME value.
+const mysqlDateTime = "2006-01-02 15:04:05"
+
 const (
 	_ = iota
 	Queued
 	Started
 	Success
 	Failed
+	PendingApproval
+	Rejected
+	Expired
+	Superseded
 )
 
+// DBConnect represents a connection to the database.
 type DBConnect struct {
-	db *sql.DB
+	db       *sql.DB        // Database connection pool.
+	errCount int64          // Number of database errors since connecting (atomic).
+	log      *logger.Logger // Optional log for database errors.
 }
 
 // NewDBConnect is a factory method that returns a new db connection
@@ -36,6 +49,11 @@ func NewDBConnect(dsn string) (*DBConnect, error) {
 	return &DBConnect{db: db}, nil
 }
 
+// NewDBConnectFromDB is a factory method that returns a connection using an open database handle.
+func NewDBConnectFromDB(db *sql.DB) *DBConnect {
+	return &DBConnect{db: db}
+}
+
 // ValidAuth returns true if the API Key is valid for a request.
 func (d *DBConnect) ValidAuth(key string) bool {
 	var id int
@@ -44,7 +62,7 @@ func (d *DBConnect) ValidAuth(key string) bool {
 	switch {
 	case err == sql.ErrNoRows:
 		return false
-	case err != nil:
+	case d.failed(err):
 		return false
 	default:
 		return true
@@ -66,25 +84,174 @@ func (d *DBConnect) AuthDeployEnv(key string, env string) bool {
 	switch {
 	case err == sql.ErrNoRows:
 		return false
-	case err != nil:
+	case d.failed(err):
+		return false
+	default:
+		return true
+	}
+}
+
+// AuthRight returns true if the API Key has been granted a named right (ex: approve).
+func (d *DBConnect) AuthRight(key string, right string) bool {
+	var id int
+	row := d.db.QueryRow("SELECT atr.id as id "+
+		"FROM auth_tokens_rights as atr "+
+		"INNER JOIN auth_tokens as at "+
+		"  ON atr.auth_token_id = at.id "+
+		"  AND at.token = ? "+
+		"WHERE atr.name = ?", key, right)
+	err := row.Scan(&id)
+	switch {
+	case err == sql.ErrNoRows:
+		return false
+	case d.failed(err):
 		return false
 	default:
 		return true
 	}
 }
 
+// AuthTokenName returns the name of the user or service the API Key was granted to.
+func (d *DBConnect) AuthTokenName(key string) string {
+	var name sql.NullString
+	row := d.db.QueryRow("SELECT name FROM auth_tokens WHERE token = ?", key)
+	if err := row.Scan(&name); d.failed(err) {
+		return ""
+	}
+	return name.String
+}
+
+// AuthTokenByCertIdentity returns the API Key of the user or service a client certificate is mapped
+// to. The identity is unique, unlike the name.
+func (d *DBConnect) AuthTokenByCertIdentity(identity string) string {
+	var token string
+	row := d.db.QueryRow("SELECT token FROM auth_tokens WHERE cert_identity = ?", identity)
+	if err := row.Scan(&token); d.failed(err) {
+		return ""
+	}
+	return token
+}
+
+// AuthTokenLimits returns the deploy requests per minute and the maximum active deploys for an
+// API Key. Zero values mean the server defaults apply.
+func (d *DBConnect) AuthTokenLimits(key string) (deploysPerMinute int, maxActive int) {
+	var rpm, active sql.NullInt64
+	row := d.db.QueryRow("SELECT deploys_per_minute, max_active_deploys FROM auth_tokens WHERE token = ?", key)
+	if err := row.Scan(&rpm, &active); d.failed(err) {
+		return 0, 0
+	}
+	return int(rpm.Int64), int(active.Int64)
+}
+
 // QueueDeploy inserts a fresh row into the log for a deployment run.
-func (d *DBConnect) QueueDeploy(deployID string, environment string, imageName string, imageTag string) bool {
+func (d *DBConnect) QueueDeploy(deployID string, environment string, imageName string, imageTag string,
+	correlationID string) bool {
 	msg := "Queued deploy."
 	log := fmt.Sprintln(msg)
 	result, err := d.db.Exec("INSERT INTO deploys (deploy_id, environment, image_name, image_tag, status, message, log, "+
-		"updated_at, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, NOW(), NOW())",
-		deployID, environment, imageName, imageTag, Started, msg, log)
-	if err != nil {
+		"correlation_id, updated_at, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, NOW(), NOW())",
+		deployID, environment, imageName, imageTag, Queued, msg, log, correlationID)
+	if d.failed(err) {
+		return false
+	}
+	id, err := result.LastInsertId()
+	if d.failed(err) || id <= 0 {
+		return false
+	}
+	return true
+}
+
+// PendingDeploy inserts a fresh row into the log for a deployment run that must be approved
+// before it is queued. The serialized request is kept with the row until it is released.
+func (d *DBConnect) PendingDeploy(deployID string, environment string, imageName string, imageTag string,
+	correlationID string, request string) bool {
+	msg := "Deploy pending approval."
+	log := fmt.Sprintln(msg)
+	result, err := d.db.Exec("INSERT INTO deploys (deploy_id, environment, image_name, image_tag, status, message, log, "+
+		"correlation_id, request, updated_at, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, NOW(), NOW())",
+		deployID, environment, imageName, imageTag, PendingApproval, msg, log, correlationID, request)
+	if d.failed(err) {
 		return false
 	}
 	id, err := result.LastInsertId()
-	if err != nil || id <= 0 {
+	if d.failed(err) || id <= 0 {
+		return false
+	}
+	return true
+}
+
+// ApproveDeploy records an approval of a deploy by the API Key and returns the number of distinct
+// keys that have approved the deploy so far.
+func (d *DBConnect) ApproveDeploy(deployID string, key string) (int, error) {
+	if _, err := d.db.Exec("INSERT IGNORE INTO deploy_approvals (deploy_id, auth_token_id, updated_at, created_at) "+
+		"SELECT ?, id, NOW(), NOW() FROM auth_tokens WHERE token = ?", deployID, key); d.failed(err) {
+		return 0, err
+	}
+	var count int
+	row := d.db.QueryRow("SELECT COUNT(DISTINCT auth_token_id) FROM deploy_approvals WHERE deploy_id = ?", deployID)
+	if err := row.Scan(&count); d.failed(err) {
+		return 0, err
+	}
+	return count, nil
+}
+
+// QueryDeployRequest returns the serialized request kept with a deploy row.
+func (d *DBConnect) QueryDeployRequest(deployID string) (string, error) {
+	var request sql.NullString
+	row := d.db.QueryRow("SELECT request FROM deploys WHERE deploy_id = ?", deployID)
+	if err := row.Scan(&request); d.failed(err) {
+		return "", err
+	}
+	return request.String, nil
+}
+
+// PendingDeploy is a deploy waiting for approval and how long it has waited.
+type PendingDeploy struct {
+	DeployID    string
+	Environment string
+	ImageName   string
+	Age         time.Duration
+}
+
+// PendingDeploys returns every deploy waiting for approval, in any environment.
+func (d *DBConnect) PendingDeploys() ([]*PendingDeploy, error) {
+	rows, err := d.db.Query("SELECT deploy_id, environment, image_name, "+
+		"TIMESTAMPDIFF(SECOND, created_at, NOW()) FROM deploys "+
+		"WHERE status = ?", PendingApproval)
+	if d.failed(err) {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var pending []*PendingDeploy
+	for rows.Next() {
+		var p PendingDeploy
+		var age int64
+		if err := rows.Scan(&p.DeployID, &p.Environment, &p.ImageName, &age); d.failed(err) {
+			return nil, err
+		}
+		p.Age = time.Duration(age) * time.Second
+		pending = append(pending, &p)
+	}
+	return pending, rows.Err()
+}
+
+// TransitionDeploy updates the deploy row only if it is still in the expected status, and appends
+// text to its log. It returns true if this caller performed the transition.
+func (d *DBConnect) TransitionDeploy(deployID string, from int, to int, message string, text string) bool {
+	result, err := d.db.Exec("UPDATE deploys "+
+		"SET status = ?, "+
+		"message = ?, "+
+		"log = CONCAT(IFNULL(log, ''), ?), "+
+		"updated_at = NOW() "+
+		"WHERE deploy_id = ? "+
+		"AND status = ?",
+		to, message, text, deployID, from)
+	if d.failed(err) {
+		return false
+	}
+	rows, err := result.RowsAffected()
+	if d.failed(err) || rows != 1 {
 		return false
 	}
 	return true
@@ -96,14 +263,131 @@ func (d *DBConnect) UpdateDeploy(deployID string, status int, message string, lo
 		"SET status = ?, "+
 		"message = ?, "+
 		"log = ?, "+
+		"started_at = CASE ? WHEN ? THEN NULL WHEN ? THEN COALESCE(started_at, NOW()) ELSE started_at END, "+
+		"finished_at = CASE WHEN ? = ? THEN NULL WHEN ? IN (?, ?) THEN NOW() ELSE finished_at END, "+
 		"updated_at = NOW() "+
 		"WHERE deploy_id = ?",
-		status, message, log, deployID)
-	if err != nil {
+		status, message, log, status, Queued, Started, status, Queued, status, Success, Failed, deployID)
+	if d.failed(err) {
+		return false
+	}
+	rows, err := result.RowsAffected()
+	if d.failed(err) || rows != 1 {
+		return false
+	}
+	return true
+}
+
+// SetFailedStep records the step a deploy failed at.
+func (d *DBConnect) SetFailedStep(deployID string, step string) bool {
+	_, err := d.db.Exec("UPDATE deploys SET failed_step = ? WHERE deploy_id = ?", step, deployID)
+	return !d.failed(err)
+}
+
+// SetEtcdSnapshot records the etcd2 keys as they were before a deploy changed them.
+func (d *DBConnect) SetEtcdSnapshot(deployID string, snapshot string) bool {
+	_, err := d.db.Exec("UPDATE deploys SET etcd_snapshot = ? WHERE deploy_id = ?", snapshot, deployID)
+	return !d.failed(err)
+}
+
+// EtcdSnapshot returns the etcd2 keys as they were before a deploy changed them, or an empty string if
+// the deploy changed none.
+func (d *DBConnect) EtcdSnapshot(deployID string) (string, error) {
+	var snapshot sql.NullString
+	row := d.db.QueryRow("SELECT etcd_snapshot FROM deploys WHERE deploy_id = ?", deployID)
+	if err := row.Scan(&snapshot); d.failed(err) {
+		return "", err
+	}
+	return snapshot.String, nil
+}
+
+// DeployRecord is a deploy row summarized for statistics.
+type DeployRecord struct {
+	Environment string // Environment deployed.
+	ImageName   string // Docker image name.
+	Status      int    // Current status.
+	FailedStep  string // Step the deploy failed at, if any.
+	Duration    int64  // Seconds from start to finish, or -1 if not finished.
+	Age         int64  // Seconds since the deploy was requested.
+	FinishedAge int64  // Seconds since the deploy finished, or -1 if not finished.
+}
+
+// DeployHistory returns the deploys requested within the last days, optionally for one
+// environment and/or image.
+func (d *DBConnect) DeployHistory(days int, environment string, imageName string) ([]*DeployRecord, error) {
+	rows, err := d.db.Query("SELECT environment, image_name, status, COALESCE(failed_step, ''), "+
+		"COALESCE(TIMESTAMPDIFF(SECOND, started_at, finished_at), -1), "+
+		"TIMESTAMPDIFF(SECOND, created_at, NOW()), "+
+		"COALESCE(TIMESTAMPDIFF(SECOND, finished_at, NOW()), -1) "+
+		"FROM deploys "+
+		"WHERE created_at >= DATE_SUB(NOW(), INTERVAL ? DAY) "+
+		"AND (? = '' OR environment = ?) "+
+		"AND (? = '' OR image_name = ?)",
+		days, environment, environment, imageName, imageName)
+	if d.failed(err) {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var records []*DeployRecord
+	for rows.Next() {
+		r := &DeployRecord{}
+		if err := rows.Scan(&r.Environment, &r.ImageName, &r.Status, &r.FailedStep, &r.Duration, &r.Age,
+			&r.FinishedAge); d.failed(err) {
+			return nil, err
+		}
+		records = append(records, r)
+	}
+	return records, rows.Err()
+}
+
+// LastSuccess is the time since the last successful deploy of an image to an environment.
+type LastSuccess struct {
+	Environment string // Environment deployed.
+	ImageName   string // Docker image name.
+	Age         int64  // Seconds since the deploy finished.
+}
+
+// LastSuccesses returns the time since the last successful deploy of each image to each environment,
+// however long ago, optionally for one environment and/or image. Deploys without a finish time are
+// skipped.
+func (d *DBConnect) LastSuccesses(environment string, imageName string) ([]*LastSuccess, error) {
+	rows, err := d.db.Query("SELECT environment, image_name, TIMESTAMPDIFF(SECOND, MAX(finished_at), NOW()) "+
+		"FROM deploys "+
+		"WHERE status = ? "+
+		"AND finished_at IS NOT NULL "+
+		"AND (? = '' OR environment = ?) "+
+		"AND (? = '' OR image_name = ?) "+
+		"GROUP BY environment, image_name",
+		Success, environment, environment, imageName, imageName)
+	if d.failed(err) {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var last []*LastSuccess
+	for rows.Next() {
+		l := &LastSuccess{}
+		if err := rows.Scan(&l.Environment, &l.ImageName, &l.Age); d.failed(err) {
+			return nil, err
+		}
+		last = append(last, l)
+	}
+	return last, rows.Err()
+}
+
+// AppendDeployLog appends text to the log of a deploy row.
+func (d *DBConnect) AppendDeployLog(deployID string, text string) bool {
+	result, err := d.db.Exec("UPDATE deploys "+
+		"SET log = CONCAT(IFNULL(log, ''), ?), "+
+		"updated_at = NOW() "+
+		"WHERE deploy_id = ?",
+		text, deployID)
+	if d.failed(err) {
 		return false
 	}
 	rows, err := result.RowsAffected()
-	if err != nil || rows != 1 {
+	if d.failed(err) || rows != 1 {
 		return false
 	}
 	return true
@@ -111,35 +395,195 @@ func (d *DBConnect) UpdateDeploy(deployID string, status int, message string, lo
 
 // DeployStatus is used to return deploy status information from the database to the requester.
 type DeployStatus struct {
-	DeployID    string `json:"deployID"`    // UUID of teh deploy.
-	Environment string `json:"environment"` // Environment serviced (development, qa etc.)
-	ImageName   string `json:"imageName"`   // Docker image name.
-	ImageTag    string `json:"imageTag"`    // Version tag of the image.
-	Status      int    `json:"status"`      // The status ID of the result.
-	Message     string `json:"message"`     // A user friendly message of what occurred.
-	Log         string `json:"log"`         // The log of all steps run during the deploy.
-	UpdatedAt   string `json:"updatedAt"`   // The create date and time of the deploy.
-	CreatedAt   string `json:"createdAt"`   // The last update to this record.
+	DeployID    string `json:"deployID"`                // UUID of teh deploy.
+	Environment string `json:"environment"`             // Environment serviced (development, qa etc.)
+	ImageName   string `json:"imageName"`               // Docker image name.
+	ImageTag    string `json:"imageTag"`                // Version tag of the image.
+	Correlation string `json:"correlationID,omitempty"` // Client request or trace ID of the request.
+	Status      int    `json:"status"`                  // The status ID of the result.
+	Message     string `json:"message"`                 // A user friendly message of what occurred.
+	Log         string `json:"log"`                     // The log of all steps run during the deploy.
+	UpdatedAt   string `json:"updatedAt"`               // The create date and time of the deploy.
+	CreatedAt   string `json:"createdAt"`               // The last update to this record.
 }
 
 // QueryDeploy returns the status of a deploy request.
 func (d *DBConnect) QueryDeploy(deployID string) (*DeployStatus, error) {
 	r := &DeployStatus{}
-	row := d.db.QueryRow("SELECT deploy_id, environment, image_name, image_tag, status, message, log, "+
+	row := d.db.QueryRow("SELECT deploy_id, environment, image_name, image_tag, correlation_id, status, message, log, "+
 		"updated_at, created_at "+
 		"FROM deploys WHERE deploy_id = ?", deployID)
-	err := row.Scan(&r.DeployID, &r.Environment, &r.ImageName, &r.ImageTag, &r.Status, &r.Message, &r.Log,
-		&r.UpdatedAt, &r.CreatedAt)
+	err := row.Scan(&r.DeployID, &r.Environment, &r.ImageName, &r.ImageTag, &r.Correlation, &r.Status, &r.Message,
+		&r.Log, &r.UpdatedAt, &r.CreatedAt)
 	switch {
 	case err == sql.ErrNoRows:
 		return nil, err
-	case err != nil:
+	case d.failed(err):
 		return nil, err
 	default:
 		return r, nil
 	}
 }
 
+// Freeze is used to return an ad-hoc deploy freeze on an environment to the requester.
+type Freeze struct {
+	ID          int64  `json:"id"`          // Unique identifier of the freeze.
+	Environment string `json:"environment"` // Environment frozen (development, qa etc.)
+	Reason      string `json:"reason"`      // Why deploys are frozen.
+	EndsAt      string `json:"endsAt"`      // When the freeze ends (UTC) or empty until lifted.
+	CreatedBy   string `json:"createdBy"`   // Name of the token that set the freeze.
+	CreatedAt   string `json:"createdAt"`   // The create date and time of the freeze (UTC).
+}
+
+// SetFreeze inserts an ad-hoc freeze for an environment. A zero until means the freeze lasts until
+// it is lifted.
+func (d *DBConnect) SetFreeze(environment string, reason string, until time.Time, key string) (int64, error) {
+	var endsAt interface{}
+	if !until.IsZero() {
+		endsAt = until.UTC().Format(mysqlDateTime)
+	}
+	result, err := d.db.Exec("INSERT INTO freezes (environment, reason, ends_at, auth_token_id, updated_at, created_at) "+
+		"SELECT ?, ?, ?, id, UTC_TIMESTAMP(), UTC_TIMESTAMP() FROM auth_tokens WHERE token = ?",
+		environment, reason, endsAt, key)
+	if d.failed(err) {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+// LiftFreeze ends all active ad-hoc freezes for an environment and returns how many were lifted.
+func (d *DBConnect) LiftFreeze(environment string) (int64, error) {
+	result, err := d.db.Exec("UPDATE freezes "+
+		"SET lifted_at = UTC_TIMESTAMP(), "+
+		"updated_at = UTC_TIMESTAMP() "+
+		"WHERE environment = ? "+
+		"AND lifted_at IS NULL "+
+		"AND (ends_at IS NULL OR ends_at > UTC_TIMESTAMP())", environment)
+	if d.failed(err) {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// ActiveFreezes returns the ad-hoc freezes in effect. An empty environment returns all of them.
+func (d *DBConnect) ActiveFreezes(environment string) ([]*Freeze, error) {
+	rows, err := d.db.Query("SELECT f.id, f.environment, f.reason, f.ends_at, at.name, f.created_at "+
+		"FROM freezes as f "+
+		"LEFT JOIN auth_tokens as at "+
+		"  ON f.auth_token_id = at.id "+
+		"WHERE f.lifted_at IS NULL "+
+		"AND (f.ends_at IS NULL OR f.ends_at > UTC_TIMESTAMP()) "+
+		"AND (? = '' OR f.environment = ?) "+
+		"ORDER BY f.id DESC", environment, environment)
+	if d.failed(err) {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []*Freeze
+	for rows.Next() {
+		var endsAt, name sql.NullString
+		f := &Freeze{}
+		if err := rows.Scan(&f.ID, &f.Environment, &f.Reason, &endsAt, &name, &f.CreatedAt); d.failed(err) {
+			return nil, err
+		}
+		f.EndsAt, f.CreatedBy = endsAt.String, name.String
+		result = append(result, f)
+	}
+	return result, rows.Err()
+}
+
+// EnvironmentSettings returns the JSON deploy settings of the environments defined in the DB, by name.
+func (d *DBConnect) EnvironmentSettings() (map[string]string, error) {
+	rows, err := d.db.Query("SELECT name, settings FROM environments WHERE settings IS NOT NULL")
+	if d.failed(err) {
+		return nil, err
+	}
+	defer rows.Close()
+	result := make(map[string]string)
+	for rows.Next() {
+		var name, settings string
+		if err := rows.Scan(&name, &settings); d.failed(err) {
+			return nil, err
+		}
+		result[name] = settings
+	}
+	if err := rows.Err(); d.failed(err) {
+		return nil, err
+	}
+	return result, nil
+}
+
+// SetEnvironmentSettings saves the JSON deploy settings of an environment, adding the environment if
+// needed. Returns true if the environment had no settings before.
+func (d *DBConnect) SetEnvironmentSettings(name string, settings string) (bool, error) {
+	var prev sql.NullString
+	err := d.db.QueryRow("SELECT settings FROM environments WHERE name = ?", name).Scan(&prev)
+	if err != sql.ErrNoRows && d.failed(err) {
+		return false, err
+	}
+	_, err = d.db.Exec("INSERT INTO environments (name, settings, created_at, updated_at) VALUES (?, ?, NOW(), NOW()) "+
+		"ON DUPLICATE KEY UPDATE settings = VALUES(settings), updated_at = NOW()", name, settings)
+	if d.failed(err) {
+		return false, err
+	}
+	return !prev.Valid, nil
+}
+
+// DeleteEnvironmentSettings removes the deploy settings of an environment from the DB. The environment
+// row is kept for its token authorizations. Returns false if it had no settings.
+func (d *DBConnect) DeleteEnvironmentSettings(name string) (bool, error) {
+	result, err := d.db.Exec("UPDATE environments SET settings = NULL, updated_at = NOW() "+
+		"WHERE name = ? AND settings IS NOT NULL", name)
+	if d.failed(err) {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	if d.failed(err) {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// Audit records an administrative action (ex: a config reload) in the audit log.
+func (d *DBConnect) Audit(action string, actor string, detail string) bool {
+	_, err := d.db.Exec("INSERT INTO audit_log (action, actor, detail, created_at) VALUES (?, ?, ?, UTC_TIMESTAMP())",
+		action, actor, detail)
+	return !d.failed(err)
+}
+
+// Ping validates the connection to the DB is alive.
+func (d *DBConnect) Ping() error {
+	err := d.db.Ping()
+	d.failed(err)
+	return err
+}
+
+// ErrorCount returns the number of database errors since connecting.
+func (d *DBConnect) ErrorCount() int64 {
+	return atomic.LoadInt64(&d.errCount)
+}
+
+// failed returns true if err is set and counts it as a database error. No rows is not an error.
+func (d *DBConnect) failed(err error) bool {
+	if err == nil {
+		return false
+	}
+	if err != sql.ErrNoRows {
+		atomic.AddInt64(&d.errCount, 1)
+		if d.log != nil {
+			d.log.Errorf("Database error: %s", err)
+		}
+	}
+	return true
+}
+
+// SetLogger sets the log that database errors are written to. It must be called before the
+// connection is shared.
+func (d *DBConnect) SetLogger(l *logger.Logger) {
+	d.log = l
+}
+
 // Close closes the connection(s) to the DB.
 func (d *DBConnect) Close() bool {
 	d.db.Close()
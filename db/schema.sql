@@ -27,9 +27,13 @@ CREATE TABLE `auth_tokens` (
   `updated_at` datetime NOT NULL COMMENT 'Last update date for this row.',
   `name` varchar(255) DEFAULT NULL COMMENT 'Name of the user or service that has been granted authority.',
   `notes` text COMMENT 'General comments.',
+  `deploys_per_minute` int(11) DEFAULT NULL COMMENT 'Deploy requests allowed per minute. NULL uses the server default.',
+  `max_active_deploys` int(11) DEFAULT NULL COMMENT 'Deploys allowed queued or running at once. NULL uses the server default.',
+  `cert_identity` varchar(255) DEFAULT NULL COMMENT 'Identity a client certificate is mapped to by tls.client_identities.',
   PRIMARY KEY (`id`),
   UNIQUE KEY `id_UNIQUE` (`id`),
-  UNIQUE KEY `token_UNIQUE` (`token`)
+  UNIQUE KEY `token_UNIQUE` (`token`),
+  UNIQUE KEY `cert_identity_UNIQUE` (`cert_identity`)
 ) ENGINE=InnoDB AUTO_INCREMENT=1 DEFAULT CHARSET=utf8;
 /*!40101 SET character_set_client = @saved_cs_client */;
 
@@ -43,6 +47,7 @@ DROP TABLE IF EXISTS `environments`;
 CREATE TABLE `environments` (
   `id` int(11) NOT NULL AUTO_INCREMENT COMMENT 'Primary key for each entry in the table.',
   `name` varchar(255) NOT NULL COMMENT 'Name of the environment.',
+  `settings` text DEFAULT NULL COMMENT 'JSON deploy settings (machine, docker_registry...). NULL uses the config file.',
   `created_at` datetime NOT NULL COMMENT 'Create date for this row.',
   `updated_at` datetime NOT NULL COMMENT 'Last update date for this row.',
   `notes` text COMMENT 'General comments.',
@@ -72,6 +77,67 @@ CREATE TABLE `auth_tokens_environments` (
 ) ENGINE=InnoDB AUTO_INCREMENT=1 DEFAULT CHARSET=utf8;
 /*!40101 SET character_set_client = @saved_cs_client */;
 
+--
+-- Table structure for table `auth_tokens_rights`
+--
+
+DROP TABLE IF EXISTS `auth_tokens_rights`;
+/*!40101 SET @saved_cs_client     = @@character_set_client */;
+/*!40101 SET character_set_client = utf8 */;
+CREATE TABLE `auth_tokens_rights` (
+  `id` int(11) NOT NULL AUTO_INCREMENT COMMENT 'Primary key for each entry in the table.',
+  `auth_token_id` int(11) NOT NULL COMMENT 'Foreign key for an auth token.',
+  `name` varchar(255) NOT NULL COMMENT 'Name of the right granted, for example: approve, freeze, override.',
+  `created_at` datetime NOT NULL COMMENT 'Create date for this row.',
+  `updated_at` datetime NOT NULL COMMENT 'Last update date for this row.',
+  `notes` text COMMENT 'General comments.',
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `id_UNIQUE` (`id`),
+  UNIQUE KEY `token_right_UNIQUE` (`auth_token_id`,`name`)
+) ENGINE=InnoDB AUTO_INCREMENT=1 DEFAULT CHARSET=utf8;
+/*!40101 SET character_set_client = @saved_cs_client */;
+
+--
+-- Table structure for table `deploy_approvals`
+--
+
+DROP TABLE IF EXISTS `deploy_approvals`;
+/*!40101 SET @saved_cs_client     = @@character_set_client */;
+/*!40101 SET character_set_client = utf8 */;
+CREATE TABLE `deploy_approvals` (
+  `id` int(11) NOT NULL AUTO_INCREMENT COMMENT 'Primary key for each entry in the table.',
+  `deploy_id` varchar(255) NOT NULL COMMENT 'UUID of the deploy being approved.',
+  `auth_token_id` int(11) NOT NULL COMMENT 'Foreign key for the approving auth token.',
+  `created_at` datetime NOT NULL COMMENT 'Create date for this row.',
+  `updated_at` datetime NOT NULL COMMENT 'Last update date for this row.',
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `id_UNIQUE` (`id`),
+  UNIQUE KEY `deploy_token_UNIQUE` (`deploy_id`,`auth_token_id`)
+) ENGINE=InnoDB AUTO_INCREMENT=1 DEFAULT CHARSET=utf8;
+/*!40101 SET character_set_client = @saved_cs_client */;
+
+--
+-- Table structure for table `freezes`
+--
+
+DROP TABLE IF EXISTS `freezes`;
+/*!40101 SET @saved_cs_client     = @@character_set_client */;
+/*!40101 SET character_set_client = utf8 */;
+CREATE TABLE `freezes` (
+  `id` int(11) NOT NULL AUTO_INCREMENT COMMENT 'Primary key for each entry in the table.',
+  `environment` varchar(255) NOT NULL COMMENT 'Environment frozen, for example: prod.',
+  `reason` varchar(255) NOT NULL COMMENT 'Why deploys to the environment are frozen.',
+  `ends_at` datetime DEFAULT NULL COMMENT 'When the freeze ends (UTC). NULL until lifted.',
+  `lifted_at` datetime DEFAULT NULL COMMENT 'When the freeze was lifted early (UTC).',
+  `auth_token_id` int(11) NOT NULL COMMENT 'Foreign key for the auth token that set the freeze.',
+  `created_at` datetime NOT NULL COMMENT 'Create date for this row (UTC).',
+  `updated_at` datetime NOT NULL COMMENT 'Last update date for this row (UTC).',
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `id_UNIQUE` (`id`),
+  KEY `environment_IDX` (`environment`)
+) ENGINE=InnoDB AUTO_INCREMENT=1 DEFAULT CHARSET=utf8;
+/*!40101 SET character_set_client = @saved_cs_client */;
+
 --
 -- Table structure for table `deploys`
 --
@@ -79,23 +145,50 @@ CREATE TABLE `auth_tokens_environments` (
 DROP TABLE IF EXISTS `deploys`;
 /*!40101 SET @saved_cs_client     = @@character_set_client */;
 /*!40101 SET character_set_client = utf8 */;
-/* note status: Started = 1, Failed = 2, Success = 3 */;
+/* note status: Queued = 1, Started = 2, Success = 3, Failed = 4, PendingApproval = 5, Rejected = 6, Expired = 7, Superseded = 8 */;
 CREATE TABLE `deploys` (
   `id` int(11) NOT NULL AUTO_INCREMENT COMMENT 'Unique identifier for each row.',
   `deploy_id` varchar(255) NOT NULL COMMENT 'UUID assigned to this deployment.',
   `environment` varchar(255) NOT NULL COMMENT 'Environment deployed, for example: dev, stage, qa, prod.',
   `image_name` varchar(255) NOT NULL COMMENT 'Repository name being deployed, for example acme-video-mobile',
   `image_tag` varchar(255) NOT NULL COMMENT 'Version of the service being deployed e.g. 1.0.0-131, latest',
-  `status` int(11) NOT NULL DEFAULT '1' COMMENT 'Current status of the deploy: Queued, Started, Failed, Success.',
+  `status` int(11) NOT NULL DEFAULT '1' COMMENT 'Current status of the deploy: Queued, Started, Success, Failed, PendingApproval, Rejected, Expired, Superseded.',
   `message` varchar(255) DEFAULT NULL COMMENT 'A short status message.',
   `log` text COMMENT 'Complete set of log messages from the deploy.',
+  `request` text COMMENT 'Serialized deploy request held while the deploy is pending approval.',
+  `correlation_id` varchar(128) NOT NULL DEFAULT '' COMMENT 'Client X-Request-ID or trace ID of the request. Empty if none was sent.',
+  `started_at` datetime DEFAULT NULL COMMENT 'When the worker started the deploy.',
+  `finished_at` datetime DEFAULT NULL COMMENT 'When the deploy succeeded or failed.',
+  `failed_step` varchar(64) DEFAULT NULL COMMENT 'Step that failed, for example: download_image, update_etcd.',
+  `etcd_snapshot` mediumtext COMMENT 'JSON etcd2 keys as they were before the deploy changed them, to restore on rollback.',
   `updated_at` datetime NOT NULL COMMENT 'The update date and time of the deploy.',
   `created_at` datetime NOT NULL COMMENT 'The create date and time of the deploy.',
   PRIMARY KEY (`id`),
   UNIQUE KEY `id_UNIQUE` (`id`),
-  UNIQUE KEY `key_UNIQUE` (`deploy_id`)
+  UNIQUE KEY `key_UNIQUE` (`deploy_id`),
+  KEY `correlation_id_IDX` (`correlation_id`),
+  KEY `environment_created_at_IDX` (`environment`, `created_at`)
 ) ENGINE=InnoDB AUTO_INCREMENT=31 DEFAULT CHARSET=utf8;
 /*!40101 SET character_set_client = @saved_cs_client */;
+
+--
+-- Table structure for table `audit_log`
+--
+
+DROP TABLE IF EXISTS `audit_log`;
+/*!40101 SET @saved_cs_client     = @@character_set_client */;
+/*!40101 SET character_set_client = utf8 */;
+CREATE TABLE `audit_log` (
+  `id` int(11) NOT NULL AUTO_INCREMENT COMMENT 'Primary key for each entry in the table.',
+  `action` varchar(64) NOT NULL COMMENT 'Administrative action, for example: config.reload.',
+  `actor` varchar(255) NOT NULL COMMENT 'Auth token name, or what triggered the action, for example: SIGHUP.',
+  `detail` text COMMENT 'Outcome and summary of the action.',
+  `created_at` datetime NOT NULL COMMENT 'Create date for this row (UTC).',
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `id_UNIQUE` (`id`),
+  KEY `action_created_at_IDX` (`action`, `created_at`)
+) ENGINE=InnoDB AUTO_INCREMENT=1 DEFAULT CHARSET=utf8;
+/*!40101 SET character_set_client = @saved_cs_client */;
 /*!40103 SET TIME_ZONE=@OLD_TIME_ZONE */;
 
 /*!40101 SET SQL_MODE=@OLD_SQL_MODE */;
@@ -37,23 +37,32 @@ func main() {
 	}
 
 	// Check additional commands beyond the flags.
+	var command string
 	for _, arg := range flag.Args() {
 		switch strings.ToLower(arg) {
 		case "version":
 			server.PrintVersionAndExit()
 		case "help":
 			server.PrintUsageAndExit()
+		case "check-config", "doctor":
+			command = strings.ToLower(arg)
 		}
 	}
 
 	// Read config file into server options.
 	v := viper.New()
 	opt.SetConfigDefaults(v)
+	if command != "" {
+		server.CheckAndExit(opt, v, command == "doctor")
+	}
 	if err := v.ReadInConfig(); err != nil {
 		log.Errorf(err.Error())
 		os.Exit(1)
 	}
-	opt.FillConfig(v)
+	if err := opt.FillConfig(v); err != nil {
+		log.Errorf(err.Error())
+		os.Exit(1)
+	}
 
 	// Boot the server.
 	s := server.New(opt, log)
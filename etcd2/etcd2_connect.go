@@ -1,29 +1,67 @@
 package etcd2
 
 import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
 	"time"
 
 	"github.com/coreos/etcd/client"
 	"golang.org/x/net/context"
 )
 
+// DefaultTimeout is the time allowed for the response header of a request to an endpoint.
+const DefaultTimeout = 5 * time.Second
+
+// Config is the connection settings of an etcd2 cluster.
+type Config struct {
+	Endpoints []string      // Client URLs, tried in turn until one answers (ex: https://10.0.0.5:2379).
+	TLS       *tls.Config   // Client certificate and CA for https endpoints. Nil uses the defaults.
+	Username  string        // User of the etcd auth. Empty if auth is off.
+	Password  string        // Password of the user.
+	Timeout   time.Duration // Time allowed for the response header of a request. 0 uses DefaultTimeout.
+}
+
 // Etcd2Connect represents a connection to the etcd2 server.
 type Etcd2Connect struct {
-	etcd2 client.Client
+	etcd2     client.Client
+	transport *http.Transport
 }
 
-// NewDBConnect is a factory method that returns a new db connection.
-func NewEtcd2Connect(etcdEndpoint string) (*Etcd2Connect, error) {
+// NewEtcd2Connect is a factory method that returns a new etcd2 connection.
+func NewEtcd2Connect(cfg Config) (*Etcd2Connect, error) {
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = DefaultTimeout
+	}
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		Dial: (&net.Dialer{
+			Timeout:   cfg.Timeout,
+			KeepAlive: 30 * time.Second,
+		}).Dial,
+		TLSClientConfig:     cfg.TLS,
+		TLSHandshakeTimeout: 10 * time.Second,
+		IdleConnTimeout:     90 * time.Second,
+	}
 	c, err := client.New(client.Config{
-		Endpoints:               []string{etcdEndpoint},
-		Transport:               client.DefaultTransport,
-		HeaderTimeoutPerRequest: time.Second,
+		Endpoints:               cfg.Endpoints,
+		Transport:               transport,
+		Username:                cfg.Username,
+		Password:                cfg.Password,
+		HeaderTimeoutPerRequest: cfg.Timeout,
 	})
 	if err != nil {
 		return nil, err
 	}
 
-	return &Etcd2Connect{etcd2: c}, nil
+	return &Etcd2Connect{etcd2: c, transport: transport}, nil
+}
+
+// Close closes the idle connections to the endpoints.
+func (e *Etcd2Connect) Close() {
+	e.transport.CloseIdleConnections()
 }
 
 // Set sets the etcd2 key with a value and returns the response or an error.
@@ -62,3 +100,249 @@ func (e *Etcd2Connect) Get(data map[string]string) (map[string]string, error) {
 	}
 	return result, nil
 }
+
+// Key is an etcd2 key with its value and options. A directory has no value.
+type Key struct {
+	Key   string        `json:"key"`             // Full path of the key (ex: /myapp/db/host).
+	Value string        `json:"value,omitempty"` // Value of the key.
+	TTL   time.Duration `json:"ttl,omitempty"`   // Time before the key expires. 0 never expires.
+	Dir   bool          `json:"dir,omitempty"`   // Is the key a directory?
+	Index uint64        `json:"index,omitempty"` // Modified index when read. 0 if the key did not exist.
+}
+
+// Snapshot is the state of keys before a change, to restore them if the change fails.
+type Snapshot struct {
+	Keys    []*Key `json:"keys"`              // Keys that existed, as they were.
+	Missing []*Key `json:"missing"`           // Keys that did not exist.
+	Written []*Key `json:"written,omitempty"` // Keys the change wrote. Index is the one written, 0 if deleted.
+}
+
+// Undo is how to put back a key a change wrote.
+type Undo struct {
+	Written *Key // The key as the change left it.
+	Before  *Key // The key as it was, or nil if it did not exist.
+}
+
+// Undos returns how to put back the keys the change wrote: the keys to delete first, deepest first, then
+// the keys to set in path order.
+func (s *Snapshot) Undos() []Undo {
+	before := make(map[string]*Key)
+	for _, k := range s.Keys {
+		before[k.Key] = k
+	}
+	var del, set []Undo
+	for _, w := range s.Written {
+		b := before[w.Key]
+		if b == nil {
+			del = append(del, Undo{Written: w})
+		} else {
+			set = append(set, Undo{Written: w, Before: b})
+		}
+	}
+	sort.Slice(del, func(i, j int) bool { return del[i].Written.Key > del[j].Written.Key })
+	sort.Slice(set, func(i, j int) bool { return set[i].Written.Key < set[j].Written.Key })
+	return append(del, set...)
+}
+
+// Restored returns the number of keys a restore set back as they were and the number it removed, given
+// the paths of the keys it skipped.
+func (s *Snapshot) Restored(skipped []string) (int, int) {
+	skip := make(map[string]bool)
+	for _, p := range skipped {
+		skip[p] = true
+	}
+	var restored, removed int
+	for _, u := range s.Undos() {
+		switch {
+		case skip[u.Written.Key]:
+		case u.Before == nil:
+			removed++
+		default:
+			restored++
+		}
+	}
+	return restored, removed
+}
+
+// NewSnapshot returns the snapshot of the keys about to change from their live state, by path.
+func NewSnapshot(keys []*Key, live map[string]*Key) *Snapshot {
+	s := &Snapshot{Keys: []*Key{}, Missing: []*Key{}}
+	for _, k := range keys {
+		if l, ok := live[k.Key]; ok {
+			s.Keys = append(s.Keys, l)
+		} else {
+			s.Missing = append(s.Missing, &Key{Key: k.Key, Dir: k.Dir})
+		}
+	}
+	sort.Slice(s.Keys, func(i, j int) bool { return s.Keys[i].Key < s.Keys[j].Key })
+	sort.Slice(s.Missing, func(i, j int) bool { return s.Missing[i].Key > s.Missing[j].Key })
+	return s
+}
+
+// SetKeys sets the etcd2 keys in order and returns the first error. A directory that already
+// exists is kept, with its TTL refreshed if one is given.
+func (e *Etcd2Connect) SetKeys(keys []*Key) error {
+	kapi := client.NewKeysAPI(e.etcd2)
+	for _, k := range keys {
+		if _, err := set(kapi, k, false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CompareAndSwap sets keys, then deletes keys, in order. Each is changed only if it is as it was read:
+// its Index is the modified index it had, or 0 if it did not exist. Returns the keys changed, as they
+// were written, and the first error. The keys changed before an error stay changed.
+func (e *Etcd2Connect) CompareAndSwap(keys []*Key, del []*Key) ([]*Key, error) {
+	kapi := client.NewKeysAPI(e.etcd2)
+	written := []*Key{}
+	for _, k := range keys {
+		index, err := set(kapi, k, true)
+		if err != nil {
+			return written, fmt.Errorf("%s: %s", k.Key, err)
+		}
+		if k.Dir && index == 0 {
+			continue // The directory existed.
+		}
+		w := *k
+		w.Index = index
+		written = append(written, &w)
+	}
+	for _, k := range del {
+		opts := &client.DeleteOptions{Dir: k.Dir}
+		if !k.Dir {
+			opts.PrevIndex = k.Index
+		}
+		_, err := kapi.Delete(context.Background(), k.Key, opts)
+		if err != nil && !isKeyNotFound(err) {
+			return written, fmt.Errorf("%s: %s", k.Key, err)
+		}
+		if err == nil {
+			written = append(written, &Key{Key: k.Key, Dir: k.Dir})
+		}
+	}
+	return written, nil
+}
+
+// Restore puts back the keys a change wrote as they were before it (see Snapshot.Undos). A key is only
+// put back if it is still as the change left it, so a later change by someone else is kept. Every key
+// is tried; returns the paths of the keys skipped because they changed, and the first error.
+func (e *Etcd2Connect) Restore(s *Snapshot) ([]string, error) {
+	kapi := client.NewKeysAPI(e.etcd2)
+	var skipped []string
+	var first error
+	for _, u := range s.Undos() {
+		var err error
+		w := u.Written
+		switch {
+		case u.Before == nil && w.Dir:
+			_, err = kapi.Delete(context.Background(), w.Key, &client.DeleteOptions{Dir: true})
+		case u.Before == nil:
+			_, err = kapi.Delete(context.Background(), w.Key, &client.DeleteOptions{PrevIndex: w.Index})
+		case u.Before.Dir:
+			opts := &client.SetOptions{Dir: true, TTL: u.Before.TTL, PrevExist: client.PrevNoExist}
+			_, err = kapi.Set(context.Background(), w.Key, "", opts)
+		default:
+			opts := &client.SetOptions{TTL: u.Before.TTL, PrevIndex: w.Index}
+			if w.Index == 0 {
+				opts.PrevExist = client.PrevNoExist // Deleted by the change.
+			}
+			_, err = kapi.Set(context.Background(), w.Key, u.Before.Value, opts)
+		}
+		switch {
+		case err == nil || (u.Before == nil && isKeyNotFound(err)):
+		case isCompareFailed(err):
+			skipped = append(skipped, w.Key)
+		case first == nil:
+			first = fmt.Errorf("%s: %s", w.Key, err)
+		}
+	}
+	return skipped, first
+}
+
+// set sets a key and returns its modified index. A directory that already exists is kept, with its TTL
+// refreshed if one is given, and returns an index of 0. With cas, a value is only set if the key is as it was
+// read (see Key.Index).
+func set(kapi client.KeysAPI, k *Key, cas bool) (uint64, error) {
+	if !k.Dir {
+		opts := &client.SetOptions{TTL: k.TTL}
+		if cas && k.Index > 0 {
+			opts.PrevIndex = k.Index
+		} else if cas {
+			opts.PrevExist = client.PrevNoExist
+		}
+		resp, err := kapi.Set(context.Background(), k.Key, k.Value, opts)
+		if err != nil {
+			return 0, err
+		}
+		return resp.Node.ModifiedIndex, nil
+	}
+	opts := &client.SetOptions{Dir: true, TTL: k.TTL, PrevExist: client.PrevNoExist}
+	resp, err := kapi.Set(context.Background(), k.Key, "", opts)
+	if err == nil {
+		return resp.Node.ModifiedIndex, nil
+	}
+	if cerr, ok := err.(client.Error); ok && cerr.Code == client.ErrorCodeNodeExist {
+		err = nil
+		if k.TTL > 0 {
+			opts.PrevExist = client.PrevExist
+			_, err = kapi.Set(context.Background(), k.Key, "", opts)
+		}
+	}
+	return 0, err
+}
+
+// GetTree returns the key at a path and every key below it, by path. Returns an empty map if the
+// path does not exist.
+func (e *Etcd2Connect) GetTree(key string) (map[string]*Key, error) {
+	kapi := client.NewKeysAPI(e.etcd2)
+	result := make(map[string]*Key)
+	resp, err := kapi.Get(context.Background(), key, &client.GetOptions{Recursive: true})
+	if isKeyNotFound(err) {
+		return result, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var walk func(n *client.Node)
+	walk = func(n *client.Node) {
+		result[n.Key] = &Key{Key: n.Key, Value: n.Value, TTL: n.TTLDuration(), Dir: n.Dir, Index: n.ModifiedIndex}
+		for _, child := range n.Nodes {
+			walk(child)
+		}
+	}
+	walk(resp.Node)
+	return result, nil
+}
+
+// Delete removes a key, or a directory that is empty. A key that does not exist is not an error.
+func (e *Etcd2Connect) Delete(key string, dir bool) error {
+	kapi := client.NewKeysAPI(e.etcd2)
+	if _, err := kapi.Delete(context.Background(), key, &client.DeleteOptions{Dir: dir}); err != nil &&
+		!isKeyNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+// isCompareFailed returns true if the error is for a key that is no longer as it was expected: changed,
+// created, deleted, or a directory that is not empty.
+func isCompareFailed(err error) bool {
+	cerr, ok := err.(client.Error)
+	if !ok {
+		return false
+	}
+	switch cerr.Code {
+	case client.ErrorCodeKeyNotFound, client.ErrorCodeTestFailed, client.ErrorCodeNodeExist,
+		client.ErrorCodeDirNotEmpty:
+		return true
+	}
+	return false
+}
+
+// isKeyNotFound returns true if the error is for a key that does not exist.
+func isKeyNotFound(err error) bool {
+	cerr, ok := err.(client.Error)
+	return ok && cerr.Code == client.ErrorCodeKeyNotFound
+}
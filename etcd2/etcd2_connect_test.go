@@ -0,0 +1,231 @@
+package etcd2
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"go.etcd.io/etcd/server/v3/embed"
+)
+
+func TestNewSnapshot(t *testing.T) {
+	t.Parallel()
+	live := map[string]*Key{
+		"/myapp/db/host": {Key: "/myapp/db/host", Value: "db1.internal", Index: 7},
+		"/myapp/old":     {Key: "/myapp/old", Value: "1", TTL: time.Minute, Index: 3},
+	}
+	s := NewSnapshot([]*Key{
+		{Key: "/myapp/old"},
+		{Key: "/myapp/db/host", Value: "db2.internal"},
+		{Key: "/myapp/cache", Dir: true},
+		{Key: "/myapp/cache/size", Value: "10"},
+	}, live)
+
+	if len(s.Keys) != 2 || s.Keys[0].Key != "/myapp/db/host" || s.Keys[0].Value != "db1.internal" ||
+		s.Keys[1].Key != "/myapp/old" || s.Keys[1].TTL != time.Minute {
+		t.Errorf("Expected the live keys in path order, received: %+v %+v", s.Keys[0], s.Keys[1])
+	}
+	if len(s.Missing) != 2 || s.Missing[0].Key != "/myapp/cache/size" || s.Missing[1].Key != "/myapp/cache" ||
+		!s.Missing[1].Dir {
+		t.Errorf("Expected the new keys deepest first, received: %+v %+v", s.Missing[0], s.Missing[1])
+	}
+
+	// Only the keys written are put back: the keys to delete deepest first, then the others.
+	s.Written = []*Key{
+		{Key: "/myapp/cache", Dir: true, Index: 9},
+		{Key: "/myapp/cache/size", Value: "10", Index: 10},
+		{Key: "/myapp/db/host", Value: "db2.internal", Index: 11},
+	}
+	undos := s.Undos()
+	if len(undos) != 3 || undos[0].Written.Key != "/myapp/cache/size" || undos[1].Before != nil ||
+		undos[2].Before.Value != "db1.internal" {
+		t.Errorf("Unexpected undos: %+v", undos)
+	}
+	if restored, removed := s.Restored([]string{"/myapp/cache"}); restored != 1 || removed != 1 {
+		t.Errorf("Expected 1 key restored and 1 removed, received %d and %d.", restored, removed)
+	}
+}
+
+func TestEtcd2FailoverAndAuth(t *testing.T) {
+	t.Parallel()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, password, ok := r.BasicAuth(); !ok || user != "deployer" || password != "secret" {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"errorCode":110,"message":"The request requires user authentication","index":0}`)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Etcd-Index", "5")
+		fmt.Fprint(w, `{"action":"get","node":{"key":"/myapp","dir":true,"nodes":[`+
+			`{"key":"/myapp/db","value":"db1.internal","modifiedIndex":5,"createdIndex":5}]}}`)
+	}))
+	defer srv.Close()
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close() // An endpoint that is not answering.
+
+	c, err := NewEtcd2Connect(Config{Endpoints: []string{down.URL, srv.URL}, Username: "deployer",
+		Password: "secret", Timeout: time.Second})
+	if err != nil {
+		t.Fatalf("Unable to connect: %s", err)
+	}
+	keys, err := c.GetTree("/myapp")
+	if err != nil {
+		t.Fatalf("Expected the second endpoint to answer, received: %s", err)
+	}
+	if k := keys["/myapp/db"]; k == nil || k.Value != "db1.internal" || k.Index != 5 {
+		t.Errorf("Unexpected keys: %v", keys)
+	}
+
+	c, _ = NewEtcd2Connect(Config{Endpoints: []string{srv.URL}, Username: "deployer", Password: "wrong"})
+	if _, err := c.GetTree("/myapp"); err == nil {
+		t.Errorf("Expected an auth error.")
+	}
+}
+
+// startEtcd runs an etcd server with the v2 API in-process and returns a connection to it. The server
+// is stopped when the test ends.
+func startEtcd(t *testing.T) *Etcd2Connect {
+	t.Helper()
+	cfg := embed.NewConfig()
+	cfg.Dir = t.TempDir()
+	cfg.LogLevel = "error"
+	cfg.EnableV2 = true
+	client, peer := freeURL(t), freeURL(t)
+	cfg.ListenClientUrls, cfg.AdvertiseClientUrls = []url.URL{client}, []url.URL{client}
+	cfg.ListenPeerUrls, cfg.AdvertisePeerUrls = []url.URL{peer}, []url.URL{peer}
+	cfg.InitialCluster = cfg.InitialClusterFromName(cfg.Name)
+	e, err := embed.StartEtcd(cfg)
+	if err != nil {
+		t.Fatalf("Unable to start etcd: %s", err)
+	}
+	t.Cleanup(e.Close)
+	select {
+	case <-e.Server.ReadyNotify():
+	case <-time.After(30 * time.Second):
+		t.Fatalf("etcd did not start.")
+	}
+	c, err := NewEtcd2Connect(Config{Endpoints: []string{client.String()}})
+	if err != nil {
+		t.Fatalf("Unable to connect: %s", err)
+	}
+	return c
+}
+
+// freeURL returns a local URL on a port that is free.
+func freeURL(t *testing.T) url.URL {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to find a free port: %s", err)
+	}
+	defer l.Close()
+	return url.URL{Scheme: "http", Host: l.Addr().String()}
+}
+
+func TestEtcd2GetTreeAndDelete(t *testing.T) {
+	t.Parallel()
+	c := startEtcd(t)
+	if err := c.SetKeys([]*Key{
+		{Key: "/myapp/db/host", Value: "db1.internal"},
+		{Key: "/myapp/locks", Dir: true},
+		{Key: "/myapp/old/flag", Value: "1", TTL: time.Minute},
+	}); err != nil {
+		t.Fatalf("Unable to set the keys: %s", err)
+	}
+
+	keys, err := c.GetTree("/myapp")
+	if err != nil {
+		t.Fatalf("Unable to read the keys: %s", err)
+	}
+	if len(keys) != 6 || !keys["/myapp"].Dir || !keys["/myapp/db"].Dir || !keys["/myapp/locks"].Dir ||
+		keys["/myapp/db/host"].Value != "db1.internal" || keys["/myapp/db/host"].Index == 0 {
+		t.Fatalf("Expected the keys and their directories, received: %v", keys)
+	}
+	if ttl := keys["/myapp/old/flag"].TTL; ttl <= 50*time.Second || ttl > time.Minute {
+		t.Errorf("Expected a TTL of about a minute, received %s.", ttl)
+	}
+	if missing, err := c.GetTree("/missing"); err != nil || len(missing) != 0 {
+		t.Errorf("Expected no keys for a missing path, received %v: %v", missing, err)
+	}
+
+	// A directory is only deleted once empty. A key that does not exist is not an error.
+	if err := c.Delete("/myapp/old", true); err == nil {
+		t.Errorf("Expected an error deleting a directory that is not empty.")
+	}
+	for _, k := range []*Key{{Key: "/myapp/old/flag"}, {Key: "/myapp/old", Dir: true}, {Key: "/myapp/nokey"}} {
+		if err := c.Delete(k.Key, k.Dir); err != nil {
+			t.Errorf("Unable to delete %s: %s", k.Key, err)
+		}
+	}
+	if keys, _ := c.GetTree("/myapp"); keys["/myapp/old"] != nil || keys["/myapp/old/flag"] != nil {
+		t.Errorf("Expected the keys deleted, received: %v", keys)
+	}
+}
+
+func TestEtcd2CompareAndSwap(t *testing.T) {
+	t.Parallel()
+	c := startEtcd(t)
+	if _, err := c.CompareAndSwap([]*Key{
+		{Key: "/myapp/db/host", Value: "db1.internal"},
+		{Key: "/myapp/db/port", Value: "5432"},
+		{Key: "/myapp/old", Value: "1"},
+	}, nil); err != nil {
+		t.Fatalf("Unable to create the keys: %s", err)
+	}
+	if _, err := c.CompareAndSwap([]*Key{{Key: "/myapp/db/host", Value: "db2.internal"}}, nil); err == nil {
+		t.Errorf("Expected an error creating a key that exists.")
+	}
+	live, _ := c.GetTree("/myapp")
+	snapshot := NewSnapshot([]*Key{{Key: "/myapp/db/host"}, {Key: "/myapp/db/port"}, {Key: "/myapp/new"},
+		{Key: "/myapp/old"}}, live)
+	host := live["/myapp/db/host"]
+	written, err := c.CompareAndSwap([]*Key{
+		{Key: "/myapp/db/host", Value: "db2.internal", Index: host.Index},
+		{Key: "/myapp/db/port", Value: "6432", Index: live["/myapp/db/port"].Index},
+		{Key: "/myapp/new", Value: "x"},
+	}, []*Key{live["/myapp/old"]})
+	if err != nil {
+		t.Fatalf("Unable to update the keys: %s", err)
+	}
+	after, _ := c.GetTree("/myapp")
+	if len(written) != 4 || written[0].Index != after["/myapp/db/host"].Index || written[3].Index != 0 {
+		t.Errorf("Expected the keys written with their new index, received: %v", written)
+	}
+	snapshot.Written = written
+
+	// The key has changed since it was read.
+	if _, err := c.CompareAndSwap([]*Key{{Key: "/myapp/db/host", Value: "db3.internal", Index: host.Index}}, nil); err == nil {
+		t.Errorf("Expected a compare failure.")
+	}
+	// Someone else changes a key after the deploy wrote it.
+	if _, err := c.CompareAndSwap([]*Key{{Key: "/myapp/db/port", Value: "7432", Index: after["/myapp/db/port"].Index}},
+		nil); err != nil {
+		t.Fatalf("Unable to update the key: %s", err)
+	}
+
+	skipped, err := c.Restore(snapshot)
+	if err != nil {
+		t.Fatalf("Unable to restore: %s", err)
+	}
+	if len(skipped) != 1 || skipped[0] != "/myapp/db/port" {
+		t.Errorf("Expected the changed key skipped, received: %v", skipped)
+	}
+	restored, _ := c.GetTree("/myapp")
+	if restored["/myapp/db/host"].Value != "db1.internal" || restored["/myapp/new"] != nil ||
+		restored["/myapp/old"].Value != "1" || restored["/myapp/db/port"].Value != "7432" {
+		t.Errorf("Expected the snapshot restored and the concurrent value kept, received: %v", restored)
+	}
+
+	// A failure partway returns the keys written before it.
+	written, err = c.CompareAndSwap([]*Key{
+		{Key: "/myapp/a", Value: "1"},
+		{Key: "/myapp/db/host", Value: "db4.internal", Index: host.Index},
+	}, nil)
+	if err == nil || len(written) != 1 || written[0].Key != "/myapp/a" {
+		t.Errorf("Expected the keys written before the failure, received %v: %v", written, err)
+	}
+}
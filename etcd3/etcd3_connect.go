@@ -0,0 +1,513 @@
+// Package etcd3 updates keys in an etcd v3 cluster through the JSON gateway of the v3 API
+// (ex: http://10.0.0.5:2379/v3/kv/range), so no gRPC client is needed. Keys and snapshots use the
+// same types as the etcd2 package.
+package etcd3
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/composer22/docker-deploy-server/etcd2"
+)
+
+// DefaultTimeout is the time allowed for a request to an endpoint.
+const DefaultTimeout = 5 * time.Second
+
+// Config is the connection settings of an etcd v3 cluster.
+type Config struct {
+	Endpoints []string      // Client URLs, tried in order (ex: https://10.0.0.5:2379).
+	TLS       *tls.Config   // Client certificate and CA for https endpoints. Nil uses the defaults.
+	Username  string        // User of the etcd auth. Empty if auth is off.
+	Password  string        // Password of the user.
+	Timeout   time.Duration // Time allowed for a request to an endpoint. 0 uses DefaultTimeout.
+}
+
+// Etcd3Connect represents a connection to an etcd v3 cluster.
+type Etcd3Connect struct {
+	cfg    Config
+	client *http.Client
+	mu     sync.Mutex // For locking access to the token.
+	token  string     // Auth token, once authenticated.
+}
+
+// NewEtcd3Connect is a factory method that returns a new etcd v3 connection.
+func NewEtcd3Connect(cfg Config) (*Etcd3Connect, error) {
+	if len(cfg.Endpoints) == 0 {
+		return nil, errors.New("No etcd3 endpoints.")
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = DefaultTimeout
+	}
+	return &Etcd3Connect{
+		cfg: cfg,
+		client: &http.Client{
+			Timeout: cfg.Timeout,
+			Transport: &http.Transport{
+				TLSClientConfig: cfg.TLS,
+				Proxy:           http.ProxyFromEnvironment,
+				IdleConnTimeout: 90 * time.Second,
+			},
+		},
+	}, nil
+}
+
+// Close closes the idle connections to the endpoints.
+func (c *Etcd3Connect) Close() {
+	c.client.CloseIdleConnections()
+}
+
+// sentOnce are the APIs not retried on another endpoint once a request was sent, as the first may have
+// applied it.
+var sentOnce = map[string]bool{"/kv/txn": true, "/lease/grant": true}
+
+// UncertainError is the error of a request that was sent but got no answer: it may have been applied.
+type UncertainError struct {
+	Err error
+}
+
+// Error returns the error of the request.
+func (u *UncertainError) Error() string {
+	return u.Err.Error()
+}
+
+// int64s is an int64 of the gateway JSON, which quotes 64 bit numbers.
+type int64s int64
+
+// UnmarshalJSON reads a quoted or bare number.
+func (i *int64s) UnmarshalJSON(b []byte) error {
+	n, err := strconv.ParseInt(strings.Trim(string(b), `"`), 10, 64)
+	*i = int64s(n)
+	return err
+}
+
+// MarshalJSON writes a quoted number.
+func (i int64s) MarshalJSON() ([]byte, error) {
+	return []byte(strconv.Quote(strconv.FormatInt(int64(i), 10))), nil
+}
+
+// kv is a key of a range response.
+type kv struct {
+	Key         []byte `json:"key"`
+	Value       []byte `json:"value"`
+	ModRevision int64s `json:"mod_revision"`
+	Lease       int64s `json:"lease"`
+}
+
+// rangeRequest reads a key, or the keys from key up to range_end.
+type rangeRequest struct {
+	Key      []byte `json:"key"`
+	RangeEnd []byte `json:"range_end,omitempty"`
+}
+
+// compare is a condition of a transaction.
+type compare struct {
+	Key            []byte  `json:"key"`
+	Target         string  `json:"target"` // MOD or CREATE.
+	Result         string  `json:"result"` // EQUAL.
+	ModRevision    *int64s `json:"mod_revision,omitempty"`
+	CreateRevision *int64s `json:"create_revision,omitempty"`
+}
+
+// op is a put or delete of a transaction.
+type op struct {
+	Put    *putRequest   `json:"request_put,omitempty"`
+	Delete *rangeRequest `json:"request_delete_range,omitempty"`
+}
+
+// putRequest sets a key, attached to a lease for a TTL.
+type putRequest struct {
+	Key   []byte `json:"key"`
+	Value []byte `json:"value"`
+	Lease int64s `json:"lease,omitempty"`
+}
+
+// txnRequest applies every op if every compare holds.
+type txnRequest struct {
+	Compare []compare `json:"compare"`
+	Success []op      `json:"success"`
+}
+
+// txnResponse is whether a transaction was applied, and the revision it was applied at.
+type txnResponse struct {
+	Header struct {
+		Revision int64s `json:"revision"`
+	} `json:"header"`
+	Succeeded bool `json:"succeeded"`
+}
+
+// GetTree returns the key at a path and every key below it, by path. v3 has no directories, so a
+// directory is returned for each parent path of a key found below the path. Returns an empty map if
+// there are no keys.
+func (e *Etcd3Connect) GetTree(key string) (map[string]*etcd2.Key, error) {
+	result := make(map[string]*etcd2.Key)
+	leases := make(map[int64s]time.Duration)
+	key = strings.TrimRight(key, "/")
+	var reqs []rangeRequest
+	if key != "" {
+		reqs = append(reqs, rangeRequest{Key: []byte(key)})
+	}
+	reqs = append(reqs, rangeRequest{Key: []byte(key + "/"), RangeEnd: []byte(key + "0")}) // '0' follows '/'.
+	for _, req := range reqs {
+		var resp struct {
+			Kvs []kv `json:"kvs"`
+		}
+		if err := e.call("/kv/range", req, &resp); err != nil {
+			return nil, err
+		}
+		for _, k := range resp.Kvs {
+			ttl, ok := leases[k.Lease]
+			if k.Lease != 0 && !ok {
+				var err error
+				if ttl, err = e.leaseTTL(k.Lease); err != nil {
+					return nil, err
+				}
+				leases[k.Lease] = ttl
+			}
+			p := string(k.Key)
+			result[p] = &etcd2.Key{Key: p, Value: string(k.Value), TTL: ttl, Index: uint64(k.ModRevision)}
+			for parent := path.Dir(p); p != key && parent != "/" && len(parent) >= len(key); parent = path.Dir(parent) {
+				if _, ok := result[parent]; !ok {
+					result[parent] = &etcd2.Key{Key: parent, Dir: true}
+				}
+			}
+		}
+	}
+	return result, nil
+}
+
+// CompareAndSwap sets keys, then deletes keys, in one transaction. The transaction is applied only if
+// every key is as it was read: its Index is the modified revision it had, or 0 if it did not exist.
+// Directories are skipped: v3 has none. Returns the keys changed, with the revision they were written
+// at, or none if the transaction was not applied.
+func (e *Etcd3Connect) CompareAndSwap(keys []*etcd2.Key, del []*etcd2.Key) ([]*etcd2.Key, error) {
+	txn := txnRequest{Compare: []compare{}, Success: []op{}}
+	for _, k := range append(append([]*etcd2.Key{}, keys...), del...) {
+		if !k.Dir {
+			txn.Compare = append(txn.Compare, compareIndex(k.Key, k.Index))
+		}
+	}
+	leases, err := e.addOps(&txn, keys, del)
+	if err != nil {
+		e.revokeLeases(leases)
+		return nil, err
+	}
+	var resp txnResponse
+	err = e.call("/kv/txn", txn, &resp)
+	if _, ok := err.(*UncertainError); ok {
+		// The leases are kept: the transaction may have been applied, or still be. They expire anyway.
+		rev, applied, rerr := e.txnApplied(keys, del)
+		if rerr != nil || !applied {
+			return nil, err
+		}
+		resp.Succeeded, resp.Header.Revision = true, int64s(rev)
+	} else if err != nil {
+		e.revokeLeases(leases)
+		return nil, err
+	}
+	if !resp.Succeeded {
+		e.revokeLeases(leases)
+		return nil, errors.New("Keys were changed by someone else since they were read.")
+	}
+	written := []*etcd2.Key{}
+	for _, k := range keys {
+		if !k.Dir {
+			w := *k
+			w.Index = uint64(resp.Header.Revision)
+			written = append(written, &w)
+		}
+	}
+	for _, k := range del {
+		if !k.Dir {
+			written = append(written, &etcd2.Key{Key: k.Key})
+		}
+	}
+	return written, nil
+}
+
+// Restore puts back the keys a change wrote as they were before it (see Snapshot.Undos), one
+// transaction per key. A key is only put back if it is still as the change left it, so a later change
+// by someone else is kept. Every key is tried; returns the paths of the keys skipped because they
+// changed, and the first error.
+func (e *Etcd3Connect) Restore(s *etcd2.Snapshot) ([]string, error) {
+	var skipped []string
+	var first error
+	for _, u := range s.Undos() {
+		if u.Written.Dir || (u.Before != nil && u.Before.Dir) {
+			continue
+		}
+		txn := txnRequest{Compare: []compare{compareIndex(u.Written.Key, u.Written.Index)}, Success: []op{}}
+		var leases []int64s
+		var err error
+		if u.Before == nil {
+			leases, err = e.addOps(&txn, nil, []*etcd2.Key{u.Written})
+		} else {
+			leases, err = e.addOps(&txn, []*etcd2.Key{u.Before}, nil)
+		}
+		var resp txnResponse
+		if err == nil {
+			err = e.call("/kv/txn", txn, &resp)
+		}
+		if _, uncertain := err.(*UncertainError); !uncertain && (err != nil || !resp.Succeeded) {
+			e.revokeLeases(leases)
+		}
+		switch {
+		case err != nil && first == nil:
+			first = fmt.Errorf("%s: %s", u.Written.Key, err)
+		case err == nil && !resp.Succeeded:
+			skipped = append(skipped, u.Written.Key)
+		}
+	}
+	return skipped, first
+}
+
+// txnApplied re-reads the keys of a transaction whose response was lost, to tell whether it was applied:
+// every key is as it left it. Returns the revision it was applied at, 0 if it only deleted keys.
+func (e *Etcd3Connect) txnApplied(keys []*etcd2.Key, del []*etcd2.Key) (uint64, bool, error) {
+	var rev uint64
+	for _, k := range append(append([]*etcd2.Key{}, keys...), del...) {
+		if k.Dir {
+			continue
+		}
+		var resp struct {
+			Kvs []kv `json:"kvs"`
+		}
+		if err := e.call("/kv/range", rangeRequest{Key: []byte(k.Key)}, &resp); err != nil {
+			return 0, false, err
+		}
+		deleted := len(resp.Kvs) == 0
+		if deleted != isDeleted(k, del) {
+			return 0, false, nil
+		}
+		if deleted {
+			continue
+		}
+		// The puts of a transaction are all at its revision, later than any read.
+		r := uint64(resp.Kvs[0].ModRevision)
+		if string(resp.Kvs[0].Value) != k.Value || r <= k.Index || (rev != 0 && r != rev) {
+			return 0, false, nil
+		}
+		rev = r
+	}
+	return rev, true, nil
+}
+
+// isDeleted returns true if a key is one of the keys to delete.
+func isDeleted(k *etcd2.Key, del []*etcd2.Key) bool {
+	for _, d := range del {
+		if d == k {
+			return true
+		}
+	}
+	return false
+}
+
+// compareIndex returns the compare that a key has the modified revision of an index, or does not exist
+// if the index is 0.
+func compareIndex(key string, index uint64) compare {
+	rev := int64s(index)
+	if index == 0 {
+		return compare{Key: []byte(key), Result: "EQUAL", Target: "CREATE", CreateRevision: &rev}
+	}
+	return compare{Key: []byte(key), Result: "EQUAL", Target: "MOD", ModRevision: &rev}
+}
+
+// addOps adds a put for each key to set and a delete for each key to delete. Keys with a TTL are
+// attached to a lease granted for that TTL. Returns the leases granted, to revoke if the transaction
+// is not applied.
+func (e *Etcd3Connect) addOps(txn *txnRequest, keys []*etcd2.Key, del []*etcd2.Key) ([]int64s, error) {
+	leases := make(map[time.Duration]int64s)
+	granted := func() []int64s {
+		ids := make([]int64s, 0, len(leases))
+		for _, id := range leases {
+			ids = append(ids, id)
+		}
+		return ids
+	}
+	for _, k := range keys {
+		if k.Dir {
+			continue
+		}
+		put := &putRequest{Key: []byte(k.Key), Value: []byte(k.Value)}
+		if k.TTL > 0 {
+			id, ok := leases[k.TTL]
+			if !ok {
+				var err error
+				if id, err = e.grantLease(k.TTL); err != nil {
+					return granted(), err
+				}
+				leases[k.TTL] = id
+			}
+			put.Lease = id
+		}
+		txn.Success = append(txn.Success, op{Put: put})
+	}
+	for _, k := range del {
+		if !k.Dir {
+			txn.Success = append(txn.Success, op{Delete: &rangeRequest{Key: []byte(k.Key)}})
+		}
+	}
+	return granted(), nil
+}
+
+// grantLease returns a new lease that expires after the TTL.
+func (e *Etcd3Connect) grantLease(ttl time.Duration) (int64s, error) {
+	var resp struct {
+		ID int64s `json:"ID"`
+	}
+	secs := int64s((ttl + time.Second - 1) / time.Second)
+	if err := e.call("/lease/grant", struct {
+		TTL int64s `json:"TTL"`
+	}{secs}, &resp); err != nil {
+		return 0, err
+	}
+	return resp.ID, nil
+}
+
+// revokeLeases revokes leases granted for a transaction that was not applied, so they do not linger
+// until they expire. Errors are ignored: an unrevoked lease still expires after its TTL.
+func (e *Etcd3Connect) revokeLeases(ids []int64s) {
+	for _, id := range ids {
+		e.call("/lease/revoke", struct {
+			ID int64s `json:"ID"`
+		}{id}, nil)
+	}
+}
+
+// leaseTTL returns the time left on a lease.
+func (e *Etcd3Connect) leaseTTL(id int64s) (time.Duration, error) {
+	var resp struct {
+		TTL int64s `json:"TTL"`
+	}
+	if err := e.call("/lease/timetolive", struct {
+		ID int64s `json:"ID"`
+	}{id}, &resp); err != nil {
+		return 0, err
+	}
+	if resp.TTL < 0 {
+		return 0, nil
+	}
+	return time.Duration(resp.TTL) * time.Second, nil
+}
+
+// call posts a request to the v3 API, trying each endpoint in turn until one answers. With auth on,
+// a token is requested first and again if it has expired. A transaction or lease grant sent to an
+// endpoint that did not answer is not sent again: an UncertainError is returned.
+func (e *Etcd3Connect) call(api string, req interface{}, resp interface{}) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	var last error
+	for _, endpoint := range e.cfg.Endpoints {
+		url := strings.TrimRight(endpoint, "/") + "/v3" + api
+		for retry := 0; retry < 2; retry++ {
+			token, err := e.authToken(endpoint, retry > 0)
+			if err != nil {
+				last = err
+				break
+			}
+			status, b, err := e.post(url, token, body)
+			if err != nil && sentOnce[api] && !notSent(err) {
+				return &UncertainError{Err: err}
+			}
+			if err != nil {
+				last = err // Unreachable: try the next endpoint.
+				break
+			}
+			if status == http.StatusUnauthorized && token != "" && retry == 0 {
+				continue // Token expired: authenticate again.
+			}
+			if status != http.StatusOK {
+				return gatewayError(status, b)
+			}
+			if resp == nil {
+				return nil
+			}
+			return json.Unmarshal(b, resp)
+		}
+	}
+	return last
+}
+
+// authToken returns the auth token, authenticating with an endpoint if there is none yet or renew is
+// set. Returns an empty token if auth is off.
+func (e *Etcd3Connect) authToken(endpoint string, renew bool) (string, error) {
+	if e.cfg.Username == "" {
+		return "", nil
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.token != "" && !renew {
+		return e.token, nil
+	}
+	body, _ := json.Marshal(struct {
+		Name     string `json:"name"`
+		Password string `json:"password"`
+	}{e.cfg.Username, e.cfg.Password})
+	status, b, err := e.post(strings.TrimRight(endpoint, "/")+"/v3/auth/authenticate", "", body)
+	if err != nil {
+		return "", err
+	}
+	if status != http.StatusOK {
+		return "", gatewayError(status, b)
+	}
+	var resp struct {
+		Token string `json:"token"`
+	}
+	if err := json.Unmarshal(b, &resp); err != nil {
+		return "", err
+	}
+	e.token = resp.Token
+	return e.token, nil
+}
+
+// post sends a JSON body and returns the status and body of the response.
+func (e *Etcd3Connect) post(url string, token string, body []byte) (int, []byte, error) {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return 0, nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", token)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, b, err
+}
+
+// notSent returns true if a request failed before it was sent: the endpoint could not be reached.
+func notSent(err error) bool {
+	var op *net.OpError
+	return errors.As(err, &op) && op.Op == "dial"
+}
+
+// gatewayError returns the error of a failed gateway response.
+func gatewayError(status int, b []byte) error {
+	var resp struct {
+		Error   string `json:"error"`
+		Message string `json:"message"`
+	}
+	if json.Unmarshal(b, &resp) == nil && (resp.Message != "" || resp.Error != "") {
+		if resp.Message == "" {
+			resp.Message = resp.Error
+		}
+		return fmt.Errorf("etcd3: %s (%d)", resp.Message, status)
+	}
+	return fmt.Errorf("etcd3: %s", http.StatusText(status))
+}
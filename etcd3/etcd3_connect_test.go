@@ -0,0 +1,263 @@
+package etcd3
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/composer22/docker-deploy-server/etcd2"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/server/v3/embed"
+)
+
+// startEtcd runs an etcd server in-process and returns its client URL. The server is stopped when the
+// test ends.
+func startEtcd(t *testing.T) string {
+	t.Helper()
+	cfg := embed.NewConfig()
+	cfg.Dir = t.TempDir()
+	cfg.LogLevel = "error"
+	client, peer := freeURL(t), freeURL(t)
+	cfg.ListenClientUrls, cfg.AdvertiseClientUrls = []url.URL{client}, []url.URL{client}
+	cfg.ListenPeerUrls, cfg.AdvertisePeerUrls = []url.URL{peer}, []url.URL{peer}
+	cfg.InitialCluster = cfg.InitialClusterFromName(cfg.Name)
+	e, err := embed.StartEtcd(cfg)
+	if err != nil {
+		t.Fatalf("Unable to start etcd: %s", err)
+	}
+	t.Cleanup(e.Close)
+	select {
+	case <-e.Server.ReadyNotify():
+	case <-time.After(30 * time.Second):
+		t.Fatalf("etcd did not start.")
+	}
+	return client.String()
+}
+
+// freeURL returns a local URL on a port that is free.
+func freeURL(t *testing.T) url.URL {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to find a free port: %s", err)
+	}
+	defer l.Close()
+	return url.URL{Scheme: "http", Host: l.Addr().String()}
+}
+
+// leases returns the number of leases in the cluster.
+func leases(t *testing.T, endpoint string) int {
+	c, err := clientv3.New(clientv3.Config{Endpoints: []string{endpoint}, DialTimeout: 5 * time.Second})
+	if err != nil {
+		t.Fatalf("Unable to connect: %s", err)
+	}
+	defer c.Close()
+	resp, err := c.Leases(context.Background())
+	if err != nil {
+		t.Fatalf("Unable to list the leases: %s", err)
+	}
+	return len(resp.Leases)
+}
+
+func TestEtcd3CompareAndSwap(t *testing.T) {
+	t.Parallel()
+	endpoint := startEtcd(t)
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close() // An endpoint that is not answering.
+
+	c, err := NewEtcd3Connect(Config{Endpoints: []string{down.URL, endpoint}})
+	if err != nil {
+		t.Fatalf("Unable to connect: %s", err)
+	}
+	// Keys that do not exist have an Index of 0.
+	if _, err := c.CompareAndSwap([]*etcd2.Key{
+		{Key: "/myapp/db/host", Value: "db1.internal"},
+		{Key: "/myapp/old", Value: "1"},
+		{Key: "/myapplication/key", Value: "not under /myapp"},
+	}, nil); err != nil {
+		t.Fatalf("Unable to create the keys: %s", err)
+	}
+	live, err := c.GetTree("/myapp")
+	if err != nil {
+		t.Fatalf("Unable to read the keys: %s", err)
+	}
+	if len(live) != 4 || live["/myapp/db"] == nil || !live["/myapp/db"].Dir ||
+		live["/myapp/db/host"].Value != "db1.internal" || live["/myapp/db/host"].Index == 0 {
+		t.Fatalf("Expected the keys with their parent directories, received: %v", live)
+	}
+
+	// Keys with a TTL share a lease.
+	snapshot := etcd2.NewSnapshot([]*etcd2.Key{{Key: "/myapp/db/host"}, {Key: "/myapp/session"},
+		{Key: "/myapp/lock"}, {Key: "/myapp/old"}}, live)
+	writes := []*etcd2.Key{
+		{Key: "/myapp/db/host", Value: "db2.internal", Index: live["/myapp/db/host"].Index},
+		{Key: "/myapp/session", Value: "x", TTL: time.Minute},
+		{Key: "/myapp/lock", Value: "y", TTL: time.Minute},
+	}
+	snapshot.Written, err = c.CompareAndSwap(writes, []*etcd2.Key{live["/myapp/old"]})
+	if err != nil {
+		t.Fatalf("Unable to update the keys: %s", err)
+	}
+	after, _ := c.GetTree("/myapp")
+	if len(snapshot.Written) != 4 || snapshot.Written[0].Index != after["/myapp/db/host"].Index ||
+		snapshot.Written[3].Key != "/myapp/old" || snapshot.Written[3].Index != 0 {
+		t.Errorf("Expected the keys written at the revision of the transaction, received: %v", snapshot.Written)
+	}
+	if after["/myapp/db/host"].Value != "db2.internal" || after["/myapp/old"] != nil {
+		t.Errorf("Expected the keys updated, received: %v", after)
+	}
+	if ttl := after["/myapp/session"].TTL; ttl <= 50*time.Second || ttl > time.Minute {
+		t.Errorf("Expected a TTL of about a minute, received %s.", ttl)
+	}
+	if n := leases(t, endpoint); n != 1 {
+		t.Errorf("Expected one lease, received %d.", n)
+	}
+
+	// A key changed by someone else since it was read fails the whole transaction, and the lease
+	// granted for it is revoked.
+	if _, err := c.CompareAndSwap([]*etcd2.Key{
+		{Key: "/myapp/db/host", Value: "db3.internal", Index: after["/myapp/db/host"].Index},
+	}, nil); err != nil {
+		t.Fatalf("Unable to update the key: %s", err)
+	}
+	written, err := c.CompareAndSwap([]*etcd2.Key{
+		{Key: "/myapp/db/host", Value: "db4.internal", Index: after["/myapp/db/host"].Index},
+		{Key: "/myapp/other", Value: "z", TTL: time.Hour},
+	}, nil)
+	if err == nil || !strings.Contains(err.Error(), "changed by someone else") || len(written) != 0 {
+		t.Errorf("Expected a compare failure with nothing written, received %v: %v", written, err)
+	}
+	failed, _ := c.GetTree("/myapp")
+	if failed["/myapp/other"] != nil || failed["/myapp/db/host"].Value != "db3.internal" {
+		t.Errorf("A failed transaction should change nothing, received: %v", failed)
+	}
+	if n := leases(t, endpoint); n != 1 {
+		t.Errorf("Expected the lease of the failed transaction revoked, received %d leases.", n)
+	}
+
+	// The snapshot puts back the keys as they were, except the key changed by someone else since.
+	skipped, err := c.Restore(snapshot)
+	if err != nil {
+		t.Fatalf("Unable to restore: %s", err)
+	}
+	if len(skipped) != 1 || skipped[0] != "/myapp/db/host" {
+		t.Errorf("Expected the changed key skipped, received: %v", skipped)
+	}
+	restored, _ := c.GetTree("/myapp")
+	if restored["/myapp/db/host"].Value != "db3.internal" || restored["/myapp/old"].Value != "1" ||
+		restored["/myapp/session"] != nil || restored["/myapp/lock"] != nil {
+		t.Errorf("Expected the snapshot restored and the concurrent value kept, received: %v", restored)
+	}
+	if r, d := snapshot.Restored(skipped); r != 1 || d != 2 {
+		t.Errorf("Expected 1 key restored and 2 removed, received %d and %d.", r, d)
+	}
+
+	// The root holds every key, without a directory for the root itself.
+	all, err := c.GetTree("/")
+	if err != nil || all["/myapplication/key"] == nil || all["/myapp"] == nil || all["/"] != nil {
+		t.Errorf("Expected every key under the root, received %v: %v", all, err)
+	}
+}
+
+// lostTxnProxy returns an endpoint in front of etcd that answers transactions too late, after sending
+// them on if apply is set.
+func lostTxnProxy(t *testing.T, endpoint string, apply bool) string {
+	u, _ := url.Parse(endpoint)
+	proxy := httputil.NewSingleHostReverseProxy(u)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v3/kv/txn" {
+			proxy.ServeHTTP(w, r)
+			return
+		}
+		if apply {
+			proxy.ServeHTTP(httptest.NewRecorder(), r)
+		}
+		time.Sleep(time.Second)
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL
+}
+
+func TestEtcd3LostTxnResponse(t *testing.T) {
+	t.Parallel()
+	endpoint := startEtcd(t)
+
+	// The transaction was applied: the keys tell so, and the lease of the TTL key is kept.
+	c, _ := NewEtcd3Connect(Config{Endpoints: []string{lostTxnProxy(t, endpoint, true), endpoint},
+		Timeout: 300 * time.Millisecond})
+	written, err := c.CompareAndSwap([]*etcd2.Key{
+		{Key: "/myapp/db/host", Value: "db1.internal"},
+		{Key: "/myapp/session", Value: "x", TTL: time.Minute},
+	}, nil)
+	if err != nil || len(written) != 2 || written[0].Index == 0 || written[0].Index != written[1].Index {
+		t.Fatalf("Expected the transaction found applied, received %v: %v", written, err)
+	}
+	live, _ := c.GetTree("/myapp")
+	if live["/myapp/session"] == nil || live["/myapp/db/host"].Index != written[0].Index {
+		t.Errorf("Expected the keys written, received: %v", live)
+	}
+	if n := leases(t, endpoint); n != 1 {
+		t.Errorf("Expected the lease kept, received %d leases.", n)
+	}
+
+	// The transaction was not applied: the uncertain error is returned and it is not sent to the next
+	// endpoint.
+	c, _ = NewEtcd3Connect(Config{Endpoints: []string{lostTxnProxy(t, endpoint, false), endpoint},
+		Timeout: 300 * time.Millisecond})
+	written, err = c.CompareAndSwap([]*etcd2.Key{
+		{Key: "/myapp/db/host", Value: "db2.internal", Index: live["/myapp/db/host"].Index},
+	}, nil)
+	if _, ok := err.(*UncertainError); !ok || len(written) != 0 {
+		t.Errorf("Expected an uncertain error, received %v: %v", written, err)
+	}
+	if after, _ := c.GetTree("/myapp"); after["/myapp/db/host"].Value != "db1.internal" {
+		t.Errorf("Expected the transaction not sent again, received: %v", after)
+	}
+}
+
+func TestEtcd3Auth(t *testing.T) {
+	t.Parallel()
+	endpoint := startEtcd(t)
+	admin, err := clientv3.New(clientv3.Config{Endpoints: []string{endpoint}, DialTimeout: 5 * time.Second})
+	if err != nil {
+		t.Fatalf("Unable to connect: %s", err)
+	}
+	defer admin.Close()
+	ctx := context.Background()
+	for _, step := range []func() error{
+		func() error { _, err := admin.UserAdd(ctx, "root", "rootpw"); return err },
+		func() error { _, err := admin.UserGrantRole(ctx, "root", "root"); return err },
+		func() error { _, err := admin.AuthEnable(ctx); return err },
+	} {
+		if err := step(); err != nil {
+			t.Fatalf("Unable to enable auth: %s", err)
+		}
+	}
+
+	c, _ := NewEtcd3Connect(Config{Endpoints: []string{endpoint}})
+	if _, err := c.GetTree("/myapp"); err == nil {
+		t.Errorf("Expected an error without a login.")
+	}
+	c, _ = NewEtcd3Connect(Config{Endpoints: []string{endpoint}, Username: "root", Password: "wrong"})
+	if _, err := c.GetTree("/myapp"); err == nil || !strings.Contains(err.Error(), "authentication failed") {
+		t.Errorf("Expected an auth error, received: %v", err)
+	}
+	c, _ = NewEtcd3Connect(Config{Endpoints: []string{endpoint}, Username: "root", Password: "rootpw"})
+	if _, err := c.CompareAndSwap([]*etcd2.Key{{Key: "/myapp/key", Value: "1"}}, nil); err != nil {
+		t.Fatalf("Unable to write with a login: %s", err)
+	}
+
+	// An expired token is renewed.
+	c.mu.Lock()
+	c.token = fmt.Sprintf("%s.expired", c.token)
+	c.mu.Unlock()
+	if keys, err := c.GetTree("/myapp"); err != nil || keys["/myapp/key"] == nil {
+		t.Errorf("Expected the token renewed, received %v: %v", keys, err)
+	}
+}
@@ -1,13 +1,24 @@
 // Package logger provides a custom logging abstract over the standard out logging of golang.
 // All logging should by go to stdout according to 12-factor principles.
 // Logging levels are based on RFC 5424: http://www.rfc-base.org/rfc-5424.html#
+// Entries are written as labelled text lines or, in JSON format, as one JSON object per line.
 package logger
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // Standard labels.
@@ -25,6 +36,12 @@ const (
 	UseDefault = -1 // Note: literal consts must follow any iota decls else unexpected results.
 )
 
+// Output formats.
+const (
+	FormatText = iota // Labelled text lines.
+	FormatJSON        // One JSON object per line.
+)
+
 const (
 	// ANSI 8 colours.
 	foregroundBlack = iota + 30
@@ -52,17 +69,62 @@ var (
 		"[INFO] ",
 		"[DEBUG] ",
 	}
+
+	// Level names used in JSON entries.
+	LevelNames = []string{"emergency",
+		"alert",
+		"critical",
+		"error",
+		"warning",
+		"notice",
+		"info",
+		"debug",
+	}
 )
 
+// Fields are key/values attached to every entry written by a logger.
+type Fields map[string]interface{}
+
+// jsonEntry is the datastructure of a log entry in JSON format.
+type jsonEntry struct {
+	Timestamp string `json:"timestamp"`          // RFC 3339 time of the entry (UTC).
+	Level     string `json:"level"`              // RFC 5424 level name.
+	Severity  *int   `json:"severity,omitempty"` // RFC 5424 severity code.
+	Message   string `json:"message"`            // The message.
+	Caller    string `json:"caller,omitempty"`   // file:line of the caller.
+	PID       int    `json:"pid"`                // Process ID.
+	Fields    Fields `json:"fields,omitempty"`   // Key/values attached with With().
+}
+
 // Wrap the os.Exit() function so we can mock/test or customize exit.
 type exiter func(code int)
 
 // Logger provides a datastructure for all logging state.
 type Logger struct {
 	logger *log.Logger
-	level  int
 	labels []string
 	exit   exiter
+	fields Fields       // Key/values attached to every entry.
+	module string       // Component name set with Module(). Empty for the root.
+	shared *loggerState // Level, format and sinks. Shared with child loggers.
+}
+
+// loggerState is the state a logger shares with its children, so a change at runtime applies to
+// every one of them.
+type loggerState struct {
+	level   int32         // Base level, read and written atomically.
+	format  int32         // Output format: FormatText or FormatJSON. Read and written atomically.
+	out     io.Writer     // Destination for JSON entries.
+	mu      sync.Mutex    // Serializes JSON writes.
+	sinkMu  sync.RWMutex  // For locking access to the syslog sink.
+	syslog  *SyslogWriter // Optional syslog sink written alongside stdout.
+	modules moduleLevels  // Per-module level overrides.
+}
+
+// moduleLevels holds level overrides by module name.
+type moduleLevels struct {
+	mu     sync.RWMutex   // For locking access to the levels.
+	levels map[string]int // Level per module.
 }
 
 // New is a factory method to return a new logger instance.
@@ -75,8 +137,13 @@ func New(lvl int, clrs bool) *Logger {
 
 	l := &Logger{
 		logger: log.New(os.Stdout, pre, flags),
-		level:  lvl,
 		exit:   func(code int) { os.Exit(code) },
+		shared: &loggerState{
+			level:   int32(lvl),
+			format:  FormatText,
+			out:     os.Stdout,
+			modules: moduleLevels{levels: make(map[string]int)},
+		},
 	}
 
 	if clrs {
@@ -87,7 +154,8 @@ func New(lvl int, clrs bool) *Logger {
 	return l
 }
 
-// SetLogLevel allows a user to set the log level of the logger.
+// SetLogLevel allows a user to set the log level of the logger. The level can be changed at runtime
+// and applies to the root logger and every child without its own module level.
 func (l *Logger) SetLogLevel(lvl int) error {
 	if lvl < UseDefault || lvl > Debug {
 		return errors.New(fmt.Sprintf("%d log level arg is not in valid range.", lvl))
@@ -96,10 +164,65 @@ func (l *Logger) SetLogLevel(lvl int) error {
 	if lvl == UseDefault {
 		lvl = Info
 	}
-	l.level = lvl
+	atomic.StoreInt32(&l.shared.level, int32(lvl))
+	return nil
+}
+
+// SetModuleLevel sets the level of the loggers of a module, overriding the base level.
+// UseDefault removes the override so the module follows the base level again.
+func (l *Logger) SetModuleLevel(module string, lvl int) error {
+	if lvl < UseDefault || lvl > Debug {
+		return errors.New(fmt.Sprintf("%d log level arg is not in valid range.", lvl))
+	}
+	if module == "" {
+		return errors.New("Module name is mandatory.")
+	}
+
+	m := &l.shared.modules
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if lvl == UseDefault {
+		delete(m.levels, module)
+	} else {
+		m.levels[module] = lvl
+	}
 	return nil
 }
 
+// ModuleLevels returns a copy of the module level overrides.
+func (l *Logger) ModuleLevels() map[string]int {
+	m := &l.shared.modules
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	levels := make(map[string]int, len(m.levels))
+	for name, lvl := range m.levels {
+		levels[name] = lvl
+	}
+	return levels
+}
+
+// Module returns a child logger for a component of the application (ex: http, deploy). Its level
+// is the module level if one is set, otherwise the base level. Entries carry a module field.
+func (l *Logger) Module(name string) *Logger {
+	child := l.With(Fields{"module": name})
+	child.module = name
+	return child
+}
+
+// ParseLevel returns the level for an RFC 5424 level name (ex: debug) or number.
+func ParseLevel(name string) (int, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	for i, n := range LevelNames {
+		if name == n {
+			return i, nil
+		}
+	}
+	if lvl, err := strconv.Atoi(name); err == nil && lvl >= Emergency && lvl <= Debug {
+		return lvl, nil
+	}
+	return UseDefault, fmt.Errorf("Invalid log level '%s'.", name)
+}
+
 // SetExitFunc allows a user to set the exit function of the logger.
 func (l *Logger) SetExitFunc(e exiter) error {
 	if e == nil {
@@ -109,9 +232,61 @@ func (l *Logger) SetExitFunc(e exiter) error {
 	return nil
 }
 
-// GetLogLevel returns the current log level of the logger.
+// SetFormat allows a user to set the output format of the logger and every child.
+func (l *Logger) SetFormat(f int) error {
+	if f != FormatText && f != FormatJSON {
+		return errors.New(fmt.Sprintf("%d log format arg is not valid.", f))
+	}
+	atomic.StoreInt32(&l.shared.format, int32(f))
+	return nil
+}
+
+// SetSyslog adds a syslog sink that receives every entry written to stdout by the logger and every
+// child. Pass nil to remove it.
+func (l *Logger) SetSyslog(w *SyslogWriter) {
+	l.shared.sinkMu.Lock()
+	l.shared.syslog = w
+	l.shared.sinkMu.Unlock()
+}
+
+// GetFormat returns the current output format of the logger.
+func (l *Logger) GetFormat() int {
+	return int(atomic.LoadInt32(&l.shared.format))
+}
+
+// With returns a child logger that attaches the fields to every entry, along with any fields of
+// this logger. The child shares the levels, format and outputs of this logger.
+func (l *Logger) With(f Fields) *Logger {
+	child := &Logger{
+		logger: l.logger,
+		labels: append([]string(nil), l.labels...),
+		exit:   l.exit,
+		fields: make(Fields, len(l.fields)+len(f)),
+		module: l.module,
+		shared: l.shared,
+	}
+	for k, v := range l.fields {
+		child.fields[k] = v
+	}
+	for k, v := range f {
+		child.fields[k] = v
+	}
+	return child
+}
+
+// GetLogLevel returns the current log level of the logger: its module level if set, otherwise the
+// base level.
 func (l *Logger) GetLogLevel() int {
-	return l.level
+	if l.module != "" {
+		m := &l.shared.modules
+		m.mu.RLock()
+		lvl, ok := m.levels[l.module]
+		m.mu.RUnlock()
+		if ok {
+			return lvl
+		}
+	}
+	return int(atomic.LoadInt32(&l.shared.level))
 }
 
 // SetPlainLabels sets the message labels to simple text output.
@@ -143,7 +318,7 @@ func (l *Logger) SetColouredLabels() {
 // Emergencyf prints an emergency message to the system log,
 // This is considered an unrecoverable error and the application also exits, unless dont exit = true.
 func (l *Logger) Emergencyf(format string, v ...interface{}) {
-	if l.level >= Emergency {
+	if l.GetLogLevel() >= Emergency {
 		l.Output(3, Labels[Emergency], format, v...)
 	}
 	l.performExit(l.exit)
@@ -151,49 +326,49 @@ func (l *Logger) Emergencyf(format string, v ...interface{}) {
 
 // Alertf prints an alert message to the system log.
 func (l *Logger) Alertf(format string, v ...interface{}) {
-	if l.level >= Alert {
+	if l.GetLogLevel() >= Alert {
 		l.Output(3, Labels[Alert], format, v...)
 	}
 }
 
 // Criticalf prints a critical message to the system log.
 func (l *Logger) Criticalf(format string, v ...interface{}) {
-	if l.level >= Critical {
+	if l.GetLogLevel() >= Critical {
 		l.Output(3, Labels[Critical], format, v...)
 	}
 }
 
 // Errorf prints an error message to the system log.
 func (l *Logger) Errorf(format string, v ...interface{}) {
-	if l.level >= Error {
+	if l.GetLogLevel() >= Error {
 		l.Output(3, Labels[Error], format, v...)
 	}
 }
 
 // Warningf prints a warning message to the system log.
 func (l *Logger) Warningf(format string, v ...interface{}) {
-	if l.level >= Warning {
+	if l.GetLogLevel() >= Warning {
 		l.Output(3, Labels[Warning], format, v...)
 	}
 }
 
 // Noticef prints a notice message to the system log.
 func (l *Logger) Noticef(format string, v ...interface{}) {
-	if l.level >= Notice {
+	if l.GetLogLevel() >= Notice {
 		l.Output(3, Labels[Notice], format, v...)
 	}
 }
 
 // Infof prints an informational message to the system log.
 func (l *Logger) Infof(format string, v ...interface{}) {
-	if l.level >= Info {
+	if l.GetLogLevel() >= Info {
 		l.Output(3, Labels[Info], format, v...)
 	}
 }
 
 // Debugf prints a debug message to the system log.
 func (l *Logger) Debugf(format string, v ...interface{}) {
-	if l.level >= Debug {
+	if l.GetLogLevel() >= Debug {
 		l.Output(3, Labels[Debug], format, v...)
 	}
 }
@@ -205,7 +380,94 @@ func (l *Logger) Output(cd int, lbl string, format string, v ...interface{}) err
 	if cd > 0 {
 		d = cd
 	}
-	return l.logger.Output(d, fmt.Sprintf(lbl+format, v...))
+	line := fmt.Sprintf(lbl+format, v...)
+	l.shared.sinkMu.RLock()
+	syslog := l.shared.syslog
+	l.shared.sinkMu.RUnlock()
+	if syslog != nil {
+		sev := labelLevel(lbl)
+		syslog.Send(sev, time.Now(), l.fields, strings.TrimPrefix(line, lbl))
+	}
+	if l.GetFormat() == FormatJSON {
+		return l.outputJSON(d, lbl, strings.TrimPrefix(line, lbl))
+	}
+	if len(l.fields) > 0 {
+		line = strings.TrimRight(line, "\n") + l.textFields()
+	}
+	return l.logger.Output(d, line)
+}
+
+// outputJSON writes an entry as a single line of JSON.
+func (l *Logger) outputJSON(cd int, lbl string, msg string) error {
+	e := &jsonEntry{
+		Timestamp: time.Now().UTC().Format(time.RFC3339Nano),
+		Message:   strings.TrimRight(msg, "\n"),
+		PID:       os.Getpid(),
+		Fields:    l.fields,
+	}
+	if lvl := labelLevel(lbl); lvl >= 0 {
+		e.Level, e.Severity = LevelNames[lvl], &lvl
+	} else {
+		e.Level = strings.ToLower(strings.Trim(lbl, "[] "))
+	}
+	// Same depth as log.Output: outputJSON stands in for it.
+	if _, file, line, ok := runtime.Caller(cd); ok {
+		e.Caller = fmt.Sprintf("%s:%d", filepath.Base(file), line)
+	}
+
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	l.shared.mu.Lock()
+	defer l.shared.mu.Unlock()
+	_, err = l.shared.out.Write(append(b, '\n'))
+	return err
+}
+
+// textFields formats the fields of the logger as sorted key=value pairs for a text entry.
+func (l *Logger) textFields() string {
+	if len(l.fields) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(l.fields))
+	for k := range l.fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	for _, k := range keys {
+		val := fieldString(l.fields[k])
+		if strings.ContainsAny(val, " \t\n\"=") {
+			val = fmt.Sprintf("%q", val)
+		}
+		fmt.Fprintf(&b, " %s=%s", k, val)
+	}
+	return b.String()
+}
+
+// fieldString formats a field value as text. Complex values are written as JSON.
+func fieldString(f interface{}) string {
+	switch v := f.(type) {
+	case string:
+		return v
+	case fmt.Stringer:
+		return v.String()
+	case int, int64, float64, bool:
+		return fmt.Sprint(v)
+	}
+	j, _ := json.Marshal(f)
+	return string(j)
+}
+
+// labelLevel returns the level of a standard label or -1 if it is not one.
+func labelLevel(lbl string) int {
+	for i, std := range Labels {
+		if lbl == std {
+			return i
+		}
+	}
+	return -1
 }
 
 // performExit wraps the application exit point wih a custom closure/anonymous function.
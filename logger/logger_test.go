@@ -18,7 +18,7 @@ func TestSetAndGetLogLevel(t *testing.T) {
 	if err != nil {
 		t.Errorf("Set log level func should have been called correctly for value Info.")
 	}
-	if l.level != Info {
+	if l.GetLogLevel() != Info {
 		t.Errorf("Set log level func should have set new value correctly.")
 	}
 
@@ -27,7 +27,7 @@ func TestSetAndGetLogLevel(t *testing.T) {
 		t.Errorf("Set log level func should have been called correctly for value UseDefault.")
 	}
 
-	if l.level != Info {
+	if l.GetLogLevel() != Info {
 		t.Errorf("Set default log level should have set new value correctly.")
 	}
 
@@ -165,6 +165,157 @@ func TestOutputf(t *testing.T) {
 	}, fmt.Sprintf("%s%s\n", testLbl, testMsg))
 }
 
+func TestSetFormat(t *testing.T) {
+	l := New(UseDefault, false)
+	if l.GetFormat() != FormatText {
+		t.Errorf("Default format should be text.")
+	}
+	if err := l.SetFormat(FormatJSON); err != nil || l.GetFormat() != FormatJSON {
+		t.Errorf("Set format func should have set JSON correctly.")
+	}
+	if err := l.SetFormat(FormatJSON + 1); err == nil {
+		t.Errorf("Invalid format value was not tested properly.")
+	}
+}
+
+func TestJSONOutput(t *testing.T) {
+	t.Parallel()
+	testMsg := "JSON"
+	expectOutput(t, func() {
+		l := New(Debug, false)
+		l.SetFormat(FormatJSON)
+		l.Warningf("%s\n", testMsg)
+	}, fmt.Sprintf(`"level":"warning","severity":%d,"message":"%s","caller":"logger_test.go:`, Warning, testMsg))
+}
+
+func TestJSONOutputCustomLabel(t *testing.T) {
+	t.Parallel()
+	expectOutput(t, func() {
+		l := New(Debug, false)
+		l.SetFormat(FormatJSON)
+		l.Output(-1, "[OUTPUT] ", "Output")
+	}, `"level":"output","message":"Output"`)
+}
+
+func TestWithFieldsJSON(t *testing.T) {
+	t.Parallel()
+	expectOutput(t, func() {
+		l := New(Debug, false)
+		l.SetFormat(FormatJSON)
+		l.With(Fields{"deployID": "ABC"}).With(Fields{"environment": "dev"}).Infof("With")
+	}, `"message":"With","caller":"logger_test.go:`)
+	expectOutput(t, func() {
+		l := New(Debug, false)
+		l.SetFormat(FormatJSON)
+		l.With(Fields{"deployID": "ABC"}).With(Fields{"environment": "dev"}).Infof("With")
+	}, `"fields":{"deployID":"ABC","environment":"dev"}}`)
+}
+
+func TestWithFieldsText(t *testing.T) {
+	t.Parallel()
+	expectOutput(t, func() {
+		l := New(Debug, false)
+		l.With(Fields{"image": "hello world", "deployID": "ABC"}).Infof("With\n")
+	}, fmt.Sprintf("%sWith deployID=ABC image=\"hello world\"\n", Labels[Info]))
+}
+
+func TestWithDoesNotChangeParent(t *testing.T) {
+	l := New(Debug, false)
+	child := l.With(Fields{"deployID": "ABC"})
+	if len(l.fields) != 0 {
+		t.Errorf("Parent fields should not be changed by With.")
+	}
+	if child.GetLogLevel() != Debug {
+		t.Errorf("Child should start with the parent level.")
+	}
+}
+
+func TestWithSharesLevel(t *testing.T) {
+	l := New(Debug, false)
+	child := l.With(Fields{"deployID": "ABC"})
+	l.SetLogLevel(Error)
+	if child.GetLogLevel() != Error {
+		t.Errorf("Child should follow a runtime level change of the parent.")
+	}
+	child.SetLogLevel(Warning)
+	if l.GetLogLevel() != Warning {
+		t.Errorf("Level set on a child should change the base level.")
+	}
+}
+
+func TestWithSharesFormatAndSinks(t *testing.T) {
+	l := New(Debug, false)
+	child := l.Module("deploy").With(Fields{"deployID": "ABC"})
+	l.SetFormat(FormatJSON)
+	if child.GetFormat() != FormatJSON {
+		t.Errorf("Child should follow a format change of the parent.")
+	}
+	w := &SyslogWriter{}
+	l.SetSyslog(w)
+	child.shared.sinkMu.RLock()
+	defer child.shared.sinkMu.RUnlock()
+	if child.shared.syslog != w {
+		t.Errorf("Child should write to a syslog sink added to the parent.")
+	}
+}
+
+func TestWithConcurrentLevelChange(t *testing.T) {
+	l := New(Info, false)
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 1000; i++ {
+			l.SetLogLevel(Info + i%2)
+		}
+		close(done)
+	}()
+	for i := 0; i < 1000; i++ {
+		l.With(Fields{"i": i}).GetLogLevel()
+	}
+	<-done
+}
+
+func TestModuleLevels(t *testing.T) {
+	l := New(Info, false)
+	deploy := l.Module("deploy")
+	http := l.Module("http")
+	if err := l.SetModuleLevel("deploy", Debug); err != nil {
+		t.Errorf("Unexpected error setting a module level: %s", err)
+	}
+	if deploy.GetLogLevel() != Debug || http.GetLogLevel() != Info || l.GetLogLevel() != Info {
+		t.Errorf("Module level should only change the loggers of that module.")
+	}
+	l.SetLogLevel(Warning)
+	if deploy.GetLogLevel() != Debug || http.GetLogLevel() != Warning {
+		t.Errorf("Base level should change modules without their own level.")
+	}
+	if lvls := l.ModuleLevels(); len(lvls) != 1 || lvls["deploy"] != Debug {
+		t.Errorf("Unexpected module levels: %v", lvls)
+	}
+	l.SetModuleLevel("deploy", UseDefault)
+	if deploy.GetLogLevel() != Warning {
+		t.Errorf("Removing a module level should restore the base level.")
+	}
+	if l.SetModuleLevel("", Debug) == nil || l.SetModuleLevel("deploy", Debug+1) == nil {
+		t.Errorf("Invalid module level args should fail.")
+	}
+	expectOutput(t, func() {
+		New(Info, false).Module("etcd").Infof("Module\n")
+	}, "Module module=etcd")
+}
+
+func TestParseLevel(t *testing.T) {
+	for name, expected := range map[string]int{"debug": Debug, " WARNING ": Warning, "3": Error} {
+		if lvl, err := ParseLevel(name); err != nil || lvl != expected {
+			t.Errorf("Expected %d for '%s', received %d (%v).", expected, name, lvl, err)
+		}
+	}
+	for _, name := range []string{"verbose", "8", ""} {
+		if _, err := ParseLevel(name); err == nil {
+			t.Errorf("Invalid level '%s' should fail.", name)
+		}
+	}
+}
+
 // expectOutput is a helper function that repipes or mocks out stdout and allows error messages to be tested
 // against the pipe.
 func expectOutput(t *testing.T, f func(), expected string) {
@@ -0,0 +1,336 @@
+package logger
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Syslog facilities from RFC 5424 section 6.2.1.
+var Facilities = map[string]int{
+	"kern":     0,
+	"user":     1,
+	"mail":     2,
+	"daemon":   3,
+	"auth":     4,
+	"syslog":   5,
+	"lpr":      6,
+	"news":     7,
+	"uucp":     8,
+	"cron":     9,
+	"authpriv": 10,
+	"ftp":      11,
+	"local0":   16,
+	"local1":   17,
+	"local2":   18,
+	"local3":   19,
+	"local4":   20,
+	"local5":   21,
+	"local6":   22,
+	"local7":   23,
+}
+
+// Syslog transports.
+const (
+	SyslogUDP  = "udp"
+	SyslogTCP  = "tcp"
+	SyslogTLS  = "tls"
+	SyslogUnix = "unix" // Local socket. Datagram is tried first, then stream.
+)
+
+const (
+	syslogVersion     = 1
+	syslogNil         = "-"
+	syslogTimeFormat  = "2006-01-02T15:04:05.000000Z07:00"
+	syslogBOM         = "\xef\xbb\xbf"
+	syslogBufferSize  = 1024
+	syslogDialTimeout = 5 * time.Second
+	syslogMaxBackoff  = 30 * time.Second
+	syslogCloseWait   = 2 * time.Second
+
+	// MsgIDField is the field used as the MSGID of a syslog message instead of structured data.
+	MsgIDField = "msgid"
+
+	// SyslogSDID is the SD-ID of the structured data element that carries the fields of an entry.
+	// 32473 is the enterprise number reserved for documentation (RFC 5612).
+	SyslogSDID = "fields@32473"
+)
+
+// SyslogConfig holds the settings of a syslog sink.
+type SyslogConfig struct {
+	Network    string      // Transport: udp, tcp, tls or unix.
+	Address    string      // host:port, or the socket path for unix (ex: /dev/log).
+	Facility   int         // RFC 5424 facility code.
+	AppName    string      // APP-NAME of every message. Defaults to the program name.
+	Hostname   string      // HOSTNAME of every message. Defaults to os.Hostname().
+	TLSConfig  *tls.Config // Client TLS settings for the tls transport.
+	BufferSize int         // Messages held while the connection is down. Defaults to 1024.
+}
+
+// SyslogWriter sends RFC 5424 messages to a syslog server. Messages are buffered and sent from a
+// goroutine, which reconnects with a backoff when the connection fails, so logging never blocks.
+type SyslogWriter struct {
+	cfg      SyslogConfig
+	procID   string
+	queue    chan []byte   // Formatted messages waiting to be sent.
+	done     chan struct{} // Closed to stop the sender.
+	stopped  chan struct{} // Closed when the sender has stopped.
+	mu       sync.Mutex    // For locking access to the counters.
+	dropped  int64         // Messages dropped because the buffer was full.
+	conn     net.Conn      // Current connection. Only used by the sender.
+	framed   bool          // Does the transport need octet counting (RFC 6587)?
+	closeOne sync.Once
+}
+
+// NewSyslogWriter is a factory function that validates the config and returns a SyslogWriter.
+// The connection is made in the background so a syslog outage does not stop the application.
+func NewSyslogWriter(cfg SyslogConfig) (*SyslogWriter, error) {
+	switch cfg.Network {
+	case SyslogUDP, SyslogTCP, SyslogTLS, SyslogUnix:
+	default:
+		return nil, fmt.Errorf("Invalid syslog network: %s", cfg.Network)
+	}
+	if cfg.Address == "" {
+		return nil, errors.New("Syslog address is mandatory.")
+	}
+	if cfg.Facility < 0 || cfg.Facility > 23 {
+		return nil, fmt.Errorf("%d syslog facility is not in valid range.", cfg.Facility)
+	}
+	if cfg.AppName == "" {
+		cfg.AppName = filepath.Base(os.Args[0])
+	}
+	if cfg.Hostname == "" {
+		cfg.Hostname, _ = os.Hostname()
+	}
+	if cfg.BufferSize <= 0 {
+		cfg.BufferSize = syslogBufferSize
+	}
+	w := &SyslogWriter{
+		cfg:     cfg,
+		procID:  fmt.Sprintf("%d", os.Getpid()),
+		queue:   make(chan []byte, cfg.BufferSize),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go w.run()
+	return w, nil
+}
+
+// Send formats an entry as an RFC 5424 message and queues it. If the buffer is full the message
+// is dropped and counted.
+func (w *SyslogWriter) Send(severity int, t time.Time, fields Fields, msg string) {
+	m := w.Format(severity, t, fields, msg)
+	select {
+	case w.queue <- m:
+	default:
+		w.mu.Lock()
+		w.dropped++
+		w.mu.Unlock()
+	}
+}
+
+// Dropped returns the number of messages dropped because the buffer was full.
+func (w *SyslogWriter) Dropped() int64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.dropped
+}
+
+// Close stops the writer, giving queued messages a short time to be sent.
+func (w *SyslogWriter) Close() error {
+	w.closeOne.Do(func() { close(w.done) })
+	select {
+	case <-w.stopped:
+	case <-time.After(syslogCloseWait):
+	}
+	return nil
+}
+
+// Format returns an entry as an RFC 5424 message:
+// <PRI>VERSION TIMESTAMP HOSTNAME APP-NAME PROCID MSGID STRUCTURED-DATA MSG
+func (w *SyslogWriter) Format(severity int, t time.Time, fields Fields, msg string) []byte {
+	if severity < Emergency || severity > Debug {
+		severity = Notice
+	}
+	msgID := syslogNil
+	if id, ok := fields[MsgIDField].(string); ok && id != "" {
+		msgID = syslogHeaderField(id, 32)
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "<%d>%d %s %s %s %s %s %s",
+		w.cfg.Facility*8+severity,
+		syslogVersion,
+		t.Format(syslogTimeFormat),
+		syslogHeaderField(w.cfg.Hostname, 255),
+		syslogHeaderField(w.cfg.AppName, 48),
+		syslogHeaderField(w.procID, 128),
+		msgID,
+		syslogStructuredData(fields),
+	)
+	if msg = strings.TrimRight(msg, "\n"); msg != "" {
+		b.WriteString(" " + syslogBOM + msg)
+	}
+	return b.Bytes()
+}
+
+// run sends queued messages until the writer is closed, reconnecting as needed.
+func (w *SyslogWriter) run() {
+	defer close(w.stopped)
+	backoff := time.Second
+	var pending []byte
+	for {
+		if pending == nil {
+			select {
+			case pending = <-w.queue:
+			case <-w.done:
+				w.drain()
+				return
+			}
+		}
+		if err := w.write(pending); err != nil {
+			w.disconnect()
+			select {
+			case <-time.After(backoff):
+			case <-w.done:
+				return
+			}
+			if backoff *= 2; backoff > syslogMaxBackoff {
+				backoff = syslogMaxBackoff
+			}
+			continue
+		}
+		pending, backoff = nil, time.Second
+	}
+}
+
+// drain sends whatever is left in the queue once, without retrying.
+func (w *SyslogWriter) drain() {
+	defer w.disconnect()
+	for {
+		select {
+		case m := <-w.queue:
+			if w.write(m) != nil {
+				return
+			}
+		default:
+			return
+		}
+	}
+}
+
+// write sends one message, connecting first if needed.
+func (w *SyslogWriter) write(m []byte) error {
+	if w.conn == nil {
+		if err := w.connect(); err != nil {
+			return err
+		}
+	}
+	if w.framed {
+		m = append([]byte(fmt.Sprintf("%d ", len(m))), m...)
+	}
+	_, err := w.conn.Write(m)
+	return err
+}
+
+// connect dials the syslog server.
+func (w *SyslogWriter) connect() error {
+	var err error
+	switch w.cfg.Network {
+	case SyslogUDP:
+		w.conn, err = net.DialTimeout("udp", w.cfg.Address, syslogDialTimeout)
+		w.framed = false
+	case SyslogTCP:
+		w.conn, err = net.DialTimeout("tcp", w.cfg.Address, syslogDialTimeout)
+		w.framed = true
+	case SyslogTLS:
+		d := &net.Dialer{Timeout: syslogDialTimeout}
+		w.conn, err = tls.DialWithDialer(d, "tcp", w.cfg.Address, w.cfg.TLSConfig)
+		w.framed = true
+	case SyslogUnix:
+		// Local daemons (ex: /dev/log) usually listen on a datagram socket and parse one message
+		// per read, so no framing is needed on either socket type.
+		if w.conn, err = net.DialTimeout("unixgram", w.cfg.Address, syslogDialTimeout); err != nil {
+			w.conn, err = net.DialTimeout("unix", w.cfg.Address, syslogDialTimeout)
+		}
+		w.framed = false
+	}
+	if err != nil {
+		w.conn = nil
+	}
+	return err
+}
+
+// disconnect closes the current connection, if any.
+func (w *SyslogWriter) disconnect() {
+	if w.conn != nil {
+		w.conn.Close()
+		w.conn = nil
+	}
+}
+
+// syslogHeaderField returns a header field as printable US-ASCII with no spaces, truncated to max.
+func syslogHeaderField(s string, max int) string {
+	b := make([]byte, 0, len(s))
+	for i := 0; i < len(s) && len(b) < max; i++ {
+		if s[i] >= 33 && s[i] <= 126 {
+			b = append(b, s[i])
+		}
+	}
+	if len(b) == 0 {
+		return syslogNil
+	}
+	return string(b)
+}
+
+// syslogStructuredData returns the fields as one SD-ELEMENT, or the nil value if there are none.
+func syslogStructuredData(fields Fields) string {
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		if k != MsgIDField {
+			keys = append(keys, k)
+		}
+	}
+	if len(keys) == 0 {
+		return syslogNil
+	}
+	sort.Strings(keys)
+
+	var b bytes.Buffer
+	b.WriteString("[" + SyslogSDID)
+	for _, k := range keys {
+		name := syslogParamName(k)
+		if name == "" {
+			continue
+		}
+		fmt.Fprintf(&b, ` %s="%s"`, name, syslogParamValue(fieldString(fields[k])))
+	}
+	b.WriteString("]")
+	return b.String()
+}
+
+// syslogParamName returns a field key as a valid PARAM-NAME: printable US-ASCII except
+// '=', ' ', ']' and '"', up to 32 characters.
+func syslogParamName(k string) string {
+	b := make([]byte, 0, len(k))
+	for i := 0; i < len(k) && len(b) < 32; i++ {
+		c := k[i]
+		if c >= 33 && c <= 126 && c != '=' && c != ']' && c != '"' {
+			b = append(b, c)
+		}
+	}
+	return string(b)
+}
+
+// syslogParamValue escapes '"', '\' and ']' in a PARAM-VALUE.
+func syslogParamValue(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`).Replace(v)
+}
@@ -0,0 +1,124 @@
+package logger
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewSyslogWriterValidation(t *testing.T) {
+	for _, cfg := range []SyslogConfig{
+		{Network: "smoke", Address: "localhost:514"},
+		{Network: SyslogUDP},
+		{Network: SyslogUDP, Address: "localhost:514", Facility: 24},
+	} {
+		if _, err := NewSyslogWriter(cfg); err == nil {
+			t.Errorf("Invalid syslog config should fail: %+v", cfg)
+		}
+	}
+}
+
+func TestSyslogFormat(t *testing.T) {
+	w := &SyslogWriter{
+		cfg:    SyslogConfig{Facility: Facilities["local0"], AppName: "deploy server", Hostname: "cc1"},
+		procID: "42",
+	}
+	ts := time.Date(2016, 5, 1, 10, 4, 5, 123000, time.UTC)
+	fields := Fields{MsgIDField: "deploy", "deployID": "abc", "reason": `say "hi" [ok]`}
+	expected := `<134>1 2016-05-01T10:04:05.000123Z cc1 deployserver 42 deploy ` +
+		`[fields@32473 deployID="abc" reason="say \"hi\" [ok\]"] ` + syslogBOM + "Deploy started."
+	if m := string(w.Format(Info, ts, fields, "Deploy started.\n")); m != expected {
+		t.Errorf("Expected '%s', received '%s'.", expected, m)
+	}
+
+	expected = `<131>1 2016-05-01T10:04:05.000123Z cc1 deployserver 42 - - ` + syslogBOM + "Failed."
+	if m := string(w.Format(Error, ts, nil, "Failed.")); m != expected {
+		t.Errorf("Expected '%s', received '%s'.", expected, m)
+	}
+}
+
+func TestSyslogUDP(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("Cannot listen on UDP: %s", err)
+	}
+	defer pc.Close()
+
+	w, err := NewSyslogWriter(SyslogConfig{Network: SyslogUDP, Address: pc.LocalAddr().String(),
+		Facility: Facilities["user"]})
+	if err != nil {
+		t.Fatalf("Unexpected error creating writer: %s", err)
+	}
+	defer w.Close()
+	l := New(Info, false)
+	l.shared.out = &discard{}
+	l.SetFormat(FormatJSON)
+	l.SetSyslog(w)
+	l.Warningf("Disk is %d%% full.", 91)
+
+	buf := make([]byte, 2048)
+	pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("Unexpected error reading message: %s", err)
+	}
+	m := string(buf[:n])
+	if !strings.HasPrefix(m, "<12>1 ") || !strings.HasSuffix(m, "Disk is 91% full.") {
+		t.Errorf("Unexpected syslog message: %s", m)
+	}
+}
+
+func TestSyslogTCPReconnect(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("Cannot listen on TCP: %s", err)
+	}
+	defer ln.Close()
+
+	w, err := NewSyslogWriter(SyslogConfig{Network: SyslogTCP, Address: ln.Addr().String()})
+	if err != nil {
+		t.Fatalf("Unexpected error creating writer: %s", err)
+	}
+	defer w.Close()
+	w.Send(Info, time.Now(), nil, "first")
+
+	// The first connection reads one message then drops, so the second message must be resent.
+	for i, expected := range []string{"first", "second"} {
+		c, err := ln.Accept()
+		if err != nil {
+			t.Fatalf("Unexpected error accepting: %s", err)
+		}
+		c.SetReadDeadline(time.Now().Add(5 * time.Second))
+		r := bufio.NewReader(c)
+		var n int
+		if _, err := fmt.Fscanf(r, "%d ", &n); err != nil {
+			t.Fatalf("Expected an octet count: %s", err)
+		}
+		b := make([]byte, n)
+		if _, err := io.ReadFull(r, b); err != nil {
+			t.Fatalf("Unexpected error reading message: %s", err)
+		}
+		if m := string(b); !strings.HasSuffix(m, expected) {
+			t.Errorf("Expected message ending '%s', received '%s'.", expected, m)
+		}
+		c.Close()
+		if i == 0 {
+			// Writes to a closed peer can succeed once, so keep sending until one is resent.
+			go func() {
+				for j := 0; j < 3; j++ {
+					time.Sleep(100 * time.Millisecond)
+					w.Send(Info, time.Now(), nil, "second")
+				}
+			}()
+		}
+	}
+}
+
+// discard is an io.Writer that drops everything written to it.
+type discard struct{}
+
+func (d *discard) Write(p []byte) (int, error) { return len(p), nil }
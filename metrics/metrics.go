@@ -0,0 +1,293 @@
+// Package metrics provides counters, gauges and histograms that are written out in the Prometheus
+// text exposition format: https://prometheus.io/docs/instrumenting/exposition_formats/
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Metric types.
+const (
+	typeCounter   = "counter"
+	typeGauge     = "gauge"
+	typeHistogram = "histogram"
+)
+
+// Default bucket boundaries in seconds.
+var (
+	HTTPBuckets   = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+	DeployBuckets = []float64{1, 5, 10, 30, 60, 120, 300, 600, 1200}
+)
+
+// collector is implemented by every metric so the registry can write it out.
+type collector interface {
+	write(b *bytes.Buffer)
+}
+
+// Registry holds a set of metrics to expose.
+type Registry struct {
+	mu         sync.Mutex  // For locking access to the collectors.
+	collectors []collector // Registered metrics in registration order.
+}
+
+// NewRegistry is a factory function that returns a new Registry instance.
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// WriteTo writes all metrics to the writer in the text exposition format.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	cs := make([]collector, len(r.collectors))
+	copy(cs, r.collectors)
+	r.mu.Unlock()
+
+	var b bytes.Buffer
+	for _, c := range cs {
+		c.write(&b)
+	}
+	return b.WriteTo(w)
+}
+
+// register adds a metric to the registry.
+func (r *Registry) register(c collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.collectors = append(r.collectors, c)
+}
+
+// desc is the common description of a metric.
+type desc struct {
+	name   string   // Metric name.
+	help   string   // Help text.
+	typ    string   // Metric type.
+	labels []string // Label names.
+}
+
+// header writes the HELP and TYPE lines of a metric.
+func (d *desc) header(b *bytes.Buffer) {
+	fmt.Fprintf(b, "# HELP %s %s\n", d.name, strings.Replace(d.help, "\n", " ", -1))
+	fmt.Fprintf(b, "# TYPE %s %s\n", d.name, d.typ)
+}
+
+// labelPairs formats label names and values as {a="1",b="2"}. Extra pairs are appended (ex: le).
+func (d *desc) labelPairs(values []string, extra ...string) string {
+	if len(d.labels) == 0 && len(extra) == 0 {
+		return ""
+	}
+	pairs := make([]string, 0, len(d.labels)+len(extra)/2)
+	for i, l := range d.labels {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, l, escape(values[i])))
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, extra[i], escape(extra[i+1])))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// key joins label values into a map key.
+func (d *desc) key(values []string) string {
+	if len(values) != len(d.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", d.name, len(d.labels), len(values)))
+	}
+	return strings.Join(values, "\xff")
+}
+
+// CounterVec is a set of counters partitioned by label values.
+type CounterVec struct {
+	desc
+	mu     sync.Mutex          // For locking access to the values.
+	values map[string]float64  // Current value per label set.
+	labels map[string][]string // Label values per label set.
+}
+
+// NewCounterVec registers and returns a new CounterVec.
+func (r *Registry) NewCounterVec(name string, help string, labels ...string) *CounterVec {
+	c := &CounterVec{
+		desc:   desc{name: name, help: help, typ: typeCounter, labels: labels},
+		values: make(map[string]float64),
+		labels: make(map[string][]string),
+	}
+	r.register(c)
+	return c
+}
+
+// Inc increments the counter for the label values by one.
+func (c *CounterVec) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+// Add adds a non-negative amount to the counter for the label values.
+func (c *CounterVec) Add(v float64, values ...string) {
+	if v < 0 {
+		return
+	}
+	k := c.key(values)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.labels[k]; !ok {
+		c.labels[k] = append([]string(nil), values...)
+	}
+	c.values[k] += v
+}
+
+func (c *CounterVec) write(b *bytes.Buffer) {
+	c.header(b)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, k := range sortedKeys(c.labels) {
+		fmt.Fprintf(b, "%s%s %s\n", c.name, c.labelPairs(c.labels[k]), formatFloat(c.values[k]))
+	}
+}
+
+// Gauge is a single value that can go up and down.
+type Gauge struct {
+	desc
+	mu    sync.Mutex // For locking access to the value.
+	value float64    // Current value.
+}
+
+// NewGauge registers and returns a new Gauge.
+func (r *Registry) NewGauge(name string, help string) *Gauge {
+	g := &Gauge{desc: desc{name: name, help: help, typ: typeGauge}}
+	r.register(g)
+	return g
+}
+
+// Set sets the gauge to a value.
+func (g *Gauge) Set(v float64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.value = v
+}
+
+func (g *Gauge) write(b *bytes.Buffer) {
+	g.header(b)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	fmt.Fprintf(b, "%s %s\n", g.name, formatFloat(g.value))
+}
+
+// funcMetric is a counter or gauge whose value is read from a function when written out.
+type funcMetric struct {
+	desc
+	f func() float64 // Returns the current value.
+}
+
+// NewCounterFunc registers a counter whose value is returned by f.
+func (r *Registry) NewCounterFunc(name string, help string, f func() float64) {
+	r.register(&funcMetric{desc: desc{name: name, help: help, typ: typeCounter}, f: f})
+}
+
+// NewGaugeFunc registers a gauge whose value is returned by f.
+func (r *Registry) NewGaugeFunc(name string, help string, f func() float64) {
+	r.register(&funcMetric{desc: desc{name: name, help: help, typ: typeGauge}, f: f})
+}
+
+func (m *funcMetric) write(b *bytes.Buffer) {
+	m.header(b)
+	fmt.Fprintf(b, "%s %s\n", m.name, formatFloat(m.f()))
+}
+
+// HistogramVec is a set of histograms partitioned by label values.
+type HistogramVec struct {
+	desc
+	buckets []float64             // Upper bounds of the buckets, ascending.
+	mu      sync.Mutex            // For locking access to the values.
+	values  map[string]*histogram // Observations per label set.
+	labels  map[string][]string   // Label values per label set.
+}
+
+// histogram holds the observations of one label set.
+type histogram struct {
+	counts []uint64 // Observations per bucket (not cumulative).
+	count  uint64   // Total observations.
+	sum    float64  // Sum of observations.
+}
+
+// NewHistogramVec registers and returns a new HistogramVec.
+func (r *Registry) NewHistogramVec(name string, help string, buckets []float64, labels ...string) *HistogramVec {
+	bs := append([]float64(nil), buckets...)
+	sort.Float64s(bs)
+	h := &HistogramVec{
+		desc:    desc{name: name, help: help, typ: typeHistogram, labels: labels},
+		buckets: bs,
+		values:  make(map[string]*histogram),
+		labels:  make(map[string][]string),
+	}
+	r.register(h)
+	return h
+}
+
+// Observe adds an observation to the histogram for the label values.
+func (h *HistogramVec) Observe(v float64, values ...string) {
+	k := h.key(values)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	hist, ok := h.values[k]
+	if !ok {
+		hist = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.values[k] = hist
+		h.labels[k] = append([]string(nil), values...)
+	}
+	for i, ub := range h.buckets {
+		if v <= ub {
+			hist.counts[i]++
+			break
+		}
+	}
+	hist.count++
+	hist.sum += v
+}
+
+func (h *HistogramVec) write(b *bytes.Buffer) {
+	h.header(b)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, k := range sortedKeys(h.labels) {
+		hist, lv := h.values[k], h.labels[k]
+		var cumulative uint64
+		for i, ub := range h.buckets {
+			cumulative += hist.counts[i]
+			fmt.Fprintf(b, "%s_bucket%s %d\n", h.name, h.labelPairs(lv, "le", formatFloat(ub)), cumulative)
+		}
+		fmt.Fprintf(b, "%s_bucket%s %d\n", h.name, h.labelPairs(lv, "le", "+Inf"), hist.count)
+		fmt.Fprintf(b, "%s_sum%s %s\n", h.name, h.labelPairs(lv), formatFloat(hist.sum))
+		fmt.Fprintf(b, "%s_count%s %d\n", h.name, h.labelPairs(lv), hist.count)
+	}
+}
+
+// escape escapes a label value.
+func escape(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
+
+// formatFloat formats a sample value.
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// sortedKeys returns the keys of a label map in sorted order so output is stable.
+func sortedKeys(m map[string][]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
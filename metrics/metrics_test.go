@@ -0,0 +1,90 @@
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestCounterVec(t *testing.T) {
+	t.Parallel()
+	r := NewRegistry()
+	c := r.NewCounterVec("requests_total", "Total requests.", "route", "code")
+	c.Inc("/v1.0/deploy", "200")
+	c.Inc("/v1.0/deploy", "200")
+	c.Add(3, "/v1.0/info", "401")
+	c.Add(-1, "/v1.0/info", "401")
+
+	expectOutput(t, r, `# HELP requests_total Total requests.
+# TYPE requests_total counter
+requests_total{route="/v1.0/deploy",code="200"} 2
+requests_total{route="/v1.0/info",code="401"} 3
+`)
+}
+
+func TestGauges(t *testing.T) {
+	t.Parallel()
+	r := NewRegistry()
+	g := r.NewGauge("queue_depth", "Queue depth.")
+	g.Set(4)
+	r.NewGaugeFunc("busy", "Busy.", func() float64 { return 1 })
+	r.NewCounterFunc("errors_total", "Errors.", func() float64 { return 7 })
+
+	expectOutput(t, r, `# HELP queue_depth Queue depth.
+# TYPE queue_depth gauge
+queue_depth 4
+# HELP busy Busy.
+# TYPE busy gauge
+busy 1
+# HELP errors_total Errors.
+# TYPE errors_total counter
+errors_total 7
+`)
+}
+
+func TestHistogramVec(t *testing.T) {
+	t.Parallel()
+	r := NewRegistry()
+	h := r.NewHistogramVec("duration_seconds", "Duration.", []float64{1, 0.5}, "step")
+	h.Observe(0.2, "etcd")
+	h.Observe(0.7, "etcd")
+	h.Observe(3, "etcd")
+
+	expectOutput(t, r, `# HELP duration_seconds Duration.
+# TYPE duration_seconds histogram
+duration_seconds_bucket{step="etcd",le="0.5"} 1
+duration_seconds_bucket{step="etcd",le="1"} 2
+duration_seconds_bucket{step="etcd",le="+Inf"} 3
+duration_seconds_sum{step="etcd"} 3.9
+duration_seconds_count{step="etcd"} 3
+`)
+}
+
+func TestLabelEscaping(t *testing.T) {
+	t.Parallel()
+	r := NewRegistry()
+	c := r.NewCounterVec("escaped_total", "Escaped.", "image")
+	c.Inc("a\"b\\c\nd")
+	expectOutput(t, r, `escaped_total{image="a\"b\\c\nd"} 1`)
+}
+
+func TestLabelCount(t *testing.T) {
+	t.Parallel()
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Wrong number of label values should panic.")
+		}
+	}()
+	NewRegistry().NewCounterVec("bad_total", "Bad.", "a", "b").Inc("a")
+}
+
+// expectOutput is a helper function that writes out the registry and tests it contains the expected text.
+func expectOutput(t *testing.T, r *Registry, expected string) {
+	var b bytes.Buffer
+	if _, err := r.WriteTo(&b); err != nil {
+		t.Fatalf("Unexpected error writing metrics: %s", err)
+	}
+	if !strings.Contains(b.String(), expected) {
+		t.Errorf("Expected '%s', received '%s'.", expected, b.String())
+	}
+}
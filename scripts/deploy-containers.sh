@@ -12,6 +12,7 @@
 # PROJECT - a project name for all containers in this environment.
 # SWARM - if set, then additional param of --swarm added to docker-machine env.
 # TEMP_DIRECTORY - temp diirectory where docker-compose.yml is kept.
+# DOCKER_REGISTRY_USERNAME, DOCKER_REGISTRY_PASSWORD - optional registry login (from the environment).
 #
 export DOCKER_IMAGE_NAME=$1
 export DOCKER_IMAGE_TAG=$2
@@ -37,6 +38,12 @@ cd "${TEMP_DIRECTORY}"
 
 eval $(docker-machine env ${swarm_sw} ${MACHINE})
 
+if [ "${DOCKER_REGISTRY_USERNAME}" != "" ]
+then
+  echo "${DOCKER_REGISTRY_PASSWORD}" | docker login -u "${DOCKER_REGISTRY_USERNAME}" --password-stdin "${DOCKER_REGISTRY}" \
+    > /dev/null 2>&1 || { echo "Unable to log in to ${DOCKER_REGISTRY}." >&2; exit 1; }
+fi
+
 # Destroy old environment if its not the same version tag (1.0.0-31 vs 1.0.0-32).
 if [ "${DOCKER_LAST_IMAGE_TAG}" != "" ] && [ "${DOCKER_IMAGE_TAG}" != "${DOCKER_LAST_IMAGE_TAG}" ]
 then
@@ -8,6 +8,7 @@ set -e
 # DOCKER_REGISTRY - Docker registry.
 # DOCKER_REPO - Docker application repository.
 # TEMP_DIRECTORY - local temporary directory where we should extract metadata.
+# DOCKER_REGISTRY_USERNAME, DOCKER_REGISTRY_PASSWORD - optional registry login (from the environment).
 #
 export DOCKER_IMAGE_TAG=$1
 export DOCKER_REGISTRY=$2
@@ -16,6 +17,12 @@ export TEMP_DIRECTORY=$4
 
 export DOCKER_IMAGE_FULLNAME="${DOCKER_REGISTRY}/${DOCKER_REPO}:${DOCKER_IMAGE_TAG}"
 
+if [ "${DOCKER_REGISTRY_USERNAME}" != "" ]
+then
+  echo "${DOCKER_REGISTRY_PASSWORD}" | docker login -u "${DOCKER_REGISTRY_USERNAME}" --password-stdin "${DOCKER_REGISTRY}" \
+    > /dev/null 2>&1 || { echo "Unable to log in to ${DOCKER_REGISTRY}." >&2; exit 1; }
+fi
+
 docker rmi ${DOCKER_IMAGE_FULLNAME} 2> /dev/null || echo > /dev/null
 docker pull ${DOCKER_IMAGE_FULLNAME}
 
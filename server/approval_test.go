@@ -0,0 +1,211 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/composer22/docker-deploy-server/db"
+	"github.com/composer22/docker-deploy-server/logger"
+)
+
+// testApprovalServer returns a server with redis, a mocked database and a "prod" environment that
+// requires two approvals.
+func testApprovalServer(t *testing.T) (*Server, sqlmock.Sqlmock) {
+	t.Helper()
+	conn, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Unable to create the database mock: %s", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	s := testRedisServer(t)
+	s.db = db.NewDBConnectFromDB(conn)
+	s.opt.Environments = map[string]*EnvironmentConfig{
+		"prod": {RequiresApproval: true, ApprovalsRequired: 2, ApprovalTimeout: time.Hour},
+	}
+	return s, mock
+}
+
+// pendingRow returns a deploy row pending approval in the "prod" environment.
+func pendingRow() *db.DeployStatus {
+	return &db.DeployStatus{
+		DeployID:    "deploy-1",
+		Environment: "prod",
+		ImageName:   "app",
+		Status:      db.PendingApproval,
+		Log:         "Deploy pending approval.\n",
+	}
+}
+
+// expectRequest expects the serialized request of deploy-1 to be read, as requested by owner.
+func expectRequest(t *testing.T, mock sqlmock.Sqlmock, owner string) {
+	t.Helper()
+	b, err := json.Marshal(&DeployRequest{DeployID: "deploy-1", Environment: "prod", ImageName: "app", Owner: owner})
+	if err != nil {
+		t.Fatalf("Unable to serialize the request: %s", err)
+	}
+	mock.ExpectQuery("SELECT request FROM deploys").WithArgs("deploy-1").
+		WillReturnRows(sqlmock.NewRows([]string{"request"}).AddRow(string(b)))
+}
+
+// expectApproval expects an approval by token to be recorded, bringing the total to count, and
+// appended to the deploy log with the name of the token.
+func expectApproval(mock sqlmock.Sqlmock, token string, name string, count int) {
+	mock.ExpectExec("INSERT IGNORE INTO deploy_approvals").WithArgs("deploy-1", token).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectQuery("SELECT COUNT\\(DISTINCT auth_token_id\\)").WithArgs("deploy-1").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(count))
+	mock.ExpectQuery("SELECT name FROM auth_tokens").WithArgs(token).
+		WillReturnRows(sqlmock.NewRows([]string{"name"}).AddRow(name))
+	mock.ExpectExec("SET log = CONCAT").
+		WithArgs(fmt.Sprintf("Approval %d of 2 received from '%s'.\n", count, name), "deploy-1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+}
+
+// approvalRequest returns a request to approve or reject deploy-1 with a bearer token.
+func approvalRequest(token string, body string) *http.Request {
+	r := httptest.NewRequest("POST", "/v1.0/deploy/deploy-1/approve", bytes.NewBufferString(body))
+	r.Header.Set("Authorization", "Bearer "+token)
+	return r
+}
+
+func TestApproveDeploySelfApproval(t *testing.T) {
+	t.Parallel()
+	s, mock := testApprovalServer(t)
+	expectRequest(t, mock, tokenKey("requester"))
+
+	w := httptest.NewRecorder()
+	s.approveDeploy(w, approvalRequest("requester", ""), pendingRow())
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected %d, got %d: %s", http.StatusForbidden, w.Code, w.Body)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unexpected database calls: %s", err)
+	}
+}
+
+func TestApproveDeploy(t *testing.T) {
+	t.Parallel()
+	s, mock := testApprovalServer(t)
+	owner := tokenKey("requester")
+
+	// The first approval keeps the deploy pending.
+	expectRequest(t, mock, owner)
+	expectApproval(mock, "alice", "Alice", 1)
+	mock.ExpectExec("UPDATE deploys").
+		WithArgs(db.PendingApproval, "Approval 1 of 2 received.", "", "deploy-1", db.PendingApproval).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	w := httptest.NewRecorder()
+	s.approveDeploy(w, approvalRequest("alice", ""), pendingRow())
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected %d, got %d: %s", http.StatusOK, w.Code, w.Body)
+	}
+	if n, _ := s.redis.LLen("queue").Result(); n != 0 {
+		t.Errorf("Expected nothing queued after the first approval, got %d", n)
+	}
+
+	// The second queues it, once the freezes are checked.
+	expectRequest(t, mock, owner)
+	expectApproval(mock, "bob", "Bob", 2)
+	mock.ExpectQuery("FROM freezes").WithArgs("prod", "prod").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "environment", "reason", "ends_at", "name", "created_at"}))
+	mock.ExpectExec("UPDATE deploys").
+		WithArgs(db.Queued, "Deploy approved and queued.", "Deploy approved and queued.\n", "deploy-1",
+			db.PendingApproval).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	w = httptest.NewRecorder()
+	s.approveDeploy(w, approvalRequest("bob", ""), pendingRow())
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected %d, got %d: %s", http.StatusOK, w.Code, w.Body)
+	}
+	queued, err := s.redis.LRange("queue", 0, -1).Result()
+	if err != nil || len(queued) != 1 {
+		t.Fatalf("Expected one queued deploy, got %v (%v)", queued, err)
+	}
+	var req DeployRequest
+	if err := json.Unmarshal([]byte(queued[0]), &req); err != nil {
+		t.Fatalf("Unable to read the queued deploy: %s", err)
+	}
+	if req.DeployID != "deploy-1" || req.Owner != owner || req.QueuedAt == 0 {
+		t.Errorf("Unexpected queued deploy: %+v", req)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unexpected database calls: %s", err)
+	}
+}
+
+func TestRejectDeploy(t *testing.T) {
+	t.Parallel()
+	s, mock := testApprovalServer(t)
+
+	mock.ExpectExec("UPDATE deploys").
+		WithArgs(db.Rejected, "Deploy rejected.", "Deploy rejected.\nReason: bad tag\n",
+			"deploy-1", db.PendingApproval).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	w := httptest.NewRecorder()
+	s.rejectDeploy(w, approvalRequest("alice", `{"reason":"bad tag"}`), pendingRow())
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected %d, got %d: %s", http.StatusOK, w.Code, w.Body)
+	}
+
+	// A deploy no longer pending cannot be rejected.
+	mock.ExpectExec("UPDATE deploys").WillReturnResult(sqlmock.NewResult(0, 0))
+	w = httptest.NewRecorder()
+	s.rejectDeploy(w, approvalRequest("alice", ""), pendingRow())
+	if w.Code != http.StatusConflict {
+		t.Errorf("Expected %d, got %d: %s", http.StatusConflict, w.Code, w.Body)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unexpected database calls: %s", err)
+	}
+}
+
+func TestExpirePendingDeploys(t *testing.T) {
+	t.Parallel()
+	conn, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Unable to create the database mock: %s", err)
+	}
+	defer conn.Close()
+
+	d := &deployService{
+		opt: &Options{Environments: map[string]*EnvironmentConfig{
+			"prod": {RequiresApproval: true, ApprovalTimeout: time.Hour},
+			"qa":   {},
+		}},
+		db:      db.NewDBConnectFromDB(conn),
+		log:     logger.New(logger.Error, false),
+		metrics: newServerMetrics(),
+	}
+
+	// prod waits an hour, qa no longer requires approval and staging was removed, so both use the default.
+	mock.ExpectQuery("SELECT deploy_id, environment, image_name").WithArgs(db.PendingApproval).
+		WillReturnRows(sqlmock.NewRows([]string{"deploy_id", "environment", "image_name", "age"}).
+			AddRow("deploy-1", "prod", "app", 3600).
+			AddRow("deploy-2", "prod", "app", 60).
+			AddRow("deploy-3", "qa", "app", 3600).
+			AddRow("deploy-4", "qa", "app", 86400).
+			AddRow("deploy-5", "staging", "app", 90000))
+	for _, id := range []string{"deploy-1", "deploy-4", "deploy-5"} {
+		msg := "Deploy approval expired after 24h0m0s."
+		if id == "deploy-1" {
+			msg = "Deploy approval expired after 1h0m0s."
+		}
+		mock.ExpectExec("UPDATE deploys").
+			WithArgs(db.Expired, msg, msg+"\n", id, db.PendingApproval).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+
+	d.expirePendingDeploys()
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unexpected database calls: %s", err)
+	}
+}
@@ -8,29 +8,144 @@ const (
 	maxRandom       = 16                     // Max Random chars to use for unique directory names.
 
 	// Config file defaults (yml)
-	DefaultConfigPrefix       = applicationName           // Server configuration file name (YML)
-	DefaultConfigPath         = "/etc/" + applicationName // Server configuration file location.
-	DefaultServerName         = applicationName
-	DefaultDomain             = applicationName
-	DefaultHostname           = "localhost"
-	DefaultPort               = 8080
-	DefaultDSN                = "root:root@tcp(mysql:3306)/" + applicationName
-	DefaultRedisHost          = "redis"
-	DefaultRedisPort          = "6379"
-	DefaultRedisKeyQueue      = applicationName + ":queue"
-	DefaultRedisKeyLastDeploy = applicationName + ":lastdeploy"
-	DefaultRedisPollInt       = 5 // sec.
-	DefaultProject            = "docker"
-	DefaultTempPath           = "/tmp/" + applicationName
-	DefaultImageTag           = "latest"
-	DefaultNumCont            = 2
+	DefaultConfigPrefix        = applicationName           // Server configuration file name (YML)
+	DefaultConfigPath          = "/etc/" + applicationName // Server configuration file location.
+	DefaultServerName          = applicationName
+	DefaultDomain              = applicationName
+	DefaultHostname            = "localhost"
+	DefaultPort                = 8080
+	DefaultDSN                 = "root:root@tcp(mysql:3306)/" + applicationName
+	DefaultRedisHost           = "redis"
+	DefaultRedisPort           = "6379"
+	DefaultRedisKeyQueue       = applicationName + ":queue"
+	DefaultRedisKeyLastDeploy  = applicationName + ":lastdeploy"
+	DefaultRedisPollInt        = 5 // sec.
+	DefaultProject             = "docker"
+	DefaultTempPath            = "/tmp/" + applicationName
+	DefaultImageTag            = "latest"
+	DefaultNumCont             = 2
+	DefaultApprovalsRequired   = 1
+	DefaultApprovalTimeout     = 24 * time.Hour
+	DefaultEtcdTimeout         = 5 * time.Second // Per request to an etcd endpoint.
+	DefaultRedisKeyRateLimit   = applicationName + ":ratelimit"
+	DefaultRedisKeyActive      = applicationName + ":active"
+	DefaultActiveDeployTTL     = 2 * time.Hour // Active deploys older than this are considered abandoned.
+	DefaultRedisKeyIdempotency = applicationName + ":idempotency"
+	DefaultIdempotencyWindow   = "24h"
+	DefaultShutdownGrace       = "5m"  // In-flight deploys get this long to finish before they are requeued.
+	DefaultEnvironmentsRefresh = "30s" // How often the environments in the DB are checked for changes.
+
+	DefaultLogFormat      = logFormatText
+	DefaultLogLevel       = "info"
+	DefaultRedactHeaders  = "Authorization,Proxy-Authorization,Cookie,Set-Cookie,X-Api-Key"
+	DefaultRedactFields   = "password,passwd,secret,token,api_key,apikey,access_key,private_key"
+	DefaultRedactMaxBody  = 4096
+	DefaultStatsDays      = 90
+	DefaultSyslogFacility = "local0"
+	DefaultTLSMinVersion  = "1.2"
+	DefaultTLSClientAuth  = "none"
+
+	// TLS.
+	certCheckInterval = 10 * time.Second // How often to check the certificate files for changes.
+
+	// Log formats.
+	logFormatText = "text"
+	logFormatJSON = "json"
+
+	// Modules with their own log level.
+	moduleHTTP   = "http"
+	moduleDeploy = "deploy"
+	moduleDB     = "db"
+	moduleEtcd   = "etcd"
+
+	logLevelDefault = "default" // Removes a module log level.
+
+	redactedValue   = "[REDACTED]" // Replaces secrets in logs.
+	minSecretLength = 4            // Secrets shorter than this are not masked by value.
+
+	tracingShutdownTimeout = 5 * time.Second // How long to wait for spans to be exported on shutdown.
+
+	// Readiness.
+	readyCheckTimeout = 5 * time.Second        // Time allowed for all readiness checks.
+	readyCacheTTL     = 10 * time.Second       // How long a readiness result is reused.
+	dockerSocket      = "/var/run/docker.sock" // Docker API socket if the docker binary is not installed.
+	checkTimeout      = 10 * time.Second       // Time allowed for each check-config and doctor check.
+
+	// Metrics.
+	metricsNamespace = "docker_deploy_server"
+
+	// Deploy outcomes.
+	outcomeSuccess    = "success"
+	outcomeFailed     = "failed"
+	outcomeRejected   = "rejected"
+	outcomeExpired    = "expired"
+	outcomeSuperseded = "superseded"
+	outcomeRequeued   = "requeued"
+
+	// Deploy steps.
+	stepDownloadImage    = "download_image"
+	stepDownloadMetadata = "download_metadata"
+	stepDeployMetadata   = "deploy_metadata"
+	stepUpdateEtcd       = "update_etcd"
+	stepDeployContainers = "deploy_containers"
+	stepFreezeCheck      = "freeze_check" // The environment was frozen when the worker took the deploy.
+	stepOther            = "other"        // Work between the steps above.
+
+	maxStatsDays = 365 // Longest period of deploy statistics.
+
+	// etcd APIs.
+	etcdAPIv2 = "v2"
+	etcdAPIv3 = "v3"
+
+	// Config sources.
+	configEnvPrefix  = "DDS"   // Prefix of environment variables that override the config.
+	secretFileSuffix = "_file" // Suffix of a key naming a file that holds a secret.
+	sourceDefault    = "default"
+	sourceConfig     = "config"
+	sourceEnv        = "env:"
+	sourceFile       = "file:"
+	sourceDB         = "db"
+
+	// Config reloads.
+	configReloadDelay = 500 * time.Millisecond // Wait for writes to a changed config file to settle.
+	auditConfigReload = "config.reload"
+	actorSIGHUP       = "SIGHUP"
+	actorConfigWatch  = "config file change"
+
+	// Environment changes.
+	auditEnvironmentPut    = "environment.put"
+	auditEnvironmentDelete = "environment.delete"
+	auditEtcdRollback      = "etcd.rollback"
+
+	// Rate limits.
+	limitWindow      = 60 // sec. Fixed window for requests per minute.
+	activeRetryAfter = 60 // sec. Retry-After when too many deploys are active.
 
 	// http: routes.
-	httpRouteV1Health  = "/v1.0/health"
-	httpRouteV1Info    = "/v1.0/info"
-	httpRouteV1Metrics = "/v1.0/metrics"
-	httpRouteV1Deploy  = "/v1.0/deploy"
-	httpRouteV1Status  = "/v1.0/status/"
+	httpRouteV1Health       = "/v1.0/health"
+	httpRouteV1Ready        = "/v1.0/health/ready"
+	httpRouteV1Info         = "/v1.0/info"
+	httpRouteV1Metrics      = "/v1.0/metrics"
+	httpRouteV1Prometheus   = "/v1.0/metrics/prometheus"
+	httpRouteV1Deploy       = "/v1.0/deploy"
+	httpRouteV1DeployAction = "/v1.0/deploy/" // :id/approve, :id/reject or :id/etcd-rollback
+	httpRouteV1Status       = "/v1.0/status/"
+	httpRouteV1Freeze       = "/v1.0/freeze"
+	httpRouteV1LogLevel     = "/v1.0/admin/log-level"
+	httpRouteV1Stats        = "/v1.0/stats"
+	httpRouteV1Environments = "/v1.0/admin/environments"
+	httpRouteV1Environment  = "/v1.0/admin/environments/" // :name
+
+	// Actions on a pending deploy, and on a finished one.
+	deployActionApprove      = "approve"
+	deployActionReject       = "reject"
+	deployActionEtcdRollback = "etcd-rollback"
+
+	// Rights that can be granted to an auth token.
+	rightApprove  = "approve"
+	rightFreeze   = "freeze"
+	rightOverride = "override"
+	rightAdmin    = "admin"
 
 	// Connections.
 	TCPReadTimeout  = 10 * time.Second
@@ -46,14 +161,41 @@ const (
 	httpPatch  = "PATCH"
 
 	// Error messages.
-	InvalidMediaType         = "Invalid Content-Type or Accept header value."
-	InvalidMethod            = "Invalid Method for this route."
-	InvalidBody              = "Invalid body of text in request."
-	InvalidJSONText          = "Invalid JSON format in text of body in request."
-	InvalidJSONAttribute     = "Invalid - 'text' attribute in JSON not found."
-	InvalidAuthorization     = "Invalid authorization."
-	InvalidEnvAuthorization  = "Invalid authorization for environment."
-	InvalidDeployEnv         = "Invalid 'deployEnvironment'."
-	InvalidDeployImage       = "Invalid 'image'."
-	InvalidDeployCannotQueue = "Cannot queue deploy request at this time."
+	InvalidMediaType           = "Invalid Content-Type or Accept header value."
+	InvalidMethod              = "Invalid Method for this route."
+	InvalidBody                = "Invalid body of text in request."
+	InvalidJSONText            = "Invalid JSON format in text of body in request."
+	InvalidJSONAttribute       = "Invalid - 'text' attribute in JSON not found."
+	InvalidAuthorization       = "Invalid authorization."
+	InvalidEnvAuthorization    = "Invalid authorization for environment."
+	InvalidDeployEnv           = "Invalid 'deployEnvironment'."
+	InvalidDeployImage         = "Invalid 'image'."
+	InvalidDeployCannotQueue   = "Cannot queue deploy request at this time."
+	InvalidIdempotencyKey      = "Idempotency-Key was already used with a different request body."
+	InvalidDeployID            = "Invalid deploy ID."
+	InvalidDeployAction        = "Invalid deploy action."
+	InvalidDeployNotPending    = "Deploy is not pending approval."
+	InvalidRightAuthorization  = "Invalid authorization for this action."
+	InvalidDeployCannotApprove = "Cannot record deploy approval at this time."
+	InvalidDeploySelfApproval  = "A deploy cannot be approved by the token that requested it."
+	InvalidDeployNotFinished   = "Deploy has not finished."
+	InvalidDeployNoSnapshot    = "Deploy did not change any etcd keys."
+	InvalidDeployUnavailable   = "Deploy cannot be read at this time."
+	InvalidEtcdRollback        = "Unable to restore the etcd keys: "
+	InvalidDeployFrozen        = "Deploys to this environment are frozen: "
+	InvalidFreezeReason        = "Invalid 'reason'."
+	InvalidFreezeUntil         = "Invalid 'until'. Must be RFC 3339."
+	InvalidFreezeCannotSet     = "Cannot update freeze at this time."
+	InvalidFreezeUnavailable   = "Cannot read deploy freezes at this time."
+	InvalidTooManyRequests     = "Too many requests. Please retry later."
+	InvalidLogLevel            = "Invalid 'level'."
+	InvalidStatsDays           = "Invalid 'days'. Must be 1 to 365."
+	InvalidStatsUnavailable    = "Deploy statistics are not available at this time."
+	InvalidEnvName             = "Invalid environment name. Must be 1-64 letters, digits, _ or -"
+	InvalidEnvSettings         = "Invalid environment settings: "
+	InvalidEnvSecret           = "Secrets cannot be stored in the DB. Set registry_password and etcd_password with an environment variable or file."
+	InvalidEnvNotFound         = "Environment not found."
+	InvalidEnvCannotSave       = "Cannot update environment at this time."
+	InvalidRequestID           = "Invalid X-Request-ID header. Must be 1-128 letters, digits or . _ : -"
+	InvalidLogModule           = "Invalid 'module'. Must be http, deploy, db or etcd."
 )
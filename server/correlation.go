@@ -0,0 +1,39 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/composer22/docker-deploy-server/tracing"
+)
+
+// validRequestID matches client request IDs that are safe to store and log.
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._:-]{0,127}$`)
+
+type correlationKey struct{}
+
+// requestCorrelationID returns the correlation ID sent by the client: its X-Request-ID or, failing
+// that, the trace ID of a valid traceparent. It is empty if neither was sent. ok is false if the
+// X-Request-ID is malformed.
+func requestCorrelationID(r *http.Request) (id string, ok bool) {
+	if id = strings.TrimSpace(r.Header.Get("X-Request-ID")); id != "" {
+		return id, validRequestID.MatchString(id)
+	}
+	if sc, err := tracing.ParseTraceparent(r.Header.Get("traceparent")); err == nil {
+		return strings.Split(sc.Traceparent(), "-")[1], true
+	}
+	return "", true
+}
+
+// withCorrelationID returns a copy of the request that carries the correlation ID.
+func withCorrelationID(r *http.Request, id string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), correlationKey{}, id))
+}
+
+// correlationID returns the correlation ID of a request, or empty if the client did not send one.
+func correlationID(r *http.Request) string {
+	id, _ := r.Context().Value(correlationKey{}).(string)
+	return id
+}
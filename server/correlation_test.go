@@ -0,0 +1,44 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestRequestCorrelationID(t *testing.T) {
+	t.Parallel()
+	tp := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	tests := []struct {
+		requestID   string
+		traceparent string
+		expected    string
+		ok          bool
+	}{
+		{"", "", "", true},
+		{"build-1234:step.2", "", "build-1234:step.2", true},
+		{"DC8D9C2E-8161-4FC0-937F-4CA7037970D5", tp, "DC8D9C2E-8161-4FC0-937F-4CA7037970D5", true},
+		{"", tp, "4bf92f3577b34da6a3ce929d0e0e4736", true},
+		{"", "00-bad", "", true},
+		{"bad id", "", "bad id", false},
+		{"-leading", "", "-leading", false},
+		{strings.Repeat("a", 129), "", strings.Repeat("a", 129), false},
+		{"<script>", tp, "<script>", false},
+	}
+	for _, tc := range tests {
+		r, _ := http.NewRequest("GET", "/v1.0/info", nil)
+		if tc.requestID != "" {
+			r.Header.Set("X-Request-ID", tc.requestID)
+		}
+		if tc.traceparent != "" {
+			r.Header.Set("traceparent", tc.traceparent)
+		}
+		id, ok := requestCorrelationID(r)
+		if id != tc.expected || ok != tc.ok {
+			t.Errorf("Expected '%s' %t, received '%s' %t.", tc.expected, tc.ok, id, ok)
+		}
+		if ok && correlationID(withCorrelationID(r, id)) != id {
+			t.Errorf("Correlation ID should be carried by the request.")
+		}
+	}
+}
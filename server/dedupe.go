@@ -0,0 +1,93 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/composer22/docker-deploy-server/db"
+)
+
+// errIdempotencyMismatch is returned when an Idempotency-Key is reused with a different body.
+var errIdempotencyMismatch = errors.New("idempotency key reused with a different body")
+
+// reserveIdempotencyKey reserves the Idempotency-Key header of a deploy request for a new deploy ID.
+// If the key was already used by the token within the window, the original deploy ID is returned
+// instead, or errIdempotencyMismatch if that request had a different body. The reserved redis key is
+// returned so it can be released if the request fails.
+func (s *Server) reserveIdempotencyKey(r *http.Request, deployID string,
+	body []byte) (key string, replayID string, err error) {
+	ik := r.Header.Get("Idempotency-Key")
+	if ik == "" {
+		return "", "", nil
+	}
+	opt := s.options()
+	sum := sha256.Sum256(body)
+	hash := hex.EncodeToString(sum[:])
+	key = fmt.Sprintf("%s:%s:%s", opt.RedisKeyIdempotency, tokenKey(s.authToken(r)), tokenKey(ik))
+	ok, err := s.redis.SetNX(key, hash+" "+deployID, opt.IdempotencyWindow).Result()
+	if err != nil {
+		return "", "", err
+	}
+	if ok {
+		return key, "", nil
+	}
+	val, err := s.redis.Get(key).Result()
+	if err != nil {
+		return "", "", err
+	}
+	// The value is the body hash and the deploy ID.
+	prev := strings.SplitN(val, " ", 2)
+	if len(prev) != 2 || prev[0] != hash {
+		return "", "", errIdempotencyMismatch
+	}
+	return "", prev[1], nil
+}
+
+// coalesceQueued removes deploys for the same environment and image that are still waiting in the
+// queue, so only the newest request is deployed. It returns the IDs of the deploys replaced.
+func (s *Server) coalesceQueued(p *DeployRequest) []string {
+	var replaced []string
+	for _, q := range s.dequeueOlder(p) {
+		msg := fmt.Sprintf("Superseded by deploy %s (%s).", p.DeployID, p.ImageTag)
+		s.db.TransitionDeploy(q.DeployID, db.Queued, db.Superseded, msg, fmt.Sprintln(msg))
+		s.metrics.deploys.Inc(q.Environment, q.ImageName, outcomeSuperseded)
+		replaced = append(replaced, q.DeployID)
+	}
+	return replaced
+}
+
+// dequeueOlder removes the requests for the same environment and image as a deploy from the queue,
+// and from their token's active deploys. It returns the requests removed.
+func (s *Server) dequeueOlder(p *DeployRequest) []*DeployRequest {
+	items, err := s.redis.LRange(s.options().RedisKeyQueue, 0, -1).Result()
+	if err != nil {
+		s.metrics.redisErrors.Inc("api")
+		s.log.Errorf("Unable to read queue to coalesce deploy %s: %s", p.DeployID, err)
+		return nil
+	}
+
+	var removed []*DeployRequest
+	for _, item := range items {
+		var q DeployRequest
+		if err := json.Unmarshal([]byte(item), &q); err != nil {
+			continue
+		}
+		if q.DeployID == p.DeployID || q.Environment != p.Environment || q.ImageName != p.ImageName {
+			continue
+		}
+		// If it's no longer in the queue, a worker already started it.
+		if n, err := s.redis.LRem(s.options().RedisKeyQueue, 1, item).Result(); err != nil || n == 0 {
+			continue
+		}
+		if q.Owner != "" {
+			s.redis.ZRem(activeDeploysKey(s.options().RedisKeyActive, q.Owner), q.DeployID)
+		}
+		removed = append(removed, &q)
+	}
+	return removed
+}
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestReserveIdempotencyKey(t *testing.T) {
+	t.Parallel()
+	s := testRedisServer(t)
+	r := httptest.NewRequest("POST", httpRouteV1Deploy, nil)
+	r.Header.Set("Authorization", "Bearer token-a")
+	body := []byte(`{"environment":"qa","imageName":"api"}`)
+
+	if key, replayID, err := s.reserveIdempotencyKey(r, "deploy-1", body); err != nil || key != "" || replayID != "" {
+		t.Errorf("Expected nothing reserved without a key, received %q %q: %v", key, replayID, err)
+	}
+	r.Header.Set("Idempotency-Key", "retry-1")
+	key, replayID, err := s.reserveIdempotencyKey(r, "deploy-1", body)
+	if err != nil || key == "" || replayID != "" {
+		t.Fatalf("Expected the key reserved, received %q %q: %v", key, replayID, err)
+	}
+	if ttl, _ := s.redis.TTL(key).Result(); ttl <= 0 || ttl > time.Hour {
+		t.Errorf("Expected the key to expire within the window, received a TTL of %s.", ttl)
+	}
+
+	// A retry with the same body gets the original deploy.
+	if key, replayID, err := s.reserveIdempotencyKey(r, "deploy-2", body); err != nil || key != "" || replayID != "deploy-1" {
+		t.Errorf("Expected deploy-1 replayed, received %q %q: %v", key, replayID, err)
+	}
+	// A different body is not a retry.
+	other := []byte(`{"environment":"prod","imageName":"api"}`)
+	if _, replayID, err := s.reserveIdempotencyKey(r, "deploy-3", other); err != errIdempotencyMismatch || replayID != "" {
+		t.Errorf("Expected a mismatch, received %q: %v", replayID, err)
+	}
+	// Keys are per token.
+	r.Header.Set("Authorization", "Bearer token-b")
+	if key, replayID, err := s.reserveIdempotencyKey(r, "deploy-4", other); err != nil || key == "" || replayID != "" {
+		t.Errorf("Expected the key reserved for another token, received %q %q: %v", key, replayID, err)
+	}
+}
+
+func TestDequeueOlder(t *testing.T) {
+	t.Parallel()
+	s := testRedisServer(t)
+	queue := []*DeployRequest{
+		{DeployID: "1", Environment: "qa", ImageName: "api", Owner: "a"},
+		{DeployID: "2", Environment: "qa", ImageName: "web", Owner: "a"},
+		{DeployID: "3", Environment: "prod", ImageName: "api", Owner: "a"},
+		{DeployID: "4", Environment: "qa", ImageName: "api", Owner: "b"},
+		{DeployID: "5", Environment: "qa", ImageName: "api", Owner: "a"},
+	}
+	for _, q := range queue {
+		s.redis.RPush("queue", fmt.Sprint(q))
+		s.trackActive(q)
+	}
+
+	removed := s.dequeueOlder(queue[4])
+	if len(removed) != 2 || removed[0].DeployID != "1" || removed[1].DeployID != "4" {
+		t.Fatalf("Expected deploys 1 and 4 removed, received %v.", removed)
+	}
+	items, _ := s.redis.LRange("queue", 0, -1).Result()
+	if len(items) != 3 || items[0] != fmt.Sprint(queue[1]) || items[2] != fmt.Sprint(queue[4]) {
+		t.Errorf("Expected deploys 2, 3 and 5 left in the queue, received %v.", items)
+	}
+	if active, _ := s.redis.ZRange(activeDeploysKey("active", "a"), 0, -1).Result(); len(active) != 3 {
+		t.Errorf("Expected deploy 1 no longer active, received %v.", active)
+	}
+	if active, _ := s.redis.ZRange(activeDeploysKey("active", "b"), 0, -1).Result(); len(active) != 0 {
+		t.Errorf("Expected deploy 4 no longer active, received %v.", active)
+	}
+}
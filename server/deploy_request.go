@@ -4,17 +4,23 @@ import "encoding/json"
 
 // DeployRequest is a struct used to demarshal requests for a deploy and also to process.
 type DeployRequest struct {
-	DeployID     string `json:"deployID"`     // A UUID for the request and for this deploy (client filled).
-	ImageName    string `json:"imageName"`    // Image name in the repository in docker registry (client filled).
-	ImageTag     string `json:"imageTag"`     // Image tag to deploy (client filled).
-	Environment  string `json:"environment"`  // Environment from config.yml (client filled).
-	EnvTag       string `json:"envTag"`       // Used to resolve machine names that are in the env (machine filled).
-	EtcdEndpoint string `json:"etcdEndpoint"` // Etcd hostname and port (machine filled).
-	Machine      string `json:"machine"`      // Master machine node for the cluster or local (machine filled).
-	MetaMount    string `json:"metaMount"`    // Remote directory on a machine to place the metadata (machine filled).
-	NumCont      int    `json:"numCont"`      // Default number of containers for this environment (machine filled).
-	Registry     string `json:"registry"`     // Docker registry for this environment (machine filled).
-	Swarm        bool   `json:"swarm"`        // Is this machine apart of a cluster (machine filled)?
+	DeployID     string `json:"deployID"`      // A UUID for the request and for this deploy (client filled).
+	ImageName    string `json:"imageName"`     // Image name in the repository in docker registry (client filled).
+	ImageTag     string `json:"imageTag"`      // Image tag to deploy (client filled).
+	Environment  string `json:"environment"`   // Environment from config.yml (client filled).
+	EnvTag       string `json:"envTag"`        // Used to resolve machine names that are in the env (machine filled).
+	EtcdEndpoint string `json:"etcdEndpoint"`  // Etcd URLs, comma separated (machine filled).
+	Machine      string `json:"machine"`       // Master machine node for the cluster or local (machine filled).
+	MetaMount    string `json:"metaMount"`     // Remote directory on a machine to place the metadata (machine filled).
+	NumCont      int    `json:"numCont"`       // Default number of containers for this environment (machine filled).
+	Registry     string `json:"registry"`      // Docker registry for this environment (machine filled).
+	Swarm        bool   `json:"swarm"`         // Is this machine apart of a cluster (machine filled)?
+	Owner        string `json:"owner"`         // Hash of the token that requested the deploy (machine filled).
+	QueuedAt     int64  `json:"queuedAt"`      // Unix time the deploy was pushed to the queue (machine filled).
+	Traceparent  string `json:"traceparent"`   // W3C trace context of the span that queued the deploy (machine filled).
+	Correlation  string `json:"correlationID"` // Client request or trace ID of the request (machine filled).
+
+	FreezeOverride bool `json:"freezeOverride"` // Was the deploy queued by a freeze override (machine filled)?
 }
 
 // NewDeployRequest is a factory function that returns a DeployRequest instance.
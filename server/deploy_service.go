@@ -1,10 +1,14 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -12,30 +16,51 @@ import (
 
 	"github.com/composer22/docker-deploy-server/db"
 	"github.com/composer22/docker-deploy-server/etcd2"
+	"github.com/composer22/docker-deploy-server/etcd3"
 	"github.com/composer22/docker-deploy-server/logger"
+	"github.com/composer22/docker-deploy-server/tracing"
 	"github.com/spf13/viper"
 	redis "gopkg.in/redis.v3"
 )
 
+// errDeployAborted is returned by a script killed at the end of the shutdown grace period.
+var errDeployAborted = errors.New("Deploy stopped by server shutdown.")
+
 // DeployService handles requests for deployoemnt into one or more machines for an environment (dev, qa etc.)
 type deployService struct {
-	opt   *Options        // Server options.
-	db    *db.DBConnect   // Database connection.
-	redis *redis.Client   // Redis connection for the queue.
-	done  chan bool       // Channel to receive signal to shutdown now.
-	log   *logger.Logger  // Application log for events.
-	wg    *sync.WaitGroup // Wait group for the run.
+	opt     *Options        // Server options as of the deploy in progress.
+	options func() *Options // Returns the current server options.
+	frozen  freezeCheck     // Returns whether deploys to an environment are frozen.
+	db      *db.DBConnect   // Database connection.
+	redis   *redis.Client   // Redis connection for the queue.
+	done    chan bool       // Channel to receive signal to shutdown now.
+	abort   context.Context // Cancelled to stop the deploy in progress at the end of the shutdown grace period.
+	log     *logger.Logger  // Application log for events.
+	wg      *sync.WaitGroup // Wait group for the run.
+	metrics *serverMetrics  // Metrics for deploys and the worker.
+	redact  *redactor       // Masks secrets in script output.
+	tracer  *tracing.Tracer // Tracer for deploy and step spans.
+
+	etcdConns map[string]*etcdConn // etcd connections by environment, reused across deploys.
 }
 
 // NewDeployService is a factory function that returns a new deployment service instance.
-func NewDeployService(o *Options, s *db.DBConnect, r *redis.Client, d chan bool, l *logger.Logger, wg *sync.WaitGroup) *deployService {
+func NewDeployService(o func() *Options, f freezeCheck, s *db.DBConnect, r *redis.Client, d chan bool, a context.Context, l *logger.Logger,
+	wg *sync.WaitGroup, m *serverMetrics, rd *redactor, t *tracing.Tracer) *deployService {
 	return &deployService{
-		opt:   o,
-		db:    s,
-		redis: r,
-		done:  d,
-		log:   l,
-		wg:    wg,
+		options: o,
+		frozen:  f,
+		db:      s,
+		redis:   r,
+		done:    d,
+		abort:   a,
+		log:     l,
+		wg:      wg,
+		metrics: m,
+		redact:  rd,
+		tracer:  t,
+
+		etcdConns: make(map[string]*etcdConn),
 	}
 }
 
@@ -51,8 +76,11 @@ func (d *deployService) Run() {
 			d.redis.Close()
 			return
 		default:
+			d.opt = d.options() // A deploy keeps the config it started with.
+			d.expirePendingDeploys()
 			result, err := d.redis.RPop(d.opt.RedisKeyQueue).Result()
 			if err != nil && err.Error() != "redis: nil" {
+				d.metrics.redisErrors.Inc("worker")
 				d.log.Errorf(err.Error())
 				break
 			}
@@ -67,20 +95,139 @@ func (d *deployService) Run() {
 			}
 			d.deploy(&r)
 		}
-		time.Sleep(time.Duration(d.opt.RedisPollInt) * time.Second)
+		select {
+		case <-d.done:
+		case <-time.After(time.Duration(d.opt.RedisPollInt) * time.Second):
+		}
+	}
+}
+
+// expirePendingDeploys expires deploys that have waited for approval longer than their
+// environment allows. Deploys in environments no longer configured, or no longer requiring
+// approval, expire after the default timeout.
+func (d *deployService) expirePendingDeploys() {
+	pending, err := d.db.PendingDeploys()
+	if err != nil {
+		d.log.Errorf(err.Error())
+		return
+	}
+	for _, p := range pending {
+		timeout := DefaultApprovalTimeout
+		if cfg := d.opt.environment(p.Environment); cfg.RequiresApproval && cfg.ApprovalTimeout > 0 {
+			timeout = cfg.ApprovalTimeout
+		}
+		if p.Age < timeout {
+			continue
+		}
+		msg := fmt.Sprintf("Deploy approval expired after %s.", timeout)
+		if d.db.TransitionDeploy(p.DeployID, db.PendingApproval, db.Expired, msg, fmt.Sprintln(msg)) {
+			d.metrics.deploys.Inc(p.Environment, p.ImageName, outcomeExpired)
+		}
 	}
 }
 
 // Deploy will handle details to deploy a request to a machine or cluster of machines.
 func (d *deployService) deploy(r *DeployRequest) {
+	// Every line logged for this deploy carries its ID, environment and image.
+	fields := logger.Fields{
+		logger.MsgIDField: "deploy",
+		"deployID":        r.DeployID,
+		"environment":     r.Environment,
+		"image":           r.ImageName,
+		"imageTag":        r.ImageTag,
+	}
+	if r.Correlation != "" {
+		fields["correlationID"] = r.Correlation
+	}
+	dlog := d.log.With(fields)
+	dlog.Infof("Deploy started.")
+
+	// Continue the trace of the request that queued the deploy.
+	parent, _ := tracing.ParseTraceparent(r.Traceparent)
+	span := d.tracer.Start("deploy", tracing.KindConsumer, parent)
+	span.SetAttribute("deploy.id", r.DeployID)
+	span.SetAttribute("deploy.environment", r.Environment)
+	span.SetAttribute("deploy.image", r.ImageName)
+	span.SetAttribute("deploy.image_tag", r.ImageTag)
+	if r.Correlation != "" {
+		span.SetAttribute("correlation.id", r.Correlation)
+	}
+	if r.QueuedAt > 0 {
+		span.SetAttribute("deploy.queued_seconds", time.Since(time.Unix(r.QueuedAt, 0)).Seconds())
+	}
+
+	// Record the worker state, the outcome and how long each step takes.
+	outcome := outcomeFailed
+	failedStep := stepOther
+	containersDeployed := false // The new containers are running with the new etcd keys.
+	aborted := false            // A step was stopped by shutdown.
+	d.metrics.workerBusy.Set(1)
+	defer func() {
+		// A deploy stopped by shutdown runs again from the start after a restart. One that failed on its own
+		// has already been marked failed and is not run again.
+		if outcome != outcomeSuccess && aborted {
+			outcome = outcomeRequeued
+			if !d.requeue(r, dlog) {
+				outcome = outcomeFailed
+			}
+		}
+		// Release the requesting token's active deploy slot unless it is still queued.
+		if r.Owner != "" && outcome != outcomeRequeued {
+			d.redis.ZRem(activeDeploysKey(d.opt.RedisKeyActive, r.Owner), r.DeployID)
+		}
+		d.metrics.workerBusy.Set(0)
+		d.metrics.deploys.Inc(r.Environment, r.ImageName, outcome)
+		if outcome == outcomeFailed {
+			d.db.SetFailedStep(r.DeployID, failedStep)
+		}
+		dlog.Infof("Deploy finished: %s.", outcome)
+		span.SetAttribute("deploy.outcome", outcome)
+		if outcome == outcomeSuccess {
+			span.SetOK()
+		} else {
+			span.SetError(errors.New(outcome))
+		}
+		span.Finish()
+	}()
+	var stepStart time.Time
+	var stepSpan *tracing.Span
+	startStep := func(step string) {
+		stepStart, failedStep = time.Now(), step
+		stepSpan = d.tracer.Start("deploy."+step, tracing.KindInternal, span.Context)
+	}
+	endStep := func(step string, err error) {
+		aborted = err == errDeployAborted
+		d.metrics.stepDuration.Observe(time.Since(stepStart).Seconds(), step, r.Environment)
+		if err != nil {
+			stepSpan.SetError(errors.New(d.redact.text(err.Error())))
+		} else {
+			failedStep = stepOther
+		}
+		stepSpan.Finish()
+	}
+
 	// Log the start to the DB.
 	row, err := d.db.QueryDeploy(r.DeployID)
 	if err != nil {
 		msg := "Could not get Deploy from MySQL for ID: "
-		d.log.Errorf("ERR: %s %s\n%s\n", msg, r.DeployID, err)
+		dlog.Errorf("ERR: %s %s\n%s\n", msg, r.DeployID, err)
 		return
 	}
 	log := row.Log
+
+	// A freeze that started after the deploy was queued stops it, unless it was queued by an override.
+	if reason, frozen, err := d.frozen(r.Environment, time.Now()); (frozen || err != nil) && !r.FreezeOverride {
+		failedStep = stepFreezeCheck
+		msg := fmt.Sprintf("Deploy not started: the environment is frozen: %s. Request it again after the freeze.",
+			reason)
+		if err != nil {
+			msg = "Deploy not started: unable to read the deploy freezes."
+		}
+		log += fmt.Sprintf("ERR: %s\n", msg)
+		d.db.UpdateDeploy(r.DeployID, db.Failed, msg, log)
+		return
+	}
+
 	msg := "Started Deploy."
 	log += fmt.Sprintln(msg)
 	d.db.UpdateDeploy(r.DeployID, db.Started, msg, log)
@@ -89,6 +236,7 @@ func (d *deployService) deploy(r *DeployRequest) {
 	lastImageDeployKey := fmt.Sprintf("%s:%s", d.opt.RedisKeyLastDeploy, r.Environment)
 	lastImageTag, err := d.redis.HGet(lastImageDeployKey, r.ImageName).Result()
 	if err != nil && err.Error() != "redis: nil" {
+		d.metrics.redisErrors.Inc("worker")
 		msg = "Unable to access redis server for last deploy validation."
 		log += fmt.Sprintf("ERR: %s\n%s\n", msg, err)
 		d.db.UpdateDeploy(r.DeployID, db.Failed, msg, log)
@@ -112,8 +260,11 @@ func (d *deployService) deploy(r *DeployRequest) {
 	msg = "Extracting meta-data from Docker image in registry."
 	log += fmt.Sprintln(msg)
 	d.db.UpdateDeploy(r.DeployID, db.Started, msg, log)
-	cmd := exec.Command("./scripts/download-image.sh", r.ImageTag, r.Registry, r.ImageName, tempDirectory)
+	startStep(stepDownloadImage)
+	cmd := exec.CommandContext(d.abort, "./scripts/download-image.sh", r.ImageTag, r.Registry, r.ImageName, tempDirectory)
+	cmd.Env = d.registryEnv(r)
 	log, err = d.executeCommand(cmd, r, msg, log)
+	endStep(stepDownloadImage, err)
 	if err != nil {
 		return
 	}
@@ -131,8 +282,10 @@ func (d *deployService) deploy(r *DeployRequest) {
 	msg = "Downloading meta-data from git."
 	log += fmt.Sprintln(msg)
 	d.db.UpdateDeploy(r.DeployID, db.Started, msg, log)
-	cmd = exec.Command("./scripts/download-metadata.sh", d.opt.GitRepo, d.opt.GitRoot, tempDirectory)
+	startStep(stepDownloadMetadata)
+	cmd = exec.CommandContext(d.abort, "./scripts/download-metadata.sh", d.opt.GitRepo, d.opt.GitRoot, tempDirectory)
 	log, err = d.executeCommand(cmd, r, msg, log)
+	endStep(stepDownloadMetadata, err)
 	if err != nil {
 		return
 	}
@@ -157,22 +310,39 @@ func (d *deployService) deploy(r *DeployRequest) {
 	msg = "Deploying meta-data."
 	log += fmt.Sprintln(msg)
 	d.db.UpdateDeploy(r.DeployID, db.Started, msg, log)
-	cmd = exec.Command("./scripts/deploy-metadata.sh", r.EnvTag, d.opt.GitRepo, r.MetaMount, tempDirectory)
+	startStep(stepDeployMetadata)
+	cmd = exec.CommandContext(d.abort, "./scripts/deploy-metadata.sh", r.EnvTag, d.opt.GitRepo, r.MetaMount, tempDirectory)
 	log, err = d.executeCommand(cmd, r, msg, log)
+	endStep(stepDeployMetadata, err)
 	if err != nil {
 		return
 	}
 
-	// Update the etcd keys in the cluster to this new meta-data (common + app specific only).
-	if r.EtcdEndpoint != "" {
-		msg := "Deploying etcd2 keys."
+	// Update the etcd keys in the cluster to this new meta-data (common + app specific only). The
+	// endpoints are those of the config the deploy runs with, which also makes the connection.
+	if len(d.opt.environment(r.Environment).EtcdEndpoints) > 0 {
+		msg := "Deploying etcd keys."
 		log += fmt.Sprintln(msg)
 		d.db.UpdateDeploy(r.DeployID, db.Started, msg, log)
-		if msg, err := d.updateEtcd(r, tempDirectory); err != nil {
+		startStep(stepUpdateEtcd)
+		var snapshot *etcd2.Snapshot
+		log, msg, snapshot, err = d.updateEtcd(r, tempDirectory, log)
+		endStep(stepUpdateEtcd, err)
+		if err != nil {
 			log += fmt.Sprintf("ERR: %s\n%s\n", msg, err)
 			d.db.UpdateDeploy(r.DeployID, db.Failed, msg, log)
 			return
 		}
+
+		// Put the keys back if a later step fails before the new containers are up, so the config matches
+		// the containers still running.
+		if snapshot != nil {
+			defer func() {
+				if outcome != outcomeSuccess && !containersDeployed {
+					d.db.AppendDeployLog(r.DeployID, d.restoreEtcd(r, snapshot))
+				}
+			}()
+		}
 	}
 
 	// Deploy containers to the machines.
@@ -185,16 +355,21 @@ func (d *deployService) deploy(r *DeployRequest) {
 	if lastImageTag == "" {
 		lastImageTag = r.ImageTag
 	}
-	cmd = exec.Command("./scripts/deploy-containers.sh", r.ImageName, r.ImageTag, lastImageTag,
+	startStep(stepDeployContainers)
+	cmd = exec.CommandContext(d.abort, "./scripts/deploy-containers.sh", r.ImageName, r.ImageTag, lastImageTag,
 		r.Registry, service, r.Machine, nc, d.opt.Project, sw, tempDirectory)
+	cmd.Env = d.registryEnv(r)
 	log, err = d.executeCommand(cmd, r, msg, log)
+	endStep(stepDeployContainers, err)
 	if err != nil {
 		return
 	}
+	containersDeployed = true
 
 	// Update redis with the repo, image, image tag of the last deploy.
 	_, err = d.redis.HSet(lastImageDeployKey, r.ImageName, r.ImageTag).Result()
 	if err != nil {
+		d.metrics.redisErrors.Inc("worker")
 		msg = "Unable to access redis server to set last deploy image tag."
 		log += fmt.Sprintf("ERR: %s\n%s\n", msg, err)
 		d.db.UpdateDeploy(r.DeployID, db.Failed, msg, log)
@@ -205,57 +380,197 @@ func (d *deployService) deploy(r *DeployRequest) {
 	msg = "Containers deployed successfully."
 	log += fmt.Sprintf("SUCCESS: %s\n", msg)
 	d.db.UpdateDeploy(r.DeployID, db.Success, msg, log)
+	outcome = outcomeSuccess
 }
 
-// updateEtcd updates etcd2 keys in the environment.
-func (d *deployService) updateEtcd(r *DeployRequest, tempDirectory string) (msg string, err error) {
-	etcd2Keys := make(map[string]string)
-
-	// Read in common etcd2 keys from the metadata.
-	v := viper.New()
-	v.SetConfigName(fmt.Sprintf("%s.etcd2", r.Environment))
-	v.AddConfigPath(fmt.Sprintf("%s/%s/roles/common/meta", tempDirectory, d.opt.GitRepo))
-	d.readEtcdKeys(v, etcd2Keys)
+// requeue puts a deploy stopped by shutdown back on the queue. Returns false if it could not.
+func (d *deployService) requeue(r *DeployRequest, dlog *logger.Logger) bool {
+	var log string
+	if row, err := d.db.QueryDeploy(r.DeployID); err == nil {
+		log = row.Log
+	}
+	if _, err := d.redis.RPush(d.opt.RedisKeyQueue, fmt.Sprint(r)).Result(); err != nil {
+		d.metrics.redisErrors.Inc("worker")
+		msg := "Deploy stopped by server shutdown and could not be requeued."
+		dlog.Errorf("%s %s", msg, err)
+		d.db.UpdateDeploy(r.DeployID, db.Failed, msg, log+fmt.Sprintf("ERR: %s\n%s\n", msg, err))
+		return false
+	}
+	msg := "Deploy stopped by server shutdown. Requeued."
+	dlog.Warningf(msg)
+	d.db.UpdateDeploy(r.DeployID, db.Queued, msg, log+fmt.Sprintln(msg))
+	return true
+}
 
-	// Read in the application etcd2 keys from the metadata.
-	v = viper.New()
-	v.SetConfigName(fmt.Sprintf("%s.etcd2", r.Environment))
-	v.AddConfigPath(fmt.Sprintf("%s/%s/roles/%s/meta", tempDirectory, d.opt.GitRepo, r.ImageName))
-	d.readEtcdKeys(v, etcd2Keys)
+// updateEtcd updates etcd keys in the environment from the key files of the metadata. Keys of the
+// image's role override the common keys. The changes to the live keys under the image's prefix are
+// written to the deploy log; keys no longer declared are deleted if the environment prunes. Each key
+// is changed only if no one else changed it since it was read, and the previous values are saved with
+// the deploy first. Returns the deploy log and the snapshot to restore if the deploy fails.
+func (d *deployService) updateEtcd(r *DeployRequest, tempDirectory string, log string) (string, string,
+	*etcd2.Snapshot, error) {
+	var problems []string
+	keys := make([]map[string]*etcd2.Key, 0, 2)
+	prefix := "/" + r.ImageName
+	allowed := d.opt.environment(r.Environment).EtcdPrefixes
+	for _, role := range []string{"common", r.ImageName} {
+		file := findEtcdKeyFile(fmt.Sprintf("%s/%s/roles/%s/meta", tempDirectory, d.opt.GitRepo, role), r.Environment)
+		if file == "" {
+			continue
+		}
+		k, p, pr := readEtcdKeyFile(file)
+		problems = append(problems, pr...)
+		keys = append(keys, k)
+		if p != "" {
+			// The prefix decides which keys are pruned, so only the image's role sets it, within its keys.
+			if msg := checkEtcdPrefix(p, role, r.ImageName, allowed); msg != "" {
+				problems = append(problems, fmt.Sprintf("%s: %s", filepath.Base(file), msg))
+				continue
+			}
+			prefix = p
+		}
+		log += fmt.Sprintf("Read %d etcd keys from roles/%s/meta/%s.\n", len(k), role, filepath.Base(file))
+	}
 
-	// No keys to update. Return.
-	if len(etcd2Keys) <= 0 {
-		return "", nil
+	// No key files. The image does not use etcd.
+	if len(keys) == 0 {
+		return log, "", nil, nil
+	}
+	for len(keys) < 2 {
+		keys = append(keys, nil)
+	}
+	declared, p := mergeEtcdKeys(keys[0], keys[1])
+	if problems = append(problems, p...); len(problems) > 0 {
+		return log, "Invalid etcd key files in the meta-data.", nil, errors.New(strings.Join(problems, "\n"))
 	}
 
 	// Get a connection.
-	conn, err := etcd2.NewEtcd2Connect(r.EtcdEndpoint)
+	elog := d.log.Module(moduleEtcd).With(logger.Fields{"deployID": r.DeployID, "environment": r.Environment})
+	env := d.opt.environment(r.Environment)
+	endpoints := strings.Join(env.EtcdEndpoints, ",")
+	conn, err := d.etcd(r.Environment)
 	if err != nil {
-		msg := "Unable to connect to etcd2 server."
-		return msg, err
+		msg := "Unable to connect to etcd server."
+		return log, msg, nil, err
 	}
 
-	// Update the server.
-	err = conn.Set(etcd2Keys)
+	// Compare with the live keys under the prefix, and any declared outside of it.
+	live, err := conn.GetTree(prefix)
+	for _, k := range declared {
+		if err != nil {
+			break
+		}
+		if _, ok := live[k.Key]; !ok && !strings.HasPrefix(k.Key, prefix+"/") {
+			var t map[string]*etcd2.Key
+			if t, err = conn.GetTree(k.Key); err == nil && t[k.Key] != nil {
+				live[k.Key] = t[k.Key]
+			}
+		}
+	}
 	if err != nil {
-		msg := "Unable to perform updates to etcd2 server."
-		return msg, err
+		msg := "Unable to read the etcd keys."
+		elog.Errorf("%s %s", msg, err)
+		return log, msg, nil, err
+	}
+	diff := diffEtcdKeys(declared, live, prefix)
+	log += diff.report()
+	if env.EtcdDryRun {
+		log += fmt.Sprintln("Dry run: etcd keys were not changed.")
+		elog.Infof("Dry run of %d etcd key changes at %s.", len(diff.added)+len(diff.changed)+len(diff.removed),
+			endpoints)
+		return log, "", nil, nil
 	}
 
-	return "", nil
-}
+	// Expect each key as it was read, so a change made meanwhile fails the step instead of being lost.
+	var writes, deletes []*etcd2.Key
+	for _, k := range append(append([]*etcd2.Key{}, diff.added...), diff.changed...) {
+		w := *k
+		if l, ok := live[k.Key]; ok {
+			w.Index = l.Index
+		}
+		writes = append(writes, &w)
+	}
+	sort.Slice(writes, func(i, j int) bool { return writes[i].Key < writes[j].Key })
+	if env.EtcdPrune {
+		deletes = diff.removed
+	} else if len(diff.removed) > 0 {
+		log += fmt.Sprintln("Kept the etcd keys no longer declared: etcd_prune is off.")
+	}
+	if len(writes)+len(deletes) == 0 {
+		return log, "", nil, nil
+	}
 
-// readEtcdKeys reads the etcd2 key values from viper into an array of key/values.
-func (d *deployService) readEtcdKeys(v *viper.Viper, etcd2Keys map[string]string) {
-	if err := v.ReadInConfig(); err == nil {
-		var k []map[string]string
-		if err := v.Unmarshal(k); err == nil {
-			for _, rec := range k {
-				etcd2Keys[rec["key"]] = rec["value"]
-			}
+	// Save the keys as they are before changing them.
+	snapshot := etcd2.NewSnapshot(append(append([]*etcd2.Key{}, writes...), deletes...), live)
+	b, _ := json.Marshal(snapshot)
+	if !d.db.SetEtcdSnapshot(r.DeployID, string(b)) {
+		msg := "Unable to save the etcd keys before changing them."
+		return log, msg, nil, errors.New("database error")
+	}
+
+	// Update the server. Key names only: values can hold secrets.
+	for _, k := range writes {
+		elog.Debugf("Setting etcd key %s at %s.", k.Key, endpoints)
+	}
+	for _, k := range deletes {
+		elog.Debugf("Deleting etcd key %s at %s.", k.Key, endpoints)
+	}
+	snapshot.Written, err = conn.CompareAndSwap(writes, deletes)
+
+	// Save the keys as written, so they are only put back while no one else has changed them since.
+	b, _ = json.Marshal(snapshot)
+	if !d.db.SetEtcdSnapshot(r.DeployID, string(b)) {
+		elog.Errorf("Unable to save the etcd keys written by the deploy.")
+		log += fmt.Sprintln("Unable to save the etcd keys written by the deploy: they cannot be rolled back later.")
+	}
+	if err != nil {
+		msg := "Unable to perform updates to etcd server."
+		elog.Errorf("%s %s", msg, err)
+		if _, ok := err.(*etcd3.UncertainError); ok {
+			log += fmt.Sprintln("No answer to the etcd update: the keys may have been changed.")
+		}
+		if len(snapshot.Written) > 0 {
+			log += d.restoreEtcd(r, snapshot) // Only the keys written before the failure.
 		}
+		return log, msg, nil, err
+	}
+	elog.Infof("Updated %d and deleted %d etcd keys at %s.", len(writes), len(deletes), endpoints)
+	log += fmt.Sprintf("Updated %d and deleted %d etcd keys.\n", len(writes), len(deletes))
+
+	return log, "", snapshot, nil
+}
+
+// restoreEtcd puts back the etcd keys a deploy wrote as they were before it, except keys changed by
+// someone else since. Returns the result for the deploy log.
+func (d *deployService) restoreEtcd(r *DeployRequest, snapshot *etcd2.Snapshot) string {
+	elog := d.log.Module(moduleEtcd).With(logger.Fields{"deployID": r.DeployID, "environment": r.Environment})
+	conn, err := d.etcd(r.Environment)
+	var skipped []string
+	if err == nil {
+		skipped, err = conn.Restore(snapshot)
+	}
+	if err != nil {
+		msg := "Unable to restore the etcd keys. The previous values are saved with the deploy."
+		elog.Errorf("%s %s", msg, err)
+		return fmt.Sprintf("ERR: %s\n%s\n", msg, err)
+	}
+	restored, removed := snapshot.Restored(skipped)
+	msg := fmt.Sprintf("Restored %d etcd keys and removed %d added by the deploy.", restored, removed)
+	elog.Infof(msg)
+	if len(skipped) > 0 {
+		elog.Warningf("Skipped %d etcd keys changed since the deploy wrote them.", len(skipped))
 	}
-	return
+	return fmt.Sprintln(msg) + skippedEtcdKeys(skipped)
+}
+
+// registryEnv returns the environment of a script with the registry login of the deploy's
+// environment. The login is read from the config, not the request, so it is never queued.
+func (d *deployService) registryEnv(r *DeployRequest) []string {
+	env := os.Environ()
+	if e := d.opt.environment(r.Environment); e.RegistryUsername != "" {
+		env = append(env, "DOCKER_REGISTRY_USERNAME="+e.RegistryUsername, "DOCKER_REGISTRY_PASSWORD="+e.RegistryPassword)
+	}
+	return env
 }
 
 // createTempDirectory creates a unique temporary directory for the deploy process.
@@ -270,10 +585,14 @@ func (d *deployService) createTempDirectory(tempPath string, environment string,
 // executeCommand executes a shell command and log an error if fail.
 func (d *deployService) executeCommand(cmd *exec.Cmd, r *DeployRequest, msg string, log string) (string, error) {
 	if _, err := execCmd(cmd); err != nil {
+		if d.abort.Err() != nil {
+			return log, errDeployAborted // Requeued, not failed.
+		}
 		if err.Error() == "Desired container number already achieved\n" {
 			return log, nil
 		}
-		log += fmt.Sprintf("ERR: %s\n%s\n", msg, err)
+		// Script output can echo registry passwords or env values.
+		log += fmt.Sprintf("ERR: %s\n%s\n", msg, d.redact.text(err.Error()))
 		d.db.UpdateDeploy(r.DeployID, db.Failed, msg, log)
 		return log, err
 	}
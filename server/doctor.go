@@ -0,0 +1,240 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/composer22/docker-deploy-server/db"
+	"github.com/composer22/docker-deploy-server/logger"
+	"github.com/spf13/viper"
+	"golang.org/x/net/context"
+	"golang.org/x/sys/unix"
+)
+
+// Check validates the config and, for the doctor, the connections to every dependency of a deploy.
+// Each check is reported to w as PASS or FAIL. Returns false if any check failed.
+func Check(o *Options, v *viper.Viper, doctor bool, w io.Writer) bool {
+	ok := true
+	run := func(name string, check func(ctx context.Context) error) bool {
+		ctx, cancel := context.WithTimeout(context.Background(), checkTimeout)
+		defer cancel()
+		start := time.Now()
+		err := runReadyCheck(ctx, check)
+		elapsed := time.Since(start) / time.Millisecond * time.Millisecond
+		if err != nil {
+			ok = false
+			fmt.Fprintf(w, "FAIL  %s (%s): %s\n", name, elapsed, strings.Replace(err.Error(), "\n", "\n      ", -1))
+			return false
+		}
+		fmt.Fprintf(w, "PASS  %s (%s)\n", name, elapsed)
+		return true
+	}
+
+	// The config.
+	if !run("config file", func(ctx context.Context) error { return v.ReadInConfig() }) ||
+		!run("config", func(ctx context.Context) error { return o.FillConfig(v) }) {
+		return false
+	}
+	for _, c := range configChecks(o) {
+		run(c.name, c.check)
+	}
+	if !doctor {
+		return ok
+	}
+
+	// The connections. The check hands over the DB connection, or closes it if the check timed out.
+	var conn *db.DBConnect
+	conns := make(chan *db.DBConnect, 1)
+	if run("db", func(ctx context.Context) error {
+		c, err := db.NewDBConnect(o.DSN)
+		conns <- c
+		return err
+	}) {
+		conn = <-conns
+		defer conn.Close()
+	} else {
+		go func() {
+			if c := <-conns; c != nil {
+				c.Close()
+			}
+		}()
+	}
+	run("redis", func(ctx context.Context) error {
+		r, err := NewRedisClient(o.RedisHostname, o.RedisPort, o.RedisPassword, o.RedisDatabase)
+		if err == nil {
+			r.Close()
+		}
+		return err
+	})
+	if conn != nil {
+		var merged *Options
+		if run("environments in db", func(ctx context.Context) error {
+			defs, err := conn.EnvironmentSettings()
+			if err != nil {
+				return err
+			}
+			n, problems := withEnvironments(o, defs)
+			if len(problems) > 0 {
+				return errors.New(strings.Join(problems, "\n"))
+			}
+			merged = n
+			return nil
+		}) {
+			o = merged
+		}
+	}
+	run("git", func(ctx context.Context) error { return checkGitRemote(ctx, o.GitRoot, o.GitRepo) })
+	names := make([]string, 0, len(o.Environments))
+	for name := range o.Environments {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		e := o.Environments[name]
+		run(fmt.Sprintf("environments.%s machine", name), func(ctx context.Context) error {
+			return checkMachine(ctx, e.Machine)
+		})
+		run(fmt.Sprintf("environments.%s registry", name), func(ctx context.Context) error {
+			return checkRegistry(ctx, e.DockerRegistry)
+		})
+		for _, endpoint := range e.EtcdEndpoints {
+			endpoint := endpoint
+			run(fmt.Sprintf("environments.%s etcd %s", name, endpoint), func(ctx context.Context) error {
+				tlsConfig, err := etcdTLSConfig(e)
+				if err != nil {
+					return err
+				}
+				return checkHTTP(ctx, strings.TrimRight(endpoint, "/")+"/version", tlsConfig)
+			})
+		}
+	}
+	return ok
+}
+
+// configChecks returns the checks of the settings only validated when the server starts.
+func configChecks(o *Options) []readyCheck {
+	checks := []readyCheck{
+		{name: "freeze windows", check: func(ctx context.Context) error {
+			_, err := parseFreezeWindows(o.FreezeWindows)
+			return err
+		}},
+		{name: "log levels", check: func(ctx context.Context) error {
+			_, _, err := parseLogLevels(o)
+			return err
+		}},
+		{name: "redaction", check: func(ctx context.Context) error {
+			_, err := newRedactor(o)
+			return err
+		}},
+		{name: "tracing", check: func(ctx context.Context) error {
+			t, err := newTracer(o)
+			if err == nil {
+				t.Shutdown(ctx)
+			}
+			return err
+		}},
+		{name: "tempPath", check: func(ctx context.Context) error {
+			return checkCreatable(o.TempPath)
+		}},
+	}
+	if o.TLSCertFile != "" {
+		checks = append(checks, readyCheck{name: "tls", check: func(ctx context.Context) error {
+			_, err := newTLSConfig(o, logger.New(logger.UseDefault, false))
+			return err
+		}})
+	}
+	if o.SyslogNetwork != "" {
+		checks = append(checks, readyCheck{name: "syslog", check: func(ctx context.Context) error {
+			w, err := newSyslogWriter(o)
+			if err == nil {
+				w.Close()
+			}
+			return err
+		}})
+	}
+	return checks
+}
+
+// checkCreatable validates that a directory is writable, or could be created, without changing
+// anything.
+func checkCreatable(dir string) error {
+	for p := filepath.Clean(dir); ; p = filepath.Dir(p) {
+		info, err := os.Stat(p)
+		switch {
+		case err == nil && !info.IsDir():
+			return fmt.Errorf("%s is not a directory", p)
+		case err == nil:
+			if err := unix.Access(p, unix.W_OK); err != nil {
+				return fmt.Errorf("%s is not writable: %s", p, err)
+			}
+			return nil
+		case !os.IsNotExist(err) || filepath.Dir(p) == p:
+			return err
+		}
+	}
+}
+
+// checkMachine validates that a docker-machine exists and is running.
+func checkMachine(ctx context.Context, machine string) error {
+	out, err := exec.CommandContext(ctx, "docker-machine", "status", machine).CombinedOutput()
+	status := strings.TrimSpace(string(out))
+	switch {
+	case err != nil && status != "":
+		return errors.New(status)
+	case err != nil:
+		return err
+	case status != "Running":
+		return fmt.Errorf("machine %s is %s", machine, status)
+	}
+	return nil
+}
+
+// checkRegistry validates that a docker registry answers the registry API. 401 is expected without a
+// login. HTTPS is tried first, then HTTP for insecure registries.
+func checkRegistry(ctx context.Context, registry string) error {
+	host := strings.SplitN(registry, "/", 2)[0]
+	err := checkHTTP(ctx, fmt.Sprintf("https://%s/v2/", host), nil)
+	if err != nil && checkHTTP(ctx, fmt.Sprintf("http://%s/v2/", host), nil) == nil {
+		return nil
+	}
+	return err
+}
+
+// checkHTTP validates that a URL answers with success, or 401 for an API that needs a login. A nil TLS
+// config uses the defaults.
+func checkHTTP(ctx context.Context, url string, tlsConfig *tls.Config) error {
+	req, err := http.NewRequest(httpGet, url, nil)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{
+		Timeout:   checkTimeout,
+		Transport: &http.Transport{TLSClientConfig: tlsConfig, Proxy: http.ProxyFromEnvironment},
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= http.StatusBadRequest && resp.StatusCode != http.StatusUnauthorized {
+		return fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+	return nil
+}
+
+// CheckAndExit runs the checks of a check-config or doctor command, then exits non-zero if any failed.
+func CheckAndExit(o *Options, v *viper.Viper, doctor bool) {
+	if !Check(o, v, doctor, os.Stdout) {
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+// checkConfig runs check-config against a config file and returns the result and the report.
+func checkConfig(t *testing.T, config string) (bool, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "docker-deploy-server.yaml")
+	if err := ioutil.WriteFile(path, []byte(config), 0600); err != nil {
+		t.Fatalf("Unable to write the config: %s", err)
+	}
+	o := &Options{}
+	v := viper.New()
+	o.SetConfigDefaults(v)
+	v.SetConfigFile(path)
+	var out bytes.Buffer
+	ok := Check(o, v, false, &out)
+	return ok, out.String()
+}
+
+func TestCheckConfig(t *testing.T) {
+	t.Parallel()
+	temp := filepath.Join(t.TempDir(), "not", "yet")
+	ok, out := checkConfig(t, `
+temp_path: `+temp+`
+environments:
+  qa:
+    machine: qa-master
+    docker_registry: registry.example.com
+`)
+	if !ok || strings.Contains(out, "FAIL") || !strings.Contains(out, "PASS  tempPath") {
+		t.Errorf("Expected the config to pass, received:\n%s", out)
+	}
+	if _, err := os.Stat(filepath.Dir(temp)); !os.IsNotExist(err) {
+		t.Errorf("Expected check-config not to create the temp path, received: %v", err)
+	}
+
+	ok, out = checkConfig(t, `
+freeze_windows:
+  qa: ["not a window"]
+environments:
+  qa:
+    machine: qa-master
+    docker_registry: registry.example.com
+`)
+	if ok || !strings.Contains(out, "FAIL  freeze windows") {
+		t.Errorf("Expected the config to fail, received:\n%s", out)
+	}
+}
+
+func TestCheckCreatable(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	file := filepath.Join(dir, "file")
+	ioutil.WriteFile(file, nil, 0600)
+
+	if err := checkCreatable(dir); err != nil {
+		t.Errorf("Expected an existing directory to pass, received: %s", err)
+	}
+	if err := checkCreatable(filepath.Join(dir, "a", "b")); err != nil {
+		t.Errorf("Expected a directory that can be created to pass, received: %s", err)
+	}
+	if err := checkCreatable(filepath.Join(file, "a")); err == nil || !strings.Contains(err.Error(), "not a directory") {
+		t.Errorf("Expected a file in the path to fail, received: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "a")); !os.IsNotExist(err) {
+		t.Errorf("Expected nothing created, received: %v", err)
+	}
+}
+
+// TestCheckAndExit runs check-config in a child process to check its exit code.
+func TestCheckAndExit(t *testing.T) {
+	if config := os.Getenv("CHECK_AND_EXIT_CONFIG"); config != "" {
+		o := &Options{}
+		v := viper.New()
+		o.SetConfigDefaults(v)
+		v.SetConfigFile(config)
+		CheckAndExit(o, v, false)
+	}
+	t.Parallel()
+
+	dir := t.TempDir()
+	good := filepath.Join(dir, "good.yaml")
+	ioutil.WriteFile(good, []byte("temp_path: "+dir+"\n"), 0600)
+	for config, code := range map[string]int{good: 0, filepath.Join(dir, "missing.yaml"): 1} {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestCheckAndExit$")
+		cmd.Env = append(os.Environ(), "CHECK_AND_EXIT_CONFIG="+config)
+		out, err := cmd.CombinedOutput()
+		exit := 0
+		if e, ok := err.(*exec.ExitError); ok {
+			exit = e.ExitCode()
+		} else if err != nil {
+			t.Fatalf("Unable to run check-config: %s", err)
+		}
+		if exit != code {
+			t.Errorf("Expected exit code %d for %s, received %d:\n%s", code, config, exit, out)
+		}
+	}
+}
@@ -0,0 +1,226 @@
+package server
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Registry host[:port][/path] as used in image names (ex: registry.example.com:5000/team).
+var validRegistry = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9.-]*[A-Za-z0-9])?(:[0-9]+)?(/[a-z0-9._-]+)*$`)
+
+// Settings of an environment in the config.
+var environmentSettings = []string{
+	"machine", "docker_registry", "registry_username", "registry_password", "env_tag", "etcd_endpoint",
+	"etcd_endpoints", "etcd_timeout", "etcd_prefixes", "metadata_mount", "num_containers", "swarm", "requires_approval", "approvals_required", "approval_timeout",
+	"coalesce", "deploys_per_minute", "etcd_prune", "etcd_dry_run", "etcd_api", "etcd_ca_file", "etcd_cert_file",
+	"etcd_key_file", "etcd_username", "etcd_password",
+}
+
+// EnvironmentConfig is the configuration of an environment that images are deployed to.
+type EnvironmentConfig struct {
+	Machine           string        `json:"machine"`           // Master machine node for the cluster or local.
+	DockerRegistry    string        `json:"dockerRegistry"`    // Docker registry host[:port] the images are pulled from.
+	RegistryUsername  string        `json:"registryUsername"`  // Docker registry login. Empty pulls without logging in.
+	RegistryPassword  string        `json:"-"`                 // Docker registry password.
+	EnvTag            string        `json:"envTag"`            // Used to resolve machine names that are in the env.
+	EtcdEndpoints     []string      `json:"etcdEndpoints"`     // etcd URLs for the app keys, for failover. Empty skips etcd.
+	EtcdTimeout       time.Duration `json:"etcdTimeout"`       // Time allowed for a request to an etcd endpoint.
+	MetadataMount     string        `json:"metadataMount"`     // Remote directory on a machine to place the metadata.
+	NumContainers     int           `json:"numContainers"`     // Containers to run unless the image metadata sets a count.
+	Swarm             bool          `json:"swarm"`             // Is the machine a Docker Swarm master?
+	RequiresApproval  bool          `json:"requiresApproval"`  // Are deploys held until approved?
+	ApprovalsRequired int           `json:"approvalsRequired"` // Distinct tokens that must approve a deploy.
+	ApprovalTimeout   time.Duration `json:"approvalTimeout"`   // How long a deploy waits for approval.
+	Coalesce          bool          `json:"coalesce"`          // Replace queued deploys of the same image?
+	DeploysPerMinute  int           `json:"deploysPerMinute"`  // Deploy requests per minute (0 = unlimited).
+	EtcdPrune         bool          `json:"etcdPrune"`         // Delete etcd keys under the prefix no longer declared?
+	EtcdDryRun        bool          `json:"etcdDryRun"`        // Only report the etcd key changes?
+	EtcdPrefixes      []string      `json:"etcdPrefixes"`      // Prefixes outside /<image> a role may own.
+	EtcdAPI           string        `json:"etcdAPI"`           // etcd API of the cluster: v2 or v3.
+	EtcdCAFile        string        `json:"etcdCAFile"`        // CA of the etcd server certificate.
+	EtcdCertFile      string        `json:"etcdCertFile"`      // Client certificate for etcd.
+	EtcdKeyFile       string        `json:"etcdKeyFile"`       // Key of the client certificate.
+	EtcdUsername      string        `json:"etcdUsername"`      // etcd auth user. Empty if auth is off.
+	EtcdPassword      string        `json:"-"`                 // etcd auth password.
+}
+
+// newEnvironmentConfig is a factory function that returns an environment with the defaults set.
+func newEnvironmentConfig() *EnvironmentConfig {
+	return &EnvironmentConfig{
+		NumContainers:     DefaultNumCont,
+		ApprovalsRequired: DefaultApprovalsRequired,
+		ApprovalTimeout:   DefaultApprovalTimeout,
+		EtcdAPI:           etcdAPIv2,
+		EtcdTimeout:       DefaultEtcdTimeout,
+	}
+}
+
+// parseEnvironment returns the configuration of an environment from its config keys, along with
+// every problem found in them.
+func parseEnvironment(name string, keys map[string]string) (*EnvironmentConfig, []string) {
+	e := newEnvironmentConfig()
+	var problems []string
+	problem := func(key string, format string, a ...interface{}) {
+		problems = append(problems, fmt.Sprintf("environments.%s.%s: %s", name, key, fmt.Sprintf(format, a...)))
+	}
+	parseInt := func(key string, value string, min int) int {
+		i, err := strconv.Atoi(value)
+		if err != nil || i < min {
+			problem(key, "must be a whole number of at least %d.", min)
+		}
+		return i
+	}
+	parseBool := func(key string, value string) bool {
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			problem(key, "must be true or false.")
+		}
+		return b
+	}
+
+	endpointsKey := "etcd_endpoints" // The key the endpoints were set with, for problems.
+	names := make([]string, 0, len(keys))
+	for k := range keys {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		value := strings.TrimSpace(keys[k])
+		switch k {
+		case "machine":
+			e.Machine = value
+		case "docker_registry":
+			e.DockerRegistry = value
+		case "registry_username":
+			e.RegistryUsername = value
+		case "registry_password":
+			e.RegistryPassword = value
+		case "env_tag":
+			e.EnvTag = value
+		case "etcd_endpoint", "etcd_endpoints":
+			if len(e.EtcdEndpoints) > 0 {
+				problem(k, "cannot be set with etcd_endpoint.")
+			}
+			e.EtcdEndpoints, endpointsKey = splitList(value), k
+		case "etcd_prefixes":
+			e.EtcdPrefixes = splitList(value)
+			for _, p := range e.EtcdPrefixes {
+				if !strings.HasPrefix(p, "/") {
+					problem(k, "'%s' must be an absolute path (ex: /shared).", p)
+				}
+			}
+		case "etcd_timeout":
+			d, err := time.ParseDuration(value)
+			if err != nil || d <= 0 {
+				problem(k, "must be a positive duration (ex: 5s).")
+			}
+			e.EtcdTimeout = d
+		case "metadata_mount":
+			e.MetadataMount = value
+		case "num_containers":
+			e.NumContainers = parseInt(k, value, 1)
+		case "swarm":
+			e.Swarm = parseBool(k, value)
+		case "requires_approval":
+			e.RequiresApproval = parseBool(k, value)
+		case "approvals_required":
+			e.ApprovalsRequired = parseInt(k, value, 1)
+		case "approval_timeout":
+			d, err := time.ParseDuration(value)
+			if err != nil || d <= 0 {
+				problem(k, "must be a positive duration (ex: 4h).")
+			}
+			e.ApprovalTimeout = d
+		case "coalesce":
+			e.Coalesce = parseBool(k, value)
+		case "deploys_per_minute":
+			e.DeploysPerMinute = parseInt(k, value, 0)
+		case "etcd_prune":
+			e.EtcdPrune = parseBool(k, value)
+		case "etcd_dry_run":
+			e.EtcdDryRun = parseBool(k, value)
+		case "etcd_api":
+			e.EtcdAPI = strings.ToLower(value)
+		case "etcd_ca_file":
+			e.EtcdCAFile = value
+		case "etcd_cert_file":
+			e.EtcdCertFile = value
+		case "etcd_key_file":
+			e.EtcdKeyFile = value
+		case "etcd_username":
+			e.EtcdUsername = value
+		case "etcd_password":
+			e.EtcdPassword = value
+		default:
+			problem(k, "is not a known setting.")
+		}
+	}
+
+	if e.Machine == "" {
+		problem("machine", "is required.")
+	}
+	switch {
+	case e.DockerRegistry == "":
+		problem("docker_registry", "is required.")
+	case !validRegistry.MatchString(e.DockerRegistry):
+		problem("docker_registry", "'%s' must be a registry host[:port][/path] without a scheme.", e.DockerRegistry)
+	}
+	if e.RegistryPassword != "" && e.RegistryUsername == "" {
+		problem("registry_username", "is required with registry_password.")
+	}
+	for _, endpoint := range e.EtcdEndpoints {
+		if u, err := url.Parse(endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") ||
+			u.Host == "" {
+			problem(endpointsKey, "'%s' must be an http or https URL.", endpoint)
+		}
+	}
+	if e.EtcdAPI != etcdAPIv2 && e.EtcdAPI != etcdAPIv3 {
+		problem("etcd_api", "'%s' must be v2 or v3.", e.EtcdAPI)
+	}
+	if (e.EtcdCertFile == "") != (e.EtcdKeyFile == "") {
+		problem("etcd_cert_file", "and etcd_key_file must be set together.")
+	}
+	if e.EtcdPassword != "" && e.EtcdUsername == "" {
+		problem("etcd_username", "is required with etcd_password.")
+	}
+	return e, problems
+}
+
+// environment returns the configuration of an environment, or the defaults if it is not configured
+// (ex: a deploy pending approval for an environment since removed).
+func (o *Options) environment(name string) *EnvironmentConfig {
+	if e, ok := o.Environments[name]; ok {
+		return e
+	}
+	return newEnvironmentConfig()
+}
+
+// splitList returns the items of a comma separated setting, without spaces or empty items.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// settingString returns a setting of the config file or a JSON body as a string. A list (ex: etcd_endpoints)
+// is joined with commas.
+func settingString(v interface{}) string {
+	list, ok := v.([]interface{})
+	if !ok {
+		return fmt.Sprint(v)
+	}
+	items := make([]string, len(list))
+	for i, item := range list {
+		items[i] = fmt.Sprint(item)
+	}
+	return strings.Join(items, ",")
+}
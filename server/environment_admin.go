@@ -0,0 +1,261 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Environment names that can be managed through the API.
+var validEnvironmentName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_-]{0,63}$`)
+
+// environmentView is an environment as shown by the admin API.
+type environmentView struct {
+	*EnvironmentConfig
+	Source string `json:"source"` // Where the environment is defined: config or db.
+}
+
+// withEnvironments returns a copy of the options with the environments defined in the DB (JSON
+// settings by name) replacing those of the config file. Invalid definitions are skipped and returned
+// as problems so one bad row does not take down every environment.
+func withEnvironments(o *Options, defs map[string]string) (*Options, []string) {
+	n := *o
+	n.Environments = make(map[string]*EnvironmentConfig, len(o.Environments)+len(defs))
+	for name, e := range o.Environments {
+		n.Environments[name] = e
+	}
+	n.Sources = make(map[string]string, len(o.Sources))
+	for k, v := range o.Sources {
+		n.Sources[k] = v
+	}
+
+	var problems []string
+	names := make([]string, 0, len(defs))
+	for name := range defs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		settings, err := environmentSettingsJSON([]byte(defs[name]))
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("environments.%s: %s", name, err))
+			continue
+		}
+		c := &configSources{sources: make(map[string]string)}
+		keys, p := c.environmentKeys(name, settings, sourceDB)
+		e, q := parseEnvironment(name, keys)
+		if p = append(p, q...); len(p) > 0 {
+			problems = append(problems, p...)
+			continue
+		}
+		prefix := fmt.Sprintf("environments.%s.", name)
+		for k := range n.Sources {
+			if strings.HasPrefix(k, prefix) {
+				delete(n.Sources, k)
+			}
+		}
+		for k, v := range c.sources {
+			n.Sources[k] = v
+		}
+		n.Sources["environments."+name] = sourceDB
+		n.Environments[name] = e
+	}
+	return &n, problems
+}
+
+// environmentSettingsJSON returns the settings of an environment from a JSON object of setting
+// names to strings, numbers or booleans.
+func environmentSettingsJSON(b []byte) (map[string]string, error) {
+	var raw map[string]interface{}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return nil, err
+	}
+	settings := make(map[string]string, len(raw))
+	for k, v := range raw {
+		switch v.(type) {
+		case string, float64, bool, []interface{}:
+			settings[k] = settingString(v)
+		default:
+			return nil, fmt.Errorf("%s must be a string, number, boolean or list.", k)
+		}
+	}
+	return settings, nil
+}
+
+// secretEnvironmentSetting returns true if a setting must not be stored in the DB. Secrets are set
+// with environment variables or files instead.
+func secretEnvironmentSetting(k string) bool {
+	return k == "registry_password" || k == "etcd_password" || strings.HasSuffix(k, secretFileSuffix)
+}
+
+// dbEnvironments returns a copy of the config file options with the environments defined in the DB.
+func (s *Server) dbEnvironments(o *Options) (*Options, error) {
+	defs, err := s.db.EnvironmentSettings()
+	if err != nil {
+		return nil, err
+	}
+	n, problems := withEnvironments(o, defs)
+	for _, p := range problems {
+		s.log.Errorf("Skipping an environment in the DB: %s", p)
+	}
+	return n, nil
+}
+
+// watchEnvironments checks the environments in the DB at an interval and refreshes them when they
+// change, so a change made through another server sharing the DB is picked up here too.
+func (s *Server) watchEnvironments(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		var last map[string]string
+		for {
+			select {
+			case <-s.done:
+				return
+			case <-time.After(interval):
+			}
+			defs, err := s.db.EnvironmentSettings()
+			if err != nil {
+				s.log.Errorf("Unable to check the environments in the DB: %s", err)
+				continue
+			}
+			if last != nil && reflect.DeepEqual(defs, last) {
+				continue
+			}
+			last = defs
+			cur := s.options()
+			if err := s.refreshEnvironments(); err != nil {
+				s.log.Errorf("Unable to refresh the environments from the DB: %s", err)
+				last = nil
+				continue
+			}
+			if summary := configDiff(cur, s.options()); len(summary) > 0 {
+				s.log.Infof("Environments refreshed from the DB: %s", strings.Join(summary, "; "))
+			}
+		}
+	}()
+}
+
+// refreshEnvironments reads the environments from the DB again after a change through the API, or
+// through another server.
+func (s *Server) refreshEnvironments() error {
+	s.reload.Lock()
+	defer s.reload.Unlock()
+	s.mu.RLock()
+	file := s.fileOpt
+	s.mu.RUnlock()
+	o, err := s.dbEnvironments(file)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.opt = o
+	s.mu.Unlock()
+	s.redact.setSecrets(o)
+	return nil
+}
+
+// environmentsHandler handles a client request to list, show, save or delete environments. Saving
+// (PUT) replaces every setting of the environment; deleting falls back to the config file, if it
+// defines the environment.
+func (s *Server) environmentsHandler(w http.ResponseWriter, r *http.Request) {
+	if s.invalidHeader(w, r) || s.invalidMethod(w, r, httpGet, httpPut, httpDelete) || s.invalidAuth(w, r) ||
+		s.authRight(w, r, rightAdmin) {
+		return
+	}
+
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, httpRouteV1Environments), "/")
+	if r.Method == httpGet && name == "" {
+		opt := s.options()
+		result := make(map[string]*environmentView, len(opt.Environments))
+		for name, e := range opt.Environments {
+			result[name] = &environmentView{e, opt.Sources["environments."+name]}
+		}
+		b, _ := json.Marshal(&struct {
+			Environments map[string]*environmentView `json:"environments"`
+		}{result})
+		w.Write(b)
+		return
+	}
+	if !validEnvironmentName.MatchString(name) {
+		http.Error(w, InvalidEnvName, http.StatusBadRequest)
+		return
+	}
+
+	status, action := http.StatusOK, ""
+	switch r.Method {
+	case httpPut:
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, InvalidBody, http.StatusBadRequest)
+			return
+		}
+		settings, err := environmentSettingsJSON(b)
+		if err != nil {
+			http.Error(w, InvalidJSONText, http.StatusBadRequest)
+			return
+		}
+		for k := range settings {
+			if secretEnvironmentSetting(k) {
+				http.Error(w, InvalidEnvSecret, http.StatusBadRequest)
+				return
+			}
+		}
+		keys, p := (&configSources{sources: make(map[string]string)}).environmentKeys(name, settings, sourceDB)
+		if _, q := parseEnvironment(name, keys); len(p)+len(q) > 0 {
+			http.Error(w, InvalidEnvSettings+strings.Join(append(p, q...), " "), http.StatusBadRequest)
+			return
+		}
+		b, _ = json.Marshal(settings)
+		created, err := s.db.SetEnvironmentSettings(name, string(b))
+		if err != nil {
+			http.Error(w, InvalidEnvCannotSave, http.StatusInternalServerError)
+			return
+		}
+		if action = "saved"; created {
+			status = http.StatusCreated
+		}
+		s.db.Audit(auditEnvironmentPut, s.db.AuthTokenName(s.authToken(r)), fmt.Sprintf("%s: %s", name, b))
+	case httpDelete:
+		deleted, err := s.db.DeleteEnvironmentSettings(name)
+		if err != nil {
+			http.Error(w, InvalidEnvCannotSave, http.StatusInternalServerError)
+			return
+		}
+		if !deleted {
+			http.Error(w, InvalidEnvNotFound, http.StatusNotFound)
+			return
+		}
+		action = "deleted"
+		s.db.Audit(auditEnvironmentDelete, s.db.AuthTokenName(s.authToken(r)), name)
+	}
+	if action != "" {
+		if err := s.refreshEnvironments(); err != nil {
+			s.log.Errorf("Unable to read the environments after a change to %s: %s", name, err)
+			http.Error(w, InvalidEnvCannotSave, http.StatusInternalServerError)
+			return
+		}
+		s.log.Noticef("Environment %s %s by %s.", name, action, s.db.AuthTokenName(s.authToken(r)))
+	}
+
+	opt := s.options()
+	e, ok := opt.Environments[name]
+	if !ok {
+		if r.Method == httpDelete {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		http.Error(w, InvalidEnvNotFound, http.StatusNotFound)
+		return
+	}
+	b, _ := json.Marshal(&environmentView{e, opt.Sources["environments."+name]})
+	w.WriteHeader(status)
+	w.Write(b)
+}
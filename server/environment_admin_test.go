@@ -0,0 +1,214 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/composer22/docker-deploy-server/db"
+	"github.com/composer22/docker-deploy-server/logger"
+)
+
+// testEnvironmentServer returns a server with a mocked database and a "prod" environment defined in
+// the config file.
+func testEnvironmentServer(t *testing.T) (*Server, sqlmock.Sqlmock) {
+	t.Helper()
+	conn, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Unable to create the database mock: %s", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	o := &Options{
+		Environments: map[string]*EnvironmentConfig{
+			"prod": {Machine: "prod-master", DockerRegistry: "registry.example.com", EtcdAPI: etcdAPIv2},
+		},
+		Sources: map[string]string{"environments.prod": sourceConfig},
+	}
+	rd, _ := newRedactor(o)
+	return &Server{opt: o, fileOpt: o, db: db.NewDBConnectFromDB(conn), redact: rd,
+		log: logger.New(logger.Error, false)}, mock
+}
+
+// expectAdmin expects the token "admin" to be checked for the admin right.
+func expectAdmin(mock sqlmock.Sqlmock) {
+	mock.ExpectQuery("SELECT id FROM auth_tokens WHERE token").WithArgs("admin").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectQuery("FROM auth_tokens_rights").WithArgs("admin", rightAdmin).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+}
+
+// expectRefresh expects the environments to be read from the DB again after a change, with the
+// settings of qa if given, and the change to be logged with the name of the token.
+func expectRefresh(mock sqlmock.Sqlmock, qa string) {
+	rows := sqlmock.NewRows([]string{"name", "settings"})
+	if qa != "" {
+		rows.AddRow("qa", qa)
+	}
+	mock.ExpectQuery("SELECT name, settings FROM environments").WillReturnRows(rows)
+	mock.ExpectQuery("SELECT name FROM auth_tokens").WithArgs("admin").
+		WillReturnRows(sqlmock.NewRows([]string{"name"}).AddRow("Admin"))
+}
+
+// environmentRequest returns an admin API request for an environment.
+func environmentRequest(method string, name string, body string) *http.Request {
+	r := httptest.NewRequest(method, httpRouteV1Environments+"/"+name, bytes.NewBufferString(body))
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("Accept", "application/json")
+	r.Header.Set("Authorization", "Bearer admin")
+	return r
+}
+
+// environmentSource returns the source of the environment in a response.
+func environmentSource(t *testing.T, w *httptest.ResponseRecorder) string {
+	t.Helper()
+	var view struct {
+		Source string `json:"source"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &view); err != nil {
+		t.Fatalf("Unable to read the environment: %s", err)
+	}
+	return view.Source
+}
+
+func TestEnvironmentsHandlerInvalid(t *testing.T) {
+	t.Parallel()
+	s, mock := testEnvironmentServer(t)
+
+	tests := []struct {
+		method string
+		name   string
+		body   string
+		status int
+		text   string
+	}{
+		{httpPut, "qa", `{"machine":"qa","docker_registry":"registry.example.com","registry_password":"x"}`,
+			http.StatusBadRequest, InvalidEnvSecret},
+		{httpPut, "qa", `{"machine":"qa","docker_registry":"registry.example.com","etcd_password_file":"/x"}`,
+			http.StatusBadRequest, InvalidEnvSecret},
+		{httpPut, "qa", `{"machine":"qa","docker_registry":"registry.example.com","num_containers":0}`,
+			http.StatusBadRequest, "environments.qa.num_containers"},
+		{httpPut, "qa", `{"docker_registry":"registry.example.com","colour":"blue"}`,
+			http.StatusBadRequest, "environments.qa.colour"},
+		{httpPut, "qa", `{"machine":`, http.StatusBadRequest, InvalidJSONText},
+		{httpPut, "bad.name", `{}`, http.StatusBadRequest, InvalidEnvName},
+		{httpGet, "unknown", "", http.StatusNotFound, InvalidEnvNotFound},
+	}
+	for _, tc := range tests {
+		expectAdmin(mock)
+		w := httptest.NewRecorder()
+		s.environmentsHandler(w, environmentRequest(tc.method, tc.name, tc.body))
+		if w.Code != tc.status || !strings.Contains(w.Body.String(), tc.text) {
+			t.Errorf("%s %s %s: expected %d %q, got %d: %s", tc.method, tc.name, tc.body, tc.status, tc.text,
+				w.Code, w.Body)
+		}
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unexpected database calls: %s", err)
+	}
+}
+
+func TestEnvironmentsHandlerSave(t *testing.T) {
+	t.Parallel()
+	s, mock := testEnvironmentServer(t)
+	qa := `{"docker_registry":"registry.example.com","machine":"qa"}`
+
+	// The first save creates the environment.
+	expectAdmin(mock)
+	mock.ExpectQuery("SELECT settings FROM environments").WithArgs("qa").
+		WillReturnRows(sqlmock.NewRows([]string{"settings"}))
+	mock.ExpectExec("INSERT INTO environments").WithArgs("qa", qa).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectQuery("SELECT name FROM auth_tokens").WithArgs("admin").
+		WillReturnRows(sqlmock.NewRows([]string{"name"}).AddRow("Admin"))
+	mock.ExpectExec("INSERT INTO audit_log").WithArgs(auditEnvironmentPut, "Admin", "qa: "+qa).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	expectRefresh(mock, qa)
+
+	w := httptest.NewRecorder()
+	s.environmentsHandler(w, environmentRequest(httpPut, "qa",
+		`{"machine":"qa","docker_registry":"registry.example.com"}`))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected %d, got %d: %s", http.StatusCreated, w.Code, w.Body)
+	}
+	if source := environmentSource(t, w); source != sourceDB {
+		t.Errorf("Expected the environment from the DB, got %q", source)
+	}
+	if e := s.options().Environments["qa"]; e == nil || e.Machine != "qa" {
+		t.Errorf("Expected qa to be added, got %+v", e)
+	}
+
+	// Saving it again replaces its settings.
+	qa = `{"docker_registry":"registry.example.com","machine":"qa-master"}`
+	expectAdmin(mock)
+	mock.ExpectQuery("SELECT settings FROM environments").WithArgs("qa").
+		WillReturnRows(sqlmock.NewRows([]string{"settings"}).AddRow(`{"machine":"qa"}`))
+	mock.ExpectExec("INSERT INTO environments").WithArgs("qa", qa).WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectQuery("SELECT name FROM auth_tokens").WithArgs("admin").
+		WillReturnRows(sqlmock.NewRows([]string{"name"}).AddRow("Admin"))
+	mock.ExpectExec("INSERT INTO audit_log").WillReturnResult(sqlmock.NewResult(1, 1))
+	expectRefresh(mock, qa)
+
+	w = httptest.NewRecorder()
+	s.environmentsHandler(w, environmentRequest(httpPut, "qa",
+		`{"machine":"qa-master","docker_registry":"registry.example.com"}`))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected %d, got %d: %s", http.StatusOK, w.Code, w.Body)
+	}
+	if e := s.options().Environments["qa"]; e == nil || e.Machine != "qa-master" {
+		t.Errorf("Expected qa to be updated, got %+v", e)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unexpected database calls: %s", err)
+	}
+}
+
+func TestEnvironmentsHandlerDelete(t *testing.T) {
+	t.Parallel()
+	s, mock := testEnvironmentServer(t)
+	expectDelete := func(name string, deleted int64) {
+		expectAdmin(mock)
+		mock.ExpectExec("UPDATE environments SET settings = NULL").WithArgs(name).
+			WillReturnResult(sqlmock.NewResult(0, deleted))
+		if deleted > 0 {
+			mock.ExpectQuery("SELECT name FROM auth_tokens").WithArgs("admin").
+				WillReturnRows(sqlmock.NewRows([]string{"name"}).AddRow("Admin"))
+			mock.ExpectExec("INSERT INTO audit_log").WithArgs(auditEnvironmentDelete, "Admin", name).
+				WillReturnResult(sqlmock.NewResult(1, 1))
+			expectRefresh(mock, "")
+		}
+	}
+
+	// prod falls back to the definition in the config file.
+	expectDelete("prod", 1)
+	w := httptest.NewRecorder()
+	s.environmentsHandler(w, environmentRequest(httpDelete, "prod", ""))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected %d, got %d: %s", http.StatusOK, w.Code, w.Body)
+	}
+	if source := environmentSource(t, w); source != sourceConfig {
+		t.Errorf("Expected the environment from the config file, got %q", source)
+	}
+
+	// qa was only defined in the DB, so it is gone.
+	expectDelete("qa", 1)
+	w = httptest.NewRecorder()
+	s.environmentsHandler(w, environmentRequest(httpDelete, "qa", ""))
+	if w.Code != http.StatusNoContent {
+		t.Errorf("Expected %d, got %d: %s", http.StatusNoContent, w.Code, w.Body)
+	}
+
+	// An environment without settings in the DB cannot be deleted.
+	expectDelete("unknown", 0)
+	w = httptest.NewRecorder()
+	s.environmentsHandler(w, environmentRequest(httpDelete, "unknown", ""))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected %d, got %d: %s", http.StatusNotFound, w.Code, w.Body)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unexpected database calls: %s", err)
+	}
+}
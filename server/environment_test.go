@@ -0,0 +1,202 @@
+package server
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func TestParseEnvironment(t *testing.T) {
+	t.Parallel()
+	e, problems := parseEnvironment("prod", map[string]string{
+		"machine":            "prod-master",
+		"docker_registry":    "registry.example.com:5000/team",
+		"etcd_endpoint":      "http://10.0.0.5:2379",
+		"num_containers":     "4",
+		"swarm":              "true",
+		"requires_approval":  "true",
+		"approval_timeout":   "4h",
+		"deploys_per_minute": "2",
+	})
+	if len(problems) > 0 {
+		t.Fatalf("Valid environment should have no problems: %v", problems)
+	}
+	if e.NumContainers != 4 || !e.Swarm || !e.RequiresApproval || e.ApprovalTimeout != 4*time.Hour ||
+		e.ApprovalsRequired != DefaultApprovalsRequired || e.DeploysPerMinute != 2 {
+		t.Errorf("Unexpected environment: %+v", e)
+	}
+
+	e, _ = parseEnvironment("dev", map[string]string{"machine": "dev", "docker_registry": "registry"})
+	if e.NumContainers != DefaultNumCont || e.ApprovalTimeout != DefaultApprovalTimeout {
+		t.Errorf("Expected defaults, received: %+v", e)
+	}
+}
+
+func TestParseEnvironmentProblems(t *testing.T) {
+	t.Parallel()
+	_, problems := parseEnvironment("qa", map[string]string{
+		"docker_registry":    "https://registry.example.com",
+		"etcd_endpoint":      "10.0.0.5:2379",
+		"num_containers":     "0",
+		"swarm":              "maybe",
+		"approval_timeout":   "soon",
+		"deploys_per_minute": "-1",
+		"num_contianers":     "2",
+	})
+	expected := []string{
+		"environments.qa.approval_timeout:",
+		"environments.qa.deploys_per_minute:",
+		"environments.qa.num_containers:",
+		"environments.qa.num_contianers: is not a known setting.",
+		"environments.qa.swarm:",
+		"environments.qa.machine: is required.",
+		"environments.qa.docker_registry:",
+		"environments.qa.etcd_endpoint:",
+	}
+	if len(problems) != len(expected) {
+		t.Fatalf("Expected %d problems, received: %v", len(expected), problems)
+	}
+	for i, p := range problems {
+		if !strings.HasPrefix(p, expected[i]) {
+			t.Errorf("Expected problem '%s', received '%s'.", expected[i], p)
+		}
+	}
+}
+
+func TestFillConfigListsEveryProblem(t *testing.T) {
+	t.Parallel()
+	v := viper.New()
+	v.SetConfigType("yaml")
+	if err := v.ReadConfig(bytes.NewBufferString(`
+environments:
+  dev:
+    machine: dev-master
+    docker_registry: registry.example.com
+    num_containers: 2
+    swarm: false
+  prod:
+    docker_registry: registry.example.com
+    num_containers: -2
+`)); err != nil {
+		t.Fatalf("Unexpected error reading config: %s", err)
+	}
+	o := &Options{}
+	err := o.FillConfig(v)
+	if err == nil {
+		t.Fatalf("Invalid config should fail.")
+	}
+	for _, p := range []string{"environments.prod.num_containers", "environments.prod.machine"} {
+		if !strings.Contains(err.Error(), p) {
+			t.Errorf("Expected '%s' in the error: %s", p, err)
+		}
+	}
+	if strings.Contains(err.Error(), "environments.dev") {
+		t.Errorf("Valid environment should not be listed: %s", err)
+	}
+	if o.Environments["dev"].NumContainers != 2 {
+		t.Errorf("Expected 2 containers in dev, received %d.", o.Environments["dev"].NumContainers)
+	}
+}
+
+// A flow list of URLs, which the yaml.v2 of before v2.4.0 rejected.
+func TestFillConfigFlowList(t *testing.T) {
+	t.Parallel()
+	v := viper.New()
+	v.SetConfigType("yaml")
+	if err := v.ReadConfig(bytes.NewBufferString(`
+environments:
+  prod:
+    machine: prod-master
+    docker_registry: registry.example.com
+    etcd_endpoints: [https://10.0.0.5:2379, "https://10.0.0.6:2379"]
+    etcd_timeout: 2s
+`)); err != nil {
+		t.Fatalf("Unexpected error reading config: %s", err)
+	}
+	o := &Options{}
+	if err := o.FillConfig(v); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if e := o.Environments["prod"]; len(e.EtcdEndpoints) != 2 || e.EtcdEndpoints[0] != "https://10.0.0.5:2379" ||
+		e.EtcdTimeout != 2*time.Second {
+		t.Errorf("Expected two endpoints and a timeout, received %v %s", e.EtcdEndpoints, e.EtcdTimeout)
+	}
+}
+
+func TestWithEnvironments(t *testing.T) {
+	t.Parallel()
+	prod, _ := parseEnvironment("prod", map[string]string{"machine": "prod-master", "docker_registry": "registry"})
+	o := &Options{
+		Environments: map[string]*EnvironmentConfig{"prod": prod},
+		Sources:      map[string]string{"environments.prod": sourceConfig, "environments.prod.machine": sourceConfig},
+	}
+	n, problems := withEnvironments(o, map[string]string{
+		"prod":    `{"machine":"prod-db","docker_registry":"registry","num_containers":4}`,
+		"staging": `{"machine":"staging-master","docker_registry":"registry","swarm":true}`,
+		"broken":  `{"docker_registry":"registry"}`,
+	})
+	if len(problems) != 1 || !strings.HasPrefix(problems[0], "environments.broken.machine:") {
+		t.Errorf("Expected the broken environment to be reported, received: %v", problems)
+	}
+	if _, ok := n.Environments["broken"]; ok {
+		t.Errorf("Invalid environment should be skipped.")
+	}
+	if e := n.Environments["prod"]; e.Machine != "prod-db" || e.NumContainers != 4 {
+		t.Errorf("Expected the DB to replace prod, received: %+v", e)
+	}
+	if e := n.Environments["staging"]; e == nil || !e.Swarm {
+		t.Errorf("Expected staging from the DB, received: %+v", e)
+	}
+	if n.Sources["environments.prod"] != sourceDB || n.Sources["environments.prod.machine"] != sourceDB {
+		t.Errorf("Expected prod sources from the DB, received: %v", n.Sources)
+	}
+	if o.Environments["prod"].Machine != "prod-master" || o.Sources["environments.prod"] != sourceConfig {
+		t.Errorf("Config file options should not change.")
+	}
+}
+
+func TestParseEnvironmentEtcd(t *testing.T) {
+	t.Parallel()
+	e, problems := parseEnvironment("prod", map[string]string{
+		"machine": "prod", "docker_registry": "registry", "etcd_api": "V3", "etcd_username": "deployer",
+		"etcd_password": "secret",
+	})
+	if len(problems) > 0 || e.EtcdAPI != etcdAPIv3 {
+		t.Errorf("Expected the v3 API, received %s: %v", e.EtcdAPI, problems)
+	}
+	_, problems = parseEnvironment("prod", map[string]string{
+		"machine": "prod", "docker_registry": "registry", "etcd_api": "v4", "etcd_cert_file": "/etc/etcd/client.pem",
+		"etcd_password": "secret",
+	})
+	if len(problems) != 3 {
+		t.Errorf("Expected the API, client key and user to be reported, received: %v", problems)
+	}
+}
+
+func TestParseEnvironmentEtcdEndpoints(t *testing.T) {
+	t.Parallel()
+	e, problems := parseEnvironment("prod", map[string]string{
+		"machine": "prod", "docker_registry": "registry", "etcd_timeout": "2s",
+		"etcd_endpoints": settingString([]interface{}{"https://10.0.0.5:2379", "https://10.0.0.6:2379"}),
+	})
+	if len(problems) > 0 || len(e.EtcdEndpoints) != 2 || e.EtcdEndpoints[1] != "https://10.0.0.6:2379" ||
+		e.EtcdTimeout != 2*time.Second {
+		t.Errorf("Expected two endpoints and a timeout, received %v %s: %v", e.EtcdEndpoints, e.EtcdTimeout, problems)
+	}
+	e, _ = parseEnvironment("dev", map[string]string{
+		"machine": "dev", "docker_registry": "registry", "etcd_endpoint": "http://10.0.0.5:2379",
+	})
+	if len(e.EtcdEndpoints) != 1 || e.EtcdTimeout != DefaultEtcdTimeout {
+		t.Errorf("Expected the single endpoint and the default timeout, received %v %s", e.EtcdEndpoints, e.EtcdTimeout)
+	}
+	_, problems = parseEnvironment("qa", map[string]string{
+		"machine": "qa", "docker_registry": "registry", "etcd_endpoint": "http://10.0.0.5:2379",
+		"etcd_endpoints": "http://10.0.0.6:2379, ftp://10.0.0.7", "etcd_timeout": "0s",
+	})
+	if len(problems) != 3 {
+		t.Errorf("Expected both keys, the bad URL and the timeout to be reported, received: %v", problems)
+	}
+}
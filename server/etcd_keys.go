@@ -0,0 +1,339 @@
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/composer22/docker-deploy-server/etcd2"
+	"gopkg.in/yaml.v2"
+)
+
+// Extensions of an etcd2 key file in the metadata (ex: roles/common/meta/prod.etcd2.yml).
+var etcdKeyFileExts = []string{"yml", "yaml", "json"}
+
+// findEtcdKeyFile returns the etcd2 key file of an environment in a metadata directory, or an empty
+// string if there is none.
+func findEtcdKeyFile(dir string, env string) string {
+	for _, ext := range etcdKeyFileExts {
+		f := filepath.Join(dir, fmt.Sprintf("%s.etcd2.%s", env, ext))
+		if _, err := os.Stat(f); err == nil {
+			return f
+		}
+	}
+	return ""
+}
+
+// readEtcdKeyFile returns the keys and prefix of an etcd2 key file, along with every problem found in it.
+func readEtcdKeyFile(file string) (map[string]*etcd2.Key, string, []string) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, "", []string{err.Error()}
+	}
+	keys, prefix, problems := parseEtcdKeys(b)
+	for i, p := range problems {
+		problems[i] = fmt.Sprintf("%s: %s", filepath.Base(file), p)
+	}
+	return keys, prefix, problems
+}
+
+// parseEtcdKeys returns the keys of an etcd2 key file by path and the prefix owned by the image, along
+// with every problem found. The file has a list of keys and/or a tree of values whose nested maps are
+// flattened to paths:
+//
+//	prefix: /myapp     # optional: keys under it not declared are removed (default: /<image>)
+//	keys:
+//	  - key: /myapp/db/host
+//	    value: db.internal
+//	    ttl: 1h          # optional: duration or seconds
+//	  - key: /myapp/locks
+//	    dir: true
+//	values:
+//	  myapp:
+//	    db:
+//	      port: 5432     # /myapp/db/port
+func parseEtcdKeys(b []byte) (map[string]*etcd2.Key, string, []string) {
+	var problems []string
+	problem := func(format string, a ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, a...))
+	}
+	keys := make(map[string]*etcd2.Key)
+	add := func(k *etcd2.Key) {
+		if _, ok := keys[k.Key]; ok {
+			problem("%s: is declared more than once.", k.Key)
+			return
+		}
+		keys[k.Key] = k
+	}
+
+	var doc map[interface{}]interface{}
+	if err := yaml.Unmarshal(b, &doc); err != nil {
+		return nil, "", []string{err.Error()}
+	}
+	var prefix string
+	for _, name := range yamlKeys(doc) {
+		section := doc[name]
+		switch name {
+		case "prefix":
+			s, ok := section.(string)
+			if !ok || !validEtcdPath(s) {
+				problem("prefix: '%v' must be an absolute path (ex: /myapp).", section)
+				continue
+			}
+			prefix = path.Clean(s)
+		case "keys":
+			list, ok := section.([]interface{})
+			if !ok && section != nil {
+				problem("keys: must be a list.")
+				continue
+			}
+			for i, item := range list {
+				k, p := parseEtcdKey(item)
+				for _, msg := range p {
+					problem("keys[%d]: %s", i, msg)
+				}
+				if len(p) == 0 {
+					add(k)
+				}
+			}
+		case "values":
+			tree, ok := section.(map[interface{}]interface{})
+			if !ok && section != nil {
+				problem("values: must be a map.")
+				continue
+			}
+			flattenEtcdValues("", tree, add, problem)
+		default:
+			problem("%v: is not a known section. Use prefix, keys or values.", name)
+		}
+	}
+	return keys, prefix, problems
+}
+
+// parseEtcdKey returns a key from an entry of the keys list, along with every problem found.
+func parseEtcdKey(item interface{}) (*etcd2.Key, []string) {
+	var problems []string
+	fields, ok := item.(map[interface{}]interface{})
+	if !ok {
+		return nil, []string{"must be a map with key and value."}
+	}
+	k := &etcd2.Key{}
+	var hasValue bool
+	for _, name := range yamlKeys(fields) {
+		v := fields[name]
+		switch name {
+		case "key":
+			s, ok := v.(string)
+			if !ok || !validEtcdPath(s) {
+				problems = append(problems, fmt.Sprintf("key '%v' must be an absolute path (ex: /myapp/db/host).", v))
+				continue
+			}
+			k.Key = path.Clean(s)
+		case "value":
+			s, ok := etcdScalar(v)
+			if !ok {
+				problems = append(problems, "value must be a string, number or boolean.")
+			}
+			k.Value, hasValue = s, true
+		case "ttl":
+			d, ok := etcdTTL(v)
+			if !ok {
+				problems = append(problems, fmt.Sprintf("ttl '%v' must be a duration (ex: 1h) or seconds of at least 1s.", v))
+			}
+			k.TTL = d
+		case "dir":
+			b, ok := v.(bool)
+			if !ok {
+				problems = append(problems, "dir must be true or false.")
+			}
+			k.Dir = b
+		default:
+			problems = append(problems, fmt.Sprintf("%v is not a known field. Use key, value, ttl or dir.", name))
+		}
+	}
+	switch {
+	case k.Key == "" && len(problems) == 0:
+		problems = append(problems, "key is required.")
+	case k.Dir && hasValue:
+		problems = append(problems, "a dir cannot have a value.")
+	case !k.Dir && !hasValue:
+		problems = append(problems, "value is required unless dir is true.")
+	}
+	return k, problems
+}
+
+// flattenEtcdValues adds a key for each value in a tree, with the path of its parent maps.
+func flattenEtcdValues(prefix string, tree map[interface{}]interface{}, add func(*etcd2.Key),
+	problem func(string, ...interface{})) {
+	names := make([]string, 0, len(tree))
+	values := make(map[string]interface{}, len(tree))
+	for k, v := range tree {
+		names = append(names, fmt.Sprint(k))
+		values[fmt.Sprint(k)] = v
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		p := prefix + "/" + name
+		if name == "" || strings.Contains(name, "/") {
+			problem("values%s: '%s' must be a name without a /.", prefix, name)
+			continue
+		}
+		switch v := values[name].(type) {
+		case map[interface{}]interface{}:
+			flattenEtcdValues(p, v, add, problem)
+		default:
+			s, ok := etcdScalar(v)
+			if !ok {
+				problem("values%s: must be a string, number, boolean or map.", p)
+				continue
+			}
+			add(&etcd2.Key{Key: p, Value: s})
+		}
+	}
+}
+
+// mergeEtcdKeys returns the common keys overridden by the role keys, in path order so that
+// directories are set before the keys in them.
+func mergeEtcdKeys(common map[string]*etcd2.Key, role map[string]*etcd2.Key) ([]*etcd2.Key, []string) {
+	merged := make(map[string]*etcd2.Key, len(common)+len(role))
+	for _, keys := range []map[string]*etcd2.Key{common, role} {
+		for p, k := range keys {
+			merged[p] = k
+		}
+	}
+	paths := make([]string, 0, len(merged))
+	for p := range merged {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	var problems []string
+	result := make([]*etcd2.Key, 0, len(paths))
+	for _, p := range paths {
+		for parent := path.Dir(p); parent != "/"; parent = path.Dir(parent) {
+			if k, ok := merged[parent]; ok && !k.Dir {
+				problems = append(problems, fmt.Sprintf("%s: is a value and cannot also hold %s.", parent, p))
+				break
+			}
+		}
+		result = append(result, merged[p])
+	}
+	return result, problems
+}
+
+// etcdDiff is the difference between the keys declared in the metadata and the live keys.
+type etcdDiff struct {
+	prefix    string       // Keys under it that are not declared are removed.
+	added     []*etcd2.Key // Declared keys that do not exist.
+	changed   []*etcd2.Key // Declared keys with another value, or a TTL to refresh.
+	removed   []*etcd2.Key // Live keys under the prefix that are not declared, deepest first.
+	unchanged []*etcd2.Key // Declared keys with the same value.
+}
+
+// diffEtcdKeys compares the declared keys, in path order, with the live keys.
+func diffEtcdKeys(declared []*etcd2.Key, live map[string]*etcd2.Key, prefix string) *etcdDiff {
+	df := &etcdDiff{prefix: prefix}
+	keep := make(map[string]bool, len(declared))
+	for _, k := range declared {
+		for p := k.Key; p != "/"; p = path.Dir(p) {
+			keep[p] = true
+		}
+		l, ok := live[k.Key]
+		switch {
+		case !ok:
+			df.added = append(df.added, k)
+		case l.Dir != k.Dir || l.Value != k.Value || k.TTL > 0:
+			df.changed = append(df.changed, k)
+		default:
+			df.unchanged = append(df.unchanged, k)
+		}
+	}
+
+	paths := make([]string, 0, len(live))
+	for p := range live {
+		if strings.HasPrefix(p, prefix+"/") && !keep[p] {
+			paths = append(paths, p)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(paths)))
+	for _, p := range paths {
+		df.removed = append(df.removed, live[p])
+	}
+	return df
+}
+
+// report returns the diff for the deploy log. Values are left out because they can hold secrets.
+func (df *etcdDiff) report() string {
+	s := fmt.Sprintf("etcd keys under %s: %d added, %d changed, %d removed, %d unchanged.\n", df.prefix,
+		len(df.added), len(df.changed), len(df.removed), len(df.unchanged))
+	for _, l := range []struct {
+		sign string
+		keys []*etcd2.Key
+	}{{"+", df.added}, {"~", df.changed}, {"-", df.removed}} {
+		for _, k := range l.keys {
+			s += fmt.Sprintf("  %s %s\n", l.sign, k.Key)
+		}
+	}
+	return s
+}
+
+// checkEtcdPrefix returns a problem if a key file of a role sets a prefix it may not own, or an empty
+// string. Only the image's role sets a prefix, at or under /<image> or one of the prefixes the
+// environment allows. The common files are shared by every image and cannot set one.
+func checkEtcdPrefix(prefix string, role string, image string, allowed []string) string {
+	if role != image {
+		return fmt.Sprintf("prefix: can only be set in the key files of the image's role, not %s.", role)
+	}
+	for _, root := range append([]string{"/" + image}, allowed...) {
+		if root == "/" || prefix == root || strings.HasPrefix(prefix, root+"/") {
+			return ""
+		}
+	}
+	return fmt.Sprintf("prefix: '%s' must be at or under /%s, or a prefix in etcd_prefixes.", prefix, image)
+}
+
+// yamlKeys returns the keys of a YAML map in order, so problems are listed in the same order.
+func yamlKeys(m map[interface{}]interface{}) []interface{} {
+	keys := make([]interface{}, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return fmt.Sprint(keys[i]) < fmt.Sprint(keys[j]) })
+	return keys
+}
+
+// validEtcdPath returns true if a key is an absolute path below the root.
+func validEtcdPath(p string) bool {
+	return strings.HasPrefix(p, "/") && path.Clean(p) != "/"
+}
+
+// etcdScalar returns a YAML scalar as a key value.
+func etcdScalar(v interface{}) (string, bool) {
+	switch v.(type) {
+	case string, int, int64, uint64, float64, bool:
+		return fmt.Sprint(v), true
+	}
+	return "", false
+}
+
+// etcdTTL returns the TTL of a key from a duration (ex: 1h) or a number of seconds.
+func etcdTTL(v interface{}) (time.Duration, bool) {
+	var d time.Duration
+	switch t := v.(type) {
+	case int:
+		d = time.Duration(t) * time.Second
+	case string:
+		var err error
+		if d, err = time.ParseDuration(t); err != nil {
+			return 0, false
+		}
+	default:
+		return 0, false
+	}
+	return d, d >= time.Second
+}
@@ -0,0 +1,272 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/composer22/docker-deploy-server/etcd2"
+)
+
+func TestParseEtcdKeys(t *testing.T) {
+	t.Parallel()
+	keys, prefix, problems := parseEtcdKeys([]byte(`
+prefix: /myapp/
+keys:
+  - key: /myapp/db/host
+    value: db.internal
+    ttl: 1h
+  - key: /myapp/locks/
+    dir: true
+    ttl: 60
+values:
+  myapp:
+    db:
+      port: 5432
+      ssl: true
+    Name: My App
+`))
+	if len(problems) > 0 {
+		t.Fatalf("Valid keys should have no problems: %v", problems)
+	}
+	if prefix != "/myapp" {
+		t.Errorf("Expected the prefix /myapp, received %s.", prefix)
+	}
+	expected := map[string]string{
+		"/myapp/db/host": "db.internal",
+		"/myapp/locks":   "",
+		"/myapp/db/port": "5432",
+		"/myapp/db/ssl":  "true",
+		"/myapp/Name":    "My App",
+	}
+	if len(keys) != len(expected) {
+		t.Fatalf("Expected %d keys, received: %v", len(expected), keys)
+	}
+	for p, v := range expected {
+		if k, ok := keys[p]; !ok || k.Value != v {
+			t.Errorf("Expected %s to be '%s', received: %+v", p, v, k)
+		}
+	}
+	if keys["/myapp/db/host"].TTL != time.Hour || keys["/myapp/locks"].TTL != time.Minute || !keys["/myapp/locks"].Dir {
+		t.Errorf("Unexpected options: %+v %+v", keys["/myapp/db/host"], keys["/myapp/locks"])
+	}
+}
+
+// The values of a key file as yaml.v2 resolves them. They are the same before and after its update to
+// v2.4.0 for the embedded etcd server of the tests.
+func TestParseEtcdKeysScalars(t *testing.T) {
+	t.Parallel()
+	keys, _, problems := parseEtcdKeys([]byte(`
+defaults: &defaults
+  timeout: 30
+values:
+  myapp:
+    octal: 0755
+    quoted: "0755"
+    hex: 0x1F
+    exp: 1e3
+    ratio: 0.5
+    big: 12345678901234567890
+    enabled: yes
+    disabled: off
+    date: 2001-12-14
+    url: http://db.internal:5432/app
+    script: |
+      line1
+      line2
+    web:
+      <<: *defaults
+      port: 8080
+`))
+	if len(problems) != 1 || !strings.HasPrefix(problems[0], "defaults:") {
+		t.Fatalf("Expected only the unknown section to be reported, received: %v", problems)
+	}
+	expected := map[string]string{
+		"/myapp/octal":       "493",
+		"/myapp/quoted":      "0755",
+		"/myapp/hex":         "31",
+		"/myapp/exp":         "1000",
+		"/myapp/ratio":       "0.5",
+		"/myapp/big":         "12345678901234567890",
+		"/myapp/enabled":     "true",
+		"/myapp/disabled":    "false",
+		"/myapp/date":        "2001-12-14",
+		"/myapp/url":         "http://db.internal:5432/app",
+		"/myapp/script":      "line1\nline2\n",
+		"/myapp/web/timeout": "30",
+		"/myapp/web/port":    "8080",
+	}
+	if len(keys) != len(expected) {
+		t.Fatalf("Expected %d keys, received: %v", len(expected), keys)
+	}
+	for p, v := range expected {
+		if k, ok := keys[p]; !ok || k.Value != v {
+			t.Errorf("Expected %s to be '%s', received: %+v", p, v, k)
+		}
+	}
+}
+
+func TestParseEtcdKeysProblems(t *testing.T) {
+	t.Parallel()
+	_, _, problems := parseEtcdKeys([]byte(`
+keys:
+  - key: myapp/relative
+    value: x
+  - key: /myapp/dir
+    dir: true
+    value: x
+  - key: /myapp/novalue
+  - key: /myapp/ttl
+    value: x
+    ttl: soon
+  - key: /myapp/typo
+    vaule: 2
+  - key: /myapp/db/port
+    value: 1
+values:
+  myapp:
+    db:
+      port: 5432
+    list: [1, 2]
+other: true
+`))
+	expected := []string{
+		"keys[0]: key 'myapp/relative' must be an absolute path",
+		"keys[1]: a dir cannot have a value.",
+		"keys[2]: value is required unless dir is true.",
+		"keys[3]: ttl 'soon' must be a duration",
+		"keys[4]: vaule is not a known field.",
+		"keys[4]: value is required unless dir is true.",
+		"other: is not a known section.",
+		"/myapp/db/port: is declared more than once.",
+		"values/myapp/list: must be a string, number, boolean or map.",
+	}
+	if len(problems) != len(expected) {
+		t.Fatalf("Expected %d problems, received: %v", len(expected), problems)
+	}
+	for _, e := range expected {
+		found := false
+		for _, p := range problems {
+			found = found || strings.HasPrefix(p, e)
+		}
+		if !found {
+			t.Errorf("Expected problem '%s' in: %v", e, problems)
+		}
+	}
+}
+
+func TestEtcdKeysRoleOverridesCommon(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"common/prod.etcd2.yml": "values:\n  myapp:\n    log_level: info\n    region: us-east\n",
+		"common/dev.etcd2.yml":  "values:\n  myapp:\n    log_level: debug\n",
+		"myapp/prod.etcd2.yaml": "keys:\n  - key: /myapp/log_level\n    value: warn\n",
+	} {
+		f := filepath.Join(dir, name)
+		if err := mkdirAndWrite(f, content); err != nil {
+			t.Fatalf("Unable to write %s: %s", f, err)
+		}
+	}
+
+	common, _, p := readEtcdKeyFile(findEtcdKeyFile(filepath.Join(dir, "common"), "prod"))
+	role, _, q := readEtcdKeyFile(findEtcdKeyFile(filepath.Join(dir, "myapp"), "prod"))
+	keys, r := mergeEtcdKeys(common, role)
+	if problems := append(append(p, q...), r...); len(problems) > 0 {
+		t.Fatalf("Valid keys should have no problems: %v", problems)
+	}
+	if len(keys) != 2 || keys[0].Key != "/myapp/log_level" || keys[0].Value != "warn" ||
+		keys[1].Key != "/myapp/region" || keys[1].Value != "us-east" {
+		t.Errorf("Expected the role to override the common log level, received: %+v %+v", keys[0], keys[1])
+	}
+	if f := findEtcdKeyFile(filepath.Join(dir, "myapp"), "dev"); f != "" {
+		t.Errorf("Expected no dev key file for the role, received %s.", f)
+	}
+
+	_, problems := mergeEtcdKeys(common, map[string]*etcd2.Key{"/myapp/region/zone": {Key: "/myapp/region/zone"}})
+	if len(problems) != 1 || !strings.HasPrefix(problems[0], "/myapp/region: is a value") {
+		t.Errorf("Expected a value holding a key to be reported, received: %v", problems)
+	}
+}
+
+// mkdirAndWrite writes a file, creating its directory.
+func mkdirAndWrite(f string, content string) error {
+	if err := os.MkdirAll(filepath.Dir(f), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(f, []byte(content), 0644)
+}
+
+func TestDiffEtcdKeys(t *testing.T) {
+	t.Parallel()
+	declared := []*etcd2.Key{
+		{Key: "/myapp/db/host", Value: "db2.internal"},
+		{Key: "/myapp/db/port", Value: "5432"},
+		{Key: "/myapp/new", Value: "x"},
+		{Key: "/myapp/session", Value: "y", TTL: time.Hour},
+		{Key: "/shared/region", Value: "us-east"},
+	}
+	live := map[string]*etcd2.Key{
+		"/myapp":             {Key: "/myapp", Dir: true},
+		"/myapp/db":          {Key: "/myapp/db", Dir: true},
+		"/myapp/db/host":     {Key: "/myapp/db/host", Value: "db1.internal"},
+		"/myapp/db/port":     {Key: "/myapp/db/port", Value: "5432"},
+		"/myapp/session":     {Key: "/myapp/session", Value: "y", TTL: time.Minute},
+		"/myapp/old":         {Key: "/myapp/old", Dir: true},
+		"/myapp/old/flag":    {Key: "/myapp/old/flag", Value: "1"},
+		"/shared/region":     {Key: "/shared/region", Value: "us-east"},
+		"/myapplication/key": {Key: "/myapplication/key", Value: "not under the prefix"},
+	}
+	df := diffEtcdKeys(declared, live, "/myapp")
+	paths := func(keys []*etcd2.Key) string {
+		var p []string
+		for _, k := range keys {
+			p = append(p, k.Key)
+		}
+		return strings.Join(p, ",")
+	}
+	for _, tc := range []struct {
+		name     string
+		keys     []*etcd2.Key
+		expected string
+	}{
+		{"added", df.added, "/myapp/new"},
+		{"changed", df.changed, "/myapp/db/host,/myapp/session"},
+		{"removed", df.removed, "/myapp/old/flag,/myapp/old"},
+		{"unchanged", df.unchanged, "/myapp/db/port,/shared/region"},
+	} {
+		if received := paths(tc.keys); received != tc.expected {
+			t.Errorf("Expected %s keys %s, received %s.", tc.name, tc.expected, received)
+		}
+	}
+	if r := df.report(); !strings.HasPrefix(r, "etcd keys under /myapp: 1 added, 2 changed, 2 removed, 2 unchanged.") ||
+		strings.Contains(r, "db2.internal") {
+		t.Errorf("Unexpected report: %s", r)
+	}
+}
+
+func TestCheckEtcdPrefix(t *testing.T) {
+	t.Parallel()
+	for _, tc := range []struct {
+		prefix, role string
+		allowed      []string
+		ok           bool
+	}{
+		{"/myapp", "myapp", nil, true},
+		{"/myapp/config", "myapp", nil, true},
+		{"/shared", "common", nil, false},
+		{"/myapp", "common", nil, false},
+		{"/myapplication", "myapp", nil, false},
+		{"/other", "myapp", nil, false},
+		{"/shared/myapp", "myapp", []string{"/shared"}, true},
+		{"/anything", "myapp", []string{"/"}, true},
+	} {
+		if msg := checkEtcdPrefix(tc.prefix, tc.role, "myapp", tc.allowed); (msg == "") != tc.ok {
+			t.Errorf("Prefix %s of role %s with %v: expected allowed %t, received '%s'.", tc.prefix, tc.role,
+				tc.allowed, tc.ok, msg)
+		}
+	}
+}
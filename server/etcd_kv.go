@@ -0,0 +1,127 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/composer22/docker-deploy-server/etcd2"
+	"github.com/composer22/docker-deploy-server/etcd3"
+)
+
+// etcdKV is the etcd API a deploy updates its keys with. The v2 and v3 connections implement it.
+type etcdKV interface {
+	GetTree(key string) (map[string]*etcd2.Key, error)
+	CompareAndSwap(keys []*etcd2.Key, del []*etcd2.Key) ([]*etcd2.Key, error)
+	Restore(s *etcd2.Snapshot) ([]string, error)
+	Close()
+}
+
+// etcdConn is a connection to the etcd cluster of an environment, with the settings it was made with.
+type etcdConn struct {
+	settings string // Connection settings of the environment, to notice a change.
+	kv       etcdKV
+}
+
+// newEtcdKV returns a connection to the etcd cluster of an environment, with the API, endpoints, TLS,
+// auth and timeout of the environment.
+func newEtcdKV(e *EnvironmentConfig) (etcdKV, error) {
+	tlsConfig, err := etcdTLSConfig(e)
+	if err != nil {
+		return nil, err
+	}
+	if e.EtcdAPI != etcdAPIv3 {
+		return etcd2.NewEtcd2Connect(etcd2.Config{
+			Endpoints: e.EtcdEndpoints,
+			TLS:       tlsConfig,
+			Username:  e.EtcdUsername,
+			Password:  e.EtcdPassword,
+			Timeout:   e.EtcdTimeout,
+		})
+	}
+	c, err := etcd3.NewEtcd3Connect(etcd3.Config{
+		Endpoints: e.EtcdEndpoints,
+		TLS:       tlsConfig,
+		Username:  e.EtcdUsername,
+		Password:  e.EtcdPassword,
+		Timeout:   e.EtcdTimeout,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// etcdSettings returns the connection settings of an environment as a string. The modified time of the
+// certificate files is included so that a certificate renewed in place gets a new connection.
+func etcdSettings(e *EnvironmentConfig) string {
+	s := fmt.Sprintf("%s %v %s %s %s %s %s %s", e.EtcdAPI, e.EtcdEndpoints, e.EtcdCAFile, e.EtcdCertFile,
+		e.EtcdKeyFile, e.EtcdUsername, e.EtcdPassword, e.EtcdTimeout)
+	for _, f := range []string{e.EtcdCAFile, e.EtcdCertFile, e.EtcdKeyFile} {
+		if fi, err := os.Stat(f); f != "" && err == nil {
+			s += " " + fi.ModTime().String()
+		}
+	}
+	return s
+}
+
+// etcd returns the connection to the etcd cluster of an environment. It is made on first use and reused
+// by later deploys until the environment's connection settings change, when the old one is closed.
+func (d *deployService) etcd(name string) (etcdKV, error) {
+	e := d.opt.environment(name)
+	settings := etcdSettings(e)
+	c, ok := d.etcdConns[name]
+	if ok && c.settings == settings {
+		return c.kv, nil
+	}
+	if ok {
+		c.kv.Close()
+		delete(d.etcdConns, name)
+	}
+	kv, err := newEtcdKV(e)
+	if err != nil {
+		return nil, err
+	}
+	d.etcdConns[name] = &etcdConn{settings: settings, kv: kv}
+	return kv, nil
+}
+
+// skippedEtcdKeys returns the line of the deploy log for the keys a restore skipped because someone
+// else changed them after the deploy wrote them, or an empty string if there are none.
+func skippedEtcdKeys(skipped []string) string {
+	if len(skipped) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("Skipped %d etcd keys changed since the deploy wrote them: %s.\n", len(skipped),
+		strings.Join(skipped, ", "))
+}
+
+// etcdTLSConfig returns the TLS configuration for the etcd client of an environment, or nil to use
+// the defaults.
+func etcdTLSConfig(e *EnvironmentConfig) (*tls.Config, error) {
+	if e.EtcdCAFile == "" && e.EtcdCertFile == "" {
+		return nil, nil
+	}
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if e.EtcdCAFile != "" {
+		pem, err := ioutil.ReadFile(e.EtcdCAFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in %s.", e.EtcdCAFile)
+		}
+	}
+	if e.EtcdCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(e.EtcdCertFile, e.EtcdKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
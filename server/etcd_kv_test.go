@@ -0,0 +1,52 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/composer22/docker-deploy-server/etcd2"
+)
+
+// closeKV is an etcdKV that records being closed.
+type closeKV struct {
+	closed bool
+}
+
+func (c *closeKV) GetTree(key string) (map[string]*etcd2.Key, error) { return nil, nil }
+func (c *closeKV) CompareAndSwap(keys []*etcd2.Key, del []*etcd2.Key) ([]*etcd2.Key, error) {
+	return nil, nil
+}
+func (c *closeKV) Restore(s *etcd2.Snapshot) ([]string, error) { return nil, nil }
+func (c *closeKV) Close()                                      { c.closed = true }
+
+func TestEtcdConnectionReused(t *testing.T) {
+	t.Parallel()
+	e := newEnvironmentConfig()
+	e.EtcdEndpoints = []string{"http://10.0.0.5:2379", "http://10.0.0.6:2379"}
+	d := &deployService{
+		opt:       &Options{Environments: map[string]*EnvironmentConfig{"prod": e}},
+		etcdConns: make(map[string]*etcdConn),
+	}
+	first, err := d.etcd("prod")
+	if err != nil {
+		t.Fatalf("Unable to connect: %s", err)
+	}
+	if again, _ := d.etcd("prod"); again != first {
+		t.Errorf("Expected the connection to be reused.")
+	}
+
+	// A change to the connection settings, as from a config reload, gets a new connection.
+	changed := *e
+	changed.EtcdTimeout = time.Second
+	d.opt = &Options{Environments: map[string]*EnvironmentConfig{"prod": &changed}}
+	if next, _ := d.etcd("prod"); next == first {
+		t.Errorf("Expected a new connection for the new settings.")
+	}
+
+	// The connection replaced is closed.
+	old := &closeKV{}
+	d.etcdConns["prod"] = &etcdConn{settings: "old settings", kv: old}
+	if next, _ := d.etcd("prod"); next == old || !old.closed {
+		t.Errorf("Expected the old connection closed and replaced.")
+	}
+}
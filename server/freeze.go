@@ -0,0 +1,155 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// freezeCheck returns true and a reason if deploys to an environment are frozen at a time, or an error
+// if the freezes cannot be read.
+type freezeCheck func(env string, t time.Time) (string, bool, error)
+
+// freezeWindow is a configured rule that blocks deploys to an environment. A rule is either a
+// cron-like expression (minute hour day-of-month month day-of-week) matched against the current
+// minute, or an RFC 3339 date range with the start and end separated by a slash.
+type freezeWindow struct {
+	rule   string          // The original rule text.
+	start  time.Time       // Start of a date range rule.
+	end    time.Time       // End of a date range rule.
+	fields [5]map[int]bool // Allowed values per cron field; nil means any value.
+}
+
+// cronBounds are the min and max values for each cron field.
+var cronBounds = [5][2]int{
+	{0, 59}, // minute
+	{0, 23}, // hour
+	{1, 31}, // day of month
+	{1, 12}, // month
+	{0, 7},  // day of week (0 and 7 are Sunday)
+}
+
+// parseFreezeWindows parses the configured freeze rules for all environments.
+func parseFreezeWindows(rules map[string][]string) (map[string][]*freezeWindow, error) {
+	result := make(map[string][]*freezeWindow)
+	for env, list := range rules {
+		for _, rule := range list {
+			fw, err := parseFreezeWindow(rule)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid freeze window for environment %s: %s", env, err)
+			}
+			result[env] = append(result[env], fw)
+		}
+	}
+	return result, nil
+}
+
+// parseFreezeWindow parses a single freeze rule.
+func parseFreezeWindow(rule string) (*freezeWindow, error) {
+	rule = strings.TrimSpace(rule)
+	fw := &freezeWindow{rule: rule}
+
+	// Date range: start/end
+	if strings.Contains(rule, "/") && !strings.Contains(rule, " ") {
+		parts := strings.SplitN(rule, "/", 2)
+		var err error
+		if fw.start, err = time.Parse(time.RFC3339, parts[0]); err != nil {
+			return nil, err
+		}
+		if fw.end, err = time.Parse(time.RFC3339, parts[1]); err != nil {
+			return nil, err
+		}
+		if !fw.end.After(fw.start) {
+			return nil, fmt.Errorf("'%s' ends before it starts", rule)
+		}
+		return fw, nil
+	}
+
+	// Cron-like expression.
+	f := strings.Fields(rule)
+	if len(f) != 5 {
+		return nil, fmt.Errorf("'%s' must have 5 fields or be a start/end date range", rule)
+	}
+	for i, field := range f {
+		values, err := parseCronField(field, cronBounds[i][0], cronBounds[i][1])
+		if err != nil {
+			return nil, fmt.Errorf("'%s': %s", rule, err)
+		}
+		fw.fields[i] = values
+	}
+	if dow := fw.fields[4]; dow != nil && dow[7] {
+		dow[0] = true
+	}
+	return fw, nil
+}
+
+// parseCronField parses one cron field of comma separated values, ranges (a-b) and steps (*/n, a-b/n).
+// A bare * returns nil to indicate any value.
+func parseCronField(field string, min int, max int) (map[int]bool, error) {
+	if field == "*" {
+		return nil, nil
+	}
+	values := make(map[int]bool)
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			s, err := strconv.Atoi(part[i+1:])
+			if err != nil || s <= 0 {
+				return nil, fmt.Errorf("invalid step in '%s'", part)
+			}
+			step, part = s, part[:i]
+		}
+		lo, hi := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			if lo, err = strconv.Atoi(bounds[0]); err != nil {
+				return nil, fmt.Errorf("invalid value '%s'", part)
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				if hi, err = strconv.Atoi(bounds[1]); err != nil {
+					return nil, fmt.Errorf("invalid value '%s'", part)
+				}
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return nil, fmt.Errorf("'%s' out of range %d-%d", part, min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			values[v] = true
+		}
+	}
+	if len(values) == 0 {
+		return nil, errors.New("no values")
+	}
+	return values, nil
+}
+
+// active returns true if the window blocks deploys at the given time.
+func (f *freezeWindow) active(t time.Time) bool {
+	if !f.start.IsZero() {
+		return !t.Before(f.start) && t.Before(f.end)
+	}
+	match := func(i int, v int) bool {
+		return f.fields[i] == nil || f.fields[i][v]
+	}
+	if !match(0, t.Minute()) || !match(1, t.Hour()) || !match(3, int(t.Month())) {
+		return false
+	}
+
+	// As in cron, if both day fields are restricted either may match.
+	dom, dow := match(2, t.Day()), match(4, int(t.Weekday()))
+	if f.fields[2] != nil && f.fields[4] != nil {
+		return dom || dow
+	}
+	return dom && dow
+}
+
+// String is an implentation of the Stringer interface so the structure is returned as a string
+// to fmt.Print() etc.
+func (f *freezeWindow) String() string {
+	return f.rule
+}
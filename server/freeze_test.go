@@ -0,0 +1,93 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFreezeWindowCron(t *testing.T) {
+	t.Parallel()
+	// Weekends all day and Friday from 16:00.
+	weekend, err := parseFreezeWindow("* * * * 0,6")
+	if err != nil {
+		t.Fatalf("Valid weekend rule should parse: %s", err)
+	}
+	friday, err := parseFreezeWindow("* 16-23 * * 5")
+	if err != nil {
+		t.Fatalf("Valid friday rule should parse: %s", err)
+	}
+
+	tests := []struct {
+		when    string
+		weekend bool
+		friday  bool
+	}{
+		{"2026-10-17T10:00:00Z", true, false},  // Saturday
+		{"2026-10-18T23:59:00Z", true, false},  // Sunday
+		{"2026-10-16T15:59:00Z", false, false}, // Friday
+		{"2026-10-16T16:00:00Z", false, true},  // Friday
+		{"2026-10-19T16:00:00Z", false, false}, // Monday
+	}
+	for _, tc := range tests {
+		when, _ := time.Parse(time.RFC3339, tc.when)
+		if weekend.active(when) != tc.weekend {
+			t.Errorf("Weekend rule at %s expected %t.", tc.when, tc.weekend)
+		}
+		if friday.active(when) != tc.friday {
+			t.Errorf("Friday rule at %s expected %t.", tc.when, tc.friday)
+		}
+	}
+}
+
+func TestFreezeWindowSundaySeven(t *testing.T) {
+	t.Parallel()
+	fw, err := parseFreezeWindow("*/15 * * * 7")
+	if err != nil {
+		t.Fatalf("Valid rule should parse: %s", err)
+	}
+	sunday, _ := time.Parse(time.RFC3339, "2026-10-18T12:30:00Z")
+	if !fw.active(sunday) {
+		t.Errorf("Day of week 7 should match Sunday.")
+	}
+	sunday = sunday.Add(time.Minute)
+	if fw.active(sunday) {
+		t.Errorf("Step should only match every 15 minutes.")
+	}
+}
+
+func TestFreezeWindowDateRange(t *testing.T) {
+	t.Parallel()
+	fw, err := parseFreezeWindow("2026-12-20T00:00:00Z/2027-01-04T00:00:00Z")
+	if err != nil {
+		t.Fatalf("Valid range should parse: %s", err)
+	}
+	for when, expected := range map[string]bool{
+		"2026-12-19T23:59:59Z": false,
+		"2026-12-20T00:00:00Z": true,
+		"2027-01-03T23:59:59Z": true,
+		"2027-01-04T00:00:00Z": false,
+	} {
+		tm, _ := time.Parse(time.RFC3339, when)
+		if fw.active(tm) != expected {
+			t.Errorf("Range at %s expected %t.", when, expected)
+		}
+	}
+}
+
+func TestFreezeWindowInvalid(t *testing.T) {
+	t.Parallel()
+	for _, rule := range []string{
+		"",
+		"* * * *",
+		"60 * * * *",
+		"* 5-2 * * *",
+		"* * * * mon",
+		"*/0 * * * *",
+		"2027-01-04T00:00:00Z/2026-12-20T00:00:00Z",
+		"2026-12-20/2027-01-04",
+	} {
+		if _, err := parseFreezeWindow(rule); err == nil {
+			t.Errorf("Rule '%s' should not parse.", rule)
+		}
+	}
+}
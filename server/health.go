@@ -0,0 +1,205 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// Readiness results.
+const (
+	readyOK       = "ok"
+	readyDegraded = "degraded" // A non-critical check failed.
+	readyFailing  = "failing"  // A critical check failed.
+)
+
+// readyCheck is a dependency check run by the readiness handler.
+type readyCheck struct {
+	name     string                          // Name reported in the result.
+	critical bool                            // Does a failure make the server not ready?
+	check    func(ctx context.Context) error // Returns an error if the dependency is unavailable.
+}
+
+// readyResult is the outcome of a readyCheck.
+type readyResult struct {
+	Status   string  `json:"status"`          // ok or failing.
+	Critical bool    `json:"critical"`        // Does a failure make the server not ready?
+	Latency  float64 `json:"latencyMs"`       // How long the check took in milliseconds.
+	Error    string  `json:"error,omitempty"` // Why the check failed.
+}
+
+// readyCache holds the last readiness result so that requests, which need no auth, don't run the
+// checks every time.
+type readyCache struct {
+	mu     sync.Mutex // Held while the checks run, so concurrent requests share one run.
+	at     time.Time  // When the result was made.
+	status string     // Overall status.
+	body   []byte     // Response body.
+}
+
+// get returns the cached result, running check for a new one once it is older than ttl.
+func (c *readyCache) get(ttl time.Duration, check func() (string, []byte)) (string, []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.body == nil || time.Since(c.at) >= ttl {
+		c.status, c.body = check()
+		c.at = time.Now()
+	}
+	return c.status, c.body
+}
+
+// readyHandler handles a client "can the server deploy?" request. Each dependency is checked in
+// parallel and 503 is returned if a critical one is failing. The result is reused for readyCacheTTL.
+func (s *Server) readyHandler(w http.ResponseWriter, r *http.Request) {
+	if s.invalidMethod(w, r, httpGet) {
+		return
+	}
+
+	status, b := s.ready.get(readyCacheTTL, s.checkReady)
+	if status == readyFailing {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	w.Write(b)
+}
+
+// checkReady runs the readiness checks and returns the overall status with the response body.
+func (s *Server) checkReady() (string, []byte) {
+	ctx, cancel := context.WithTimeout(context.Background(), readyCheckTimeout)
+	defer cancel()
+	checks := s.readyChecks()
+	results := make(map[string]*readyResult)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, c := range checks {
+		wg.Add(1)
+		go func(c readyCheck) {
+			defer wg.Done()
+			start := time.Now()
+			err := runReadyCheck(ctx, c.check)
+			res := &readyResult{
+				Status:   readyOK,
+				Critical: c.critical,
+				Latency:  float64(time.Since(start)) / float64(time.Millisecond),
+			}
+			if err != nil {
+				res.Status, res.Error = readyFailing, err.Error()
+			}
+			mu.Lock()
+			results[c.name] = res
+			mu.Unlock()
+		}(c)
+	}
+	wg.Wait()
+
+	status := readyOK
+	for _, res := range results {
+		switch {
+		case res.Status == readyOK:
+		case res.Critical:
+			status = readyFailing
+		case status == readyOK:
+			status = readyDegraded
+		}
+	}
+
+	b, _ := json.Marshal(
+		&struct {
+			Status string                  `json:"status"`
+			Checks map[string]*readyResult `json:"checks"`
+		}{
+			Status: status,
+			Checks: results,
+		})
+	return status, b
+}
+
+// readyChecks returns the dependency checks for the server.
+func (s *Server) readyChecks() []readyCheck {
+	return []readyCheck{
+		{name: "db", critical: true, check: func(ctx context.Context) error {
+			return s.db.Ping()
+		}},
+		{name: "redis", critical: true, check: func(ctx context.Context) error {
+			_, err := s.redis.Ping().Result()
+			return err
+		}},
+		{name: "tempPath", critical: true, check: func(ctx context.Context) error {
+			return checkWritable(s.options().TempPath)
+		}},
+		{name: "docker", critical: true, check: func(ctx context.Context) error {
+			if _, err := exec.LookPath("docker"); err == nil {
+				return nil
+			}
+			if _, err := os.Stat(dockerSocket); err == nil {
+				return nil
+			}
+			return fmt.Errorf("docker binary not in PATH and no socket at %s", dockerSocket)
+		}},
+		{name: "dockerCompose", critical: true, check: func(ctx context.Context) error {
+			_, err := exec.LookPath("docker-compose")
+			return err
+		}},
+		{name: "dockerMachine", critical: true, check: func(ctx context.Context) error {
+			_, err := exec.LookPath("docker-machine")
+			return err
+		}},
+		{name: "git", critical: false, check: func(ctx context.Context) error {
+			o := s.options()
+			return checkGitRemote(ctx, o.GitRoot, o.GitRepo)
+		}},
+	}
+}
+
+// runReadyCheck runs a check, giving up when the context is done.
+func runReadyCheck(ctx context.Context, check func(ctx context.Context) error) error {
+	result := make(chan error, 1)
+	go func() { result <- check(ctx) }()
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		return errors.New("check timed out")
+	}
+}
+
+// checkWritable validates that a file can be created in a directory.
+func checkWritable(dir string) error {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(dir, ".ready-")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// checkGitRemote validates that the metadata repo can be reached with git.
+func checkGitRemote(ctx context.Context, gitRoot string, gitRepo string) error {
+	if gitRepo == "" {
+		return errors.New("git.repo is not configured")
+	}
+	cmd := exec.Command("git", "ls-remote", "--heads", fmt.Sprintf("%s/%s.git", gitRoot, gitRepo))
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		cmd.Process.Kill()
+		return errors.New("git ls-remote timed out")
+	}
+}
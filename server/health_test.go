@@ -0,0 +1,29 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReadyCache(t *testing.T) {
+	t.Parallel()
+	var c readyCache
+	runs := 0
+	check := func() (string, []byte) {
+		runs++
+		return readyOK, []byte("{}")
+	}
+	for i := 0; i < 3; i++ {
+		if status, b := c.get(time.Minute, check); status != readyOK || string(b) != "{}" {
+			t.Errorf("Expected the check result, received %s %s.", status, b)
+		}
+	}
+	if runs != 1 {
+		t.Errorf("Expected the checks run once within the TTL, received %d runs.", runs)
+	}
+	c.at = time.Now().Add(-2 * time.Minute)
+	c.get(time.Minute, check)
+	if runs != 2 {
+		t.Errorf("Expected the checks run again after the TTL, received %d runs.", runs)
+	}
+}
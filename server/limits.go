@@ -0,0 +1,127 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	redis "gopkg.in/redis.v3"
+)
+
+// deployRateLimited validates that the Authorization token has not exceeded its deploy requests
+// per minute.
+func (s *Server) deployRateLimited(w http.ResponseWriter, r *http.Request) bool {
+	token := s.authToken(r)
+	limit, _ := s.db.AuthTokenLimits(token)
+	if limit <= 0 {
+		limit = s.options().DeploysPerMinute
+	}
+	return s.rateLimited(w, "token:"+tokenKey(token), limit)
+}
+
+// envRateLimited validates that an environment has not exceeded its deploy requests per minute.
+func (s *Server) envRateLimited(w http.ResponseWriter, env string) bool {
+	return s.rateLimited(w, "env:"+env, s.options().environment(env).DeploysPerMinute)
+}
+
+// rateLimited increments a fixed window counter in redis and responds with 429 if the limit has
+// been exceeded. A limit of zero is unlimited.
+func (s *Server) rateLimited(w http.ResponseWriter, key string, limit int) bool {
+	if limit <= 0 {
+		return false
+	}
+	now := time.Now().Unix()
+	k := fmt.Sprintf("%s:%s:%d", s.options().RedisKeyRateLimit, key, now/limitWindow)
+	n, err := s.redis.Incr(k).Result()
+	if err != nil {
+		s.metrics.redisErrors.Inc("api")
+		s.log.Errorf("Unable to access redis server for rate limit: %s", err)
+		return false
+	}
+	if n == 1 {
+		s.redis.Expire(k, 2*limitWindow*time.Second)
+	}
+	if n > int64(limit) {
+		tooManyRequests(w, limitWindow-now%limitWindow)
+		return true
+	}
+	return false
+}
+
+// reserveActiveScript drops the entries left behind by deploys that never finished, then adds a
+// deploy to a token's active deploys unless it already has the maximum. It returns 1 if the deploy
+// was added. Being a script, the count and the add can't interleave with another request.
+var reserveActiveScript = redis.NewScript(`
+redis.call("ZREMRANGEBYSCORE", KEYS[1], "-inf", ARGV[1])
+if redis.call("ZCARD", KEYS[1]) >= tonumber(ARGV[2]) then
+	return 0
+end
+redis.call("ZADD", KEYS[1], ARGV[3], ARGV[4])
+redis.call("EXPIRE", KEYS[1], ARGV[5])
+return 1
+`)
+
+// activeLimited reserves a place for a deploy among the Authorization token's active deploys. It
+// responds with 429 if the token already has too many deploys queued or running.
+func (s *Server) activeLimited(w http.ResponseWriter, r *http.Request, deployID string) bool {
+	token := s.authToken(r)
+	_, max := s.db.AuthTokenLimits(token)
+	if max <= 0 {
+		max = s.options().MaxActiveDeploys
+	}
+	if max <= 0 {
+		return false
+	}
+
+	key := activeDeploysKey(s.options().RedisKeyActive, tokenKey(token))
+	reserved, err := reserveActive(s.redis, key, deployID, max, time.Now())
+	if err != nil {
+		s.metrics.redisErrors.Inc("api")
+		s.log.Errorf("Unable to access redis server for active deploys: %s", err)
+		return false
+	}
+	if !reserved {
+		tooManyRequests(w, activeRetryAfter)
+		return true
+	}
+	return false
+}
+
+// reserveActive adds a deploy to the active deploys in key if there are fewer than max.
+func reserveActive(c *redis.Client, key string, deployID string, max int, now time.Time) (bool, error) {
+	stale := now.Add(-DefaultActiveDeployTTL).Unix()
+	res, err := reserveActiveScript.Run(c, []string{key}, []string{
+		strconv.FormatInt(stale, 10),
+		strconv.Itoa(max),
+		strconv.FormatInt(now.Unix(), 10),
+		deployID,
+		strconv.Itoa(int(DefaultActiveDeployTTL / time.Second)),
+	}).Result()
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.(int64)
+	return n == 1, nil
+}
+
+// trackActive records a queued deploy against the token that requested it, whatever the limit.
+func (s *Server) trackActive(r *DeployRequest) {
+	if r.Owner == "" {
+		return
+	}
+	key := activeDeploysKey(s.options().RedisKeyActive, r.Owner)
+	s.redis.ZAdd(key, redis.Z{Score: float64(time.Now().Unix()), Member: r.DeployID})
+	s.redis.Expire(key, DefaultActiveDeployTTL)
+}
+
+// activeDeploysKey returns the redis key of the sorted set holding a token's active deploys.
+func activeDeploysKey(prefix string, owner string) string {
+	return fmt.Sprintf("%s:%s", prefix, owner)
+}
+
+// tooManyRequests responds with 429 and the number of seconds the client should wait.
+func tooManyRequests(w http.ResponseWriter, retryAfter int64) {
+	w.Header().Set("Retry-After", strconv.FormatInt(retryAfter, 10))
+	http.Error(w, InvalidTooManyRequests, http.StatusTooManyRequests)
+}
@@ -0,0 +1,115 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/composer22/docker-deploy-server/logger"
+	redis "gopkg.in/redis.v3"
+)
+
+// testRedis returns a client for a redis server run in-process. The server is stopped when the test
+// ends.
+func testRedis(t *testing.T) *redis.Client {
+	t.Helper()
+	m := miniredis.RunT(t)
+	c := redis.NewClient(&redis.Options{Addr: m.Addr()})
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+// testRedisServer returns a server with only its redis and options set up.
+func testRedisServer(t *testing.T) *Server {
+	c := testRedis(t)
+	return &Server{
+		opt: &Options{
+			RedisKeyQueue:       "queue",
+			RedisKeyRateLimit:   "ratelimit",
+			RedisKeyActive:      "active",
+			RedisKeyIdempotency: "idempotency",
+			IdempotencyWindow:   time.Hour,
+		},
+		redis:   c,
+		metrics: newServerMetrics(),
+		log:     logger.New(logger.Error, false),
+	}
+}
+
+func TestReserveActiveConcurrent(t *testing.T) {
+	t.Parallel()
+	c := testRedis(t)
+	now := time.Now()
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	reserved := 0
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ok, err := reserveActive(c, "active:token", fmt.Sprintf("deploy-%d", i), 3, now)
+			if err != nil {
+				t.Errorf("Unable to reserve: %s", err)
+			}
+			if ok {
+				mu.Lock()
+				reserved++
+				mu.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+	if reserved != 3 {
+		t.Errorf("Expected 3 deploys reserved, received %d.", reserved)
+	}
+	if n, _ := c.ZCard("active:token").Result(); n != 3 {
+		t.Errorf("Expected 3 active deploys, received %d.", n)
+	}
+	if ttl, _ := c.TTL("active:token").Result(); ttl <= 0 || ttl > DefaultActiveDeployTTL {
+		t.Errorf("Expected the active deploys to expire, received a TTL of %s.", ttl)
+	}
+}
+
+func TestReserveActiveDropsStale(t *testing.T) {
+	t.Parallel()
+	c := testRedis(t)
+	now := time.Now()
+	old := float64(now.Add(-DefaultActiveDeployTTL - time.Minute).Unix())
+	c.ZAdd("active:token", redis.Z{Score: old, Member: "abandoned"})
+
+	if ok, err := reserveActive(c, "active:token", "deploy-1", 1, now); err != nil || !ok {
+		t.Errorf("Expected the abandoned deploy dropped, received %t: %v", ok, err)
+	}
+	if ok, _ := reserveActive(c, "active:token", "deploy-2", 1, now); ok {
+		t.Errorf("Expected the limit to hold.")
+	}
+	if members, _ := c.ZRange("active:token", 0, -1).Result(); len(members) != 1 || members[0] != "deploy-1" {
+		t.Errorf("Expected only deploy-1 active, received %v.", members)
+	}
+}
+
+func TestRateLimited(t *testing.T) {
+	t.Parallel()
+	s := testRedisServer(t)
+
+	for i := 0; i < 2; i++ {
+		if w := httptest.NewRecorder(); s.rateLimited(w, "token:a", 2) {
+			t.Fatalf("Expected request %d allowed, received %d.", i+1, w.Code)
+		}
+	}
+	w := httptest.NewRecorder()
+	if !s.rateLimited(w, "token:a", 2) || w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Errorf("Expected 429 with a Retry-After, received %d %v.", w.Code, w.Header())
+	}
+	if s.rateLimited(httptest.NewRecorder(), "token:b", 2) {
+		t.Errorf("Expected other keys to have their own count.")
+	}
+	if s.rateLimited(httptest.NewRecorder(), "token:a", 0) {
+		t.Errorf("Expected a limit of zero to be unlimited.")
+	}
+}
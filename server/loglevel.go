@@ -0,0 +1,149 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/composer22/docker-deploy-server/logger"
+)
+
+// logLevels is the datastructure of the current log levels returned by the API.
+type logLevels struct {
+	Level   string            `json:"level"`   // Base level.
+	Modules map[string]string `json:"modules"` // Level overrides by module.
+}
+
+// parseLogLevels returns the base and module log levels of the options. --debug overrides the base.
+func parseLogLevels(o *Options) (int, map[string]int, error) {
+	base := logger.Info
+	if o.LogLevel != "" {
+		lvl, err := logger.ParseLevel(o.LogLevel)
+		if err != nil {
+			return 0, nil, fmt.Errorf("Invalid log_level: %s", err)
+		}
+		base = lvl
+	}
+	if o.Debug {
+		base = logger.Debug
+	}
+	modules := make(map[string]int)
+	for m, name := range o.LogLevels {
+		if !validLogModule(m) {
+			return 0, nil, fmt.Errorf("Invalid log_levels module '%s'.", m)
+		}
+		lvl, err := logger.ParseLevel(name)
+		if err != nil {
+			return 0, nil, fmt.Errorf("Invalid log_levels.%s: %s", m, err)
+		}
+		modules[m] = lvl
+	}
+	return base, modules, nil
+}
+
+// applyLogLevels sets the base and module log levels from the options.
+func (s *Server) applyLogLevels(o *Options) error {
+	base, modules, err := parseLogLevels(o)
+	if err != nil {
+		return err
+	}
+	s.log.SetLogLevel(base)
+	for m := range s.log.ModuleLevels() {
+		s.log.SetModuleLevel(m, logger.UseDefault)
+	}
+	for m, lvl := range modules {
+		s.log.SetModuleLevel(m, lvl)
+	}
+	return nil
+}
+
+// currentLogLevels returns the current base and module log levels by name.
+func (s *Server) currentLogLevels() *logLevels {
+	l := &logLevels{
+		Level:   logger.LevelNames[s.log.GetLogLevel()],
+		Modules: make(map[string]string),
+	}
+	for m, lvl := range s.log.ModuleLevels() {
+		l.Modules[m] = logger.LevelNames[lvl]
+	}
+	return l
+}
+
+// toggleDebug switches the base log level between debug and the configured level.
+func (s *Server) toggleDebug() {
+	if s.log.GetLogLevel() != logger.Debug {
+		s.log.SetLogLevel(logger.Debug)
+	} else if lvl, err := logger.ParseLevel(s.options().LogLevel); err == nil {
+		s.log.SetLogLevel(lvl)
+	} else {
+		s.log.SetLogLevel(logger.Info)
+	}
+	s.log.Noticef("Log level changed to %s.", logger.LevelNames[s.log.GetLogLevel()])
+}
+
+// logLevelHandler handles a client request to show or change the log levels at runtime.
+func (s *Server) logLevelHandler(w http.ResponseWriter, r *http.Request) {
+	if s.invalidHeader(w, r) || s.invalidMethod(w, r, httpGet, httpPut) || s.invalidAuth(w, r) {
+		return
+	}
+
+	if r.Method == httpPut {
+		if s.authRight(w, r, rightAdmin) {
+			return
+		}
+		var req struct {
+			Module string `json:"module"` // Empty sets the base level.
+			Level  string `json:"level"`  // Level name, or "default" to remove a module level.
+		}
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, InvalidBody, http.StatusBadRequest)
+			return
+		}
+		if err := json.Unmarshal(b, &req); err != nil {
+			http.Error(w, InvalidJSONText, http.StatusBadRequest)
+			return
+		}
+		req.Module = strings.ToLower(req.Module)
+		if req.Module != "" && !validLogModule(req.Module) {
+			http.Error(w, InvalidLogModule, http.StatusBadRequest)
+			return
+		}
+		lvl := logger.UseDefault
+		if !(req.Module != "" && strings.ToLower(req.Level) == logLevelDefault) {
+			if lvl, err = logger.ParseLevel(req.Level); err != nil {
+				http.Error(w, InvalidLogLevel, http.StatusBadRequest)
+				return
+			}
+		}
+		if req.Module == "" {
+			s.log.SetLogLevel(lvl)
+		} else {
+			s.log.SetModuleLevel(req.Module, lvl)
+		}
+		s.log.Noticef("Log level of %s changed to %s by %s.", logModuleName(req.Module), req.Level,
+			s.db.AuthTokenName(s.authToken(r)))
+	}
+
+	b, _ := json.Marshal(s.currentLogLevels())
+	w.Write(b)
+}
+
+// validLogModule returns true if the name is a module with its own log level.
+func validLogModule(m string) bool {
+	switch m {
+	case moduleHTTP, moduleDeploy, moduleDB, moduleEtcd:
+		return true
+	}
+	return false
+}
+
+// logModuleName returns a module name for messages, where empty is the base level.
+func logModuleName(m string) string {
+	if m == "" {
+		return "base"
+	}
+	return m
+}
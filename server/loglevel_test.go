@@ -0,0 +1,156 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/composer22/docker-deploy-server/db"
+	"github.com/composer22/docker-deploy-server/logger"
+)
+
+func TestParseLogLevels(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		opt     *Options
+		base    int
+		modules map[string]int
+		err     string
+	}{
+		{&Options{}, logger.Info, map[string]int{}, ""},
+		{&Options{LogLevel: "warning", LogLevels: map[string]string{"http": "error", "etcd": "debug"}},
+			logger.Warning, map[string]int{"http": logger.Error, "etcd": logger.Debug}, ""},
+		{&Options{LogLevel: "error", Debug: true}, logger.Debug, map[string]int{}, ""},
+		{&Options{LogLevel: "loud"}, 0, nil, "Invalid log_level"},
+		{&Options{LogLevels: map[string]string{"redis": "debug"}}, 0, nil, "Invalid log_levels module 'redis'."},
+		{&Options{LogLevels: map[string]string{"db": "loud"}}, 0, nil, "Invalid log_levels.db"},
+	}
+	for _, tc := range tests {
+		base, modules, err := parseLogLevels(tc.opt)
+		if tc.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("%+v: expected the error %q, got %v", tc.opt, tc.err, err)
+			}
+			continue
+		}
+		if err != nil || base != tc.base || !reflect.DeepEqual(modules, tc.modules) {
+			t.Errorf("%+v: expected %d %v, got %d %v (%v)", tc.opt, tc.base, tc.modules, base, modules, err)
+		}
+	}
+}
+
+// testLogLevelServer returns a server with a mocked database logging at info, and at warning for
+// http requests.
+func testLogLevelServer(t *testing.T) (*Server, sqlmock.Sqlmock) {
+	t.Helper()
+	conn, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Unable to create the database mock: %s", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	o := &Options{LogLevel: "info", LogLevels: map[string]string{"http": "warning"}}
+	s := &Server{opt: o, fileOpt: o, db: db.NewDBConnectFromDB(conn), log: logger.New(logger.Info, false)}
+	if err := s.applyLogLevels(o); err != nil {
+		t.Fatalf("Unable to apply the log levels: %s", err)
+	}
+	return s, mock
+}
+
+// logLevelRequest returns a request to the log level API with a bearer token.
+func logLevelRequest(method string, route string, token string, body string) *http.Request {
+	r := httptest.NewRequest(method, route, bytes.NewBufferString(body))
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("Accept", "application/json")
+	r.Header.Set("Authorization", "Bearer "+token)
+	return r
+}
+
+// expectValidAuth expects a token to be checked.
+func expectValidAuth(mock sqlmock.Sqlmock, token string) {
+	mock.ExpectQuery("SELECT id FROM auth_tokens WHERE token").WithArgs(token).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+}
+
+func TestLogLevelHandler(t *testing.T) {
+	t.Parallel()
+	s, mock := testLogLevelServer(t)
+	levels := func(w *httptest.ResponseRecorder) *logLevels {
+		t.Helper()
+		var l logLevels
+		if err := json.Unmarshal(w.Body.Bytes(), &l); err != nil {
+			t.Fatalf("Unable to read the log levels: %s", err)
+		}
+		return &l
+	}
+
+	// GET shows the base and module levels to any valid token.
+	expectValidAuth(mock, "user")
+	w := httptest.NewRecorder()
+	s.logLevelHandler(w, logLevelRequest(httpGet, httpRouteV1LogLevel, "user", ""))
+	expected := &logLevels{Level: "info", Modules: map[string]string{"http": "warning"}}
+	if w.Code != http.StatusOK || !reflect.DeepEqual(levels(w), expected) {
+		t.Errorf("Expected %+v, got %d: %s", expected, w.Code, w.Body)
+	}
+
+	// PUT needs the admin right.
+	expectValidAuth(mock, "user")
+	mock.ExpectQuery("FROM auth_tokens_rights").WithArgs("user", rightAdmin).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	w = httptest.NewRecorder()
+	s.logLevelHandler(w, logLevelRequest(httpPut, httpRouteV1LogLevel, "user", `{"level":"debug"}`))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected %d, got %d: %s", http.StatusForbidden, w.Code, w.Body)
+	}
+
+	// Unknown levels and modules are rejected.
+	for body, text := range map[string]string{
+		`{"level":"loud"}`:                    InvalidLogLevel,
+		`{"module":"redis","level":"debug"}`:  InvalidLogModule,
+		`{"level":"default"}`:                 InvalidLogLevel,
+		`{"module":"deploy","level":"quiet"}`: InvalidLogLevel,
+	} {
+		expectAdmin(mock)
+		w = httptest.NewRecorder()
+		s.logLevelHandler(w, logLevelRequest(httpPut, httpRouteV1LogLevel, "admin", body))
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), text) {
+			t.Errorf("%s: expected %d %q, got %d: %s", body, http.StatusBadRequest, text, w.Code, w.Body)
+		}
+	}
+	if s.log.GetLogLevel() != logger.Info {
+		t.Errorf("Expected the base level to be unchanged, got %d", s.log.GetLogLevel())
+	}
+
+	// An admin changes a module level, and the info route shows it.
+	expectAdmin(mock)
+	mock.ExpectQuery("SELECT name FROM auth_tokens").WithArgs("admin").
+		WillReturnRows(sqlmock.NewRows([]string{"name"}).AddRow("Admin"))
+	w = httptest.NewRecorder()
+	s.logLevelHandler(w, logLevelRequest(httpPut, httpRouteV1LogLevel, "admin",
+		`{"module":"etcd","level":"debug"}`))
+	expected = &logLevels{Level: "info", Modules: map[string]string{"http": "warning", "etcd": "debug"}}
+	if w.Code != http.StatusOK || !reflect.DeepEqual(levels(w), expected) {
+		t.Errorf("Expected %+v, got %d: %s", expected, w.Code, w.Body)
+	}
+
+	expectValidAuth(mock, "user")
+	w = httptest.NewRecorder()
+	s.infoHandler(w, logLevelRequest(httpGet, httpRouteV1Info, "user", ""))
+	var info struct {
+		LogLevels *logLevels `json:"logLevels"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &info); err != nil {
+		t.Fatalf("Unable to read the info: %s (%s)", err, w.Body)
+	}
+	if !reflect.DeepEqual(info.LogLevels, expected) {
+		t.Errorf("Expected the info to show %+v, got %+v", expected, info.LogLevels)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unexpected database calls: %s", err)
+	}
+}
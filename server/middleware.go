@@ -1,6 +1,11 @@
 package server
 
-import "net/http"
+import (
+	"net/http"
+	"time"
+
+	"github.com/composer22/docker-deploy-server/tracing"
+)
 
 // Middleware is used to perform filtering work on the request before the main controllers are
 // called.
@@ -12,11 +17,43 @@ type Middleware struct {
 // ServeHTTP implements the interface to accept requests so they can be filtered before handling
 // by the server.
 func (m *Middleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	// Don't log health checks
-	if r.URL.Path != httpRouteV1Health {
+	// Carry the client's correlation ID with the request. Malformed IDs are rejected below.
+	cid, validID := requestCorrelationID(r)
+	if validID {
+		r = withCorrelationID(r, cid)
+	}
+
+	// Don't log or trace health checks or metrics scrapes.
+	var span *tracing.Span
+	switch r.URL.Path {
+	case httpRouteV1Health, httpRouteV1Ready, httpRouteV1Prometheus:
+	default:
 		m.serv.LogRequest(r)
+		span, r = m.serv.startRequestSpan(r)
 	}
 	m.serv.incrementStats(r)
 	m.serv.initResponseHeader(w)
-	m.handler.ServeHTTP(w, r)
+	if validID && cid != "" {
+		w.Header().Set("X-Correlation-ID", cid)
+	}
+
+	// Record the status code and latency of the request.
+	start := time.Now()
+	rec := &statusRecorder{ResponseWriter: w}
+	defer func() {
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		m.serv.metrics.observeRequest(r.URL.Path, rec.status, time.Since(start))
+		if span != nil {
+			finishRequestSpan(span, w, rec.status)
+		}
+	}()
+
+	if !validID {
+		http.Error(rec, InvalidRequestID, http.StatusBadRequest)
+		return
+	}
+
+	m.handler.ServeHTTP(rec, r)
 }
@@ -2,34 +2,70 @@ package server
 
 import (
 	"encoding/json"
+	"fmt"
+	"sort"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/spf13/viper"
 )
 
 // Options represents parameters that are passed to the application for launching the server.
 type Options struct {
-	ConfigPath         string                       `json:"configPath"`         // Filepath to the config of the server.
-	ConfigPrefix       string                       `json:"configPrefix"`       // Prefix of the config file name of the server.
-	ServerName         string                       `json:"serverName"`         // Name of the server.
-	Domain             string                       `json:"domain"`             // Domain of the server.
-	Hostname           string                       `json:"hostName"`           // Hostname of the server.
-	Port               int                          `json:"port"`               // HTTP api port of the server.
-	ProfPort           int                          `json:"profPort"`           // The profiler port of the server.
-	DSN                string                       `json:"-"`                  // DSN login string to the database.
-	RedisHostname      string                       `json:"redisHostname"`      // Hostname of a redis server.
-	RedisPort          int                          `json:"redisPort"`          // Port of a redis server.
-	RedisPassword      string                       `json:"-"`                  // Password of a redis server.
-	RedisDatabase      int                          `json:"redisDatabase"`      // Database of a redis server.
-	RedisKeyLastDeploy string                       `json:"redisKeyLastDeploy"` // Redis key for the hash that holds the last deploys.
-	RedisKeyQueue      string                       `json:"redisKeyQueue"`      // Redis key for the list that acts as a queue.
-	RedisPollInt       int                          `json:"redisPollInt"`       // Redis polling interval for teh queue.
-	GitRoot            string                       `json:"gitRoot"`            // Prefix for the git command to access account.
-	GitRepo            string                       `json:"gitRepo"`            // Repo name on github that contains app config data.
-	Project            string                       `json:"project"`            // Docker-compose project param.
-	TempPath           string                       `json:"tempPath"`           // Temp directory for work.
-	Debug              bool                         `json:"debugEnabled"`       // Is debugging enabled in the application or server.
-	Environments       map[string]map[string]string `json:"environments"`       // Environments for deployment.
+	ConfigPath          string                        `json:"configPath"`          // Filepath to the config of the server.
+	ConfigFile          string                        `json:"configFile"`          // Config file read.
+	ConfigPrefix        string                        `json:"configPrefix"`        // Prefix of the config file name of the server.
+	ServerName          string                        `json:"serverName"`          // Name of the server.
+	Domain              string                        `json:"domain"`              // Domain of the server.
+	Hostname            string                        `json:"hostName"`            // Hostname of the server.
+	Port                int                           `json:"port"`                // HTTP api port of the server.
+	ProfPort            int                           `json:"profPort"`            // The profiler port of the server.
+	DSN                 string                        `json:"-"`                   // DSN login string to the database.
+	RedisHostname       string                        `json:"redisHostname"`       // Hostname of a redis server.
+	RedisPort           int                           `json:"redisPort"`           // Port of a redis server.
+	RedisPassword       string                        `json:"-"`                   // Password of a redis server.
+	RedisDatabase       int                           `json:"redisDatabase"`       // Database of a redis server.
+	RedisKeyLastDeploy  string                        `json:"redisKeyLastDeploy"`  // Redis key for the hash that holds the last deploys.
+	RedisKeyQueue       string                        `json:"redisKeyQueue"`       // Redis key for the list that acts as a queue.
+	RedisPollInt        int                           `json:"redisPollInt"`        // Redis polling interval for teh queue.
+	RedisKeyRateLimit   string                        `json:"redisKeyRateLimit"`   // Redis key prefix for rate limit counters.
+	RedisKeyActive      string                        `json:"redisKeyActive"`      // Redis key prefix for active deploys per token.
+	RedisKeyIdempotency string                        `json:"redisKeyIdempotency"` // Redis key prefix for idempotency keys.
+	IdempotencyWindow   time.Duration                 `json:"idempotencyWindow"`   // How long an Idempotency-Key returns the original deploy.
+	ShutdownGrace       time.Duration                 `json:"shutdownGrace"`       // How long shutdown waits for in-flight deploys before requeueing them.
+	EnvironmentsRefresh time.Duration                 `json:"environmentsRefresh"` // How often the environments in the DB are checked for changes (0 = never).
+	DeploysPerMinute    int                           `json:"deploysPerMinute"`    // Default deploy requests per minute per token (0 = unlimited).
+	MaxActiveDeploys    int                           `json:"maxActiveDeploys"`    // Default queued or running deploys per token (0 = unlimited).
+	TLSCertFile         string                        `json:"tlsCertFile"`         // PEM certificate for the API listener. Empty serves plain HTTP.
+	TLSKeyFile          string                        `json:"tlsKeyFile"`          // PEM key for the API listener.
+	TLSMinVersion       string                        `json:"tlsMinVersion"`       // Minimum TLS version (1.0, 1.1, 1.2, 1.3).
+	TLSClientAuth       string                        `json:"tlsClientAuth"`       // Client certificate policy: none, request or require.
+	TLSClientCAFile     string                        `json:"tlsClientCAFile"`     // PEM CA bundle to verify client certificates.
+	TLSClientIdentities map[string]string             `json:"tlsClientIdentities"` // Client cert subject or CN mapped to an auth token cert identity.
+	GitRoot             string                        `json:"gitRoot"`             // Prefix for the git command to access account.
+	GitRepo             string                        `json:"gitRepo"`             // Repo name on github that contains app config data.
+	Project             string                        `json:"project"`             // Docker-compose project param.
+	TempPath            string                        `json:"tempPath"`            // Temp directory for work.
+	LogFormat           string                        `json:"logFormat"`           // Log output format: text or json.
+	LogLevel            string                        `json:"logLevel"`            // Configured base log level (ex: info).
+	LogLevels           map[string]string             `json:"logLevels"`           // Configured log level by module (http, deploy, db, etcd).
+	RedactHeaders       []string                      `json:"redactHeaders"`       // Extra request headers masked in the log.
+	RedactFields        []string                      `json:"redactFields"`        // Extra JSON body fields and query params masked in the log.
+	RedactPatterns      []string                      `json:"redactPatterns"`      // Regexps masked in logged bodies and script output.
+	RedactMaxBody       int                           `json:"redactMaxBody"`       // Maximum request body bytes logged (0 = unlimited).
+	TracingEndpoint     string                        `json:"tracingEndpoint"`     // OTLP/HTTP traces URL. Empty disables export.
+	TracingServiceName  string                        `json:"tracingServiceName"`  // service.name of exported spans.
+	TracingHeaders      map[string]string             `json:"-"`                   // Extra headers sent to the collector (ex: API keys).
+	SyslogNetwork       string                        `json:"syslogNetwork"`       // Syslog transport: udp, tcp, tls or unix. Empty disables syslog.
+	SyslogAddress       string                        `json:"syslogAddress"`       // Syslog host:port or socket path.
+	SyslogFacility      string                        `json:"syslogFacility"`      // Syslog facility name (ex: local0).
+	SyslogAppName       string                        `json:"syslogAppName"`       // APP-NAME of syslog messages.
+	SyslogCAFile        string                        `json:"syslogCAFile"`        // PEM CA bundle to verify a tls syslog server.
+	Debug               bool                          `json:"debugEnabled"`        // Is debugging enabled in the application or server.
+	Environments        map[string]*EnvironmentConfig `json:"environments"`        // Environments for deployment.
+	Sources             map[string]string             `json:"sources"`             // Where each config value came from: default, config, env:<var> or file:<path>.
+	FreezeWindows       map[string][]string           `json:"freezeWindows"`       // Deploy freeze rules per environment.
 }
 
 // Fill in the defaults for the viper configuration.
@@ -47,11 +83,49 @@ func (o *Options) SetConfigDefaults(v *viper.Viper) {
 		"database":        "",
 		"key_last_deploy": DefaultRedisKeyLastDeploy,
 		"key_queue":       DefaultRedisKeyQueue,
-		"poll_interval":   string(DefaultRedisPollInt),
+		"poll_interval":   strconv.Itoa(DefaultRedisPollInt),
+		"key_rate_limit":  DefaultRedisKeyRateLimit,
+		"key_active":      DefaultRedisKeyActive,
+		"key_idempotency": DefaultRedisKeyIdempotency,
+	})
+	v.SetDefault("limits", map[string]string{
+		"deploys_per_minute": "0",
+		"max_active_deploys": "0",
+	})
+	v.SetDefault("idempotency_window", DefaultIdempotencyWindow)
+	v.SetDefault("shutdown_grace", DefaultShutdownGrace)
+	v.SetDefault("environments_refresh", DefaultEnvironmentsRefresh)
+	v.SetDefault("tls", map[string]string{
+		"cert_file":      "",
+		"key_file":       "",
+		"min_version":    DefaultTLSMinVersion,
+		"client_auth":    DefaultTLSClientAuth,
+		"client_ca_file": "",
+	})
+	v.SetDefault("log_format", DefaultLogFormat)
+	v.SetDefault("log_level", DefaultLogLevel)
+	v.SetDefault("tracing", map[string]string{
+		"endpoint":     "",
+		"service_name": applicationName,
+	})
+	v.SetDefault("redact", map[string]string{
+		"max_body": strconv.Itoa(DefaultRedactMaxBody),
+	})
+	v.SetDefault("syslog", map[string]string{
+		"network":  "",
+		"address":  "",
+		"facility": DefaultSyslogFacility,
+		"app_name": applicationName,
+		"ca_file":  "",
 	})
 	v.SetDefault("project", DefaultProject)
 	v.SetDefault("temp_path", DefaultTempPath)
 
+	// Environment variables override the config (ex: DDS_REDIS_PASSWORD for redis.password).
+	v.SetEnvPrefix(configEnvPrefix)
+	v.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	v.AutomaticEnv()
+
 	// Add the config path.
 	v.SetConfigType("yaml")
 	v.SetConfigName(o.ConfigPrefix)
@@ -62,45 +136,91 @@ func (o *Options) SetConfigDefaults(v *viper.Viper) {
 	v.AddConfigPath(".")
 }
 
-// Fill in the options from a viper configuration.
-func (o *Options) FillConfig(v *viper.Viper) {
-	o.ServerName = v.GetString("server_name")
-	o.Domain = v.GetString("domain")
-	o.Hostname = v.GetString("hostname")
-	o.Port = v.GetInt("port")
-	o.ProfPort = v.GetInt("profiler_port")
-	o.DSN = v.GetString("dsn")
-	o.RedisHostname = v.GetString("redis.hostname")
-	o.RedisPort = v.GetInt("redis.port")
-	o.RedisPassword = v.GetString("redis.password")
-	o.RedisDatabase = v.GetInt("redis.database")
-	o.RedisKeyLastDeploy = v.GetString("redis.key_last_deploy")
-	o.RedisKeyQueue = v.GetString("redis.key_queue")
-	o.RedisPollInt = v.GetInt("redis.poll_interval")
-	o.GitRoot = v.GetString("git.root")
-	o.GitRepo = v.GetString("git.repo")
-	o.Project = v.GetString("project")
-	o.TempPath = v.GetString("temp_path")
+// Fill in the options from a viper configuration. Returns an error listing every invalid setting.
+func (o *Options) FillConfig(v *viper.Viper) error {
+	// Secrets can be read from files, and every key can be overridden by an environment variable.
+	c := newConfigSources(v)
+	problems := c.readSecretFiles()
+	o.ConfigFile = v.ConfigFileUsed()
+	o.ServerName = v.GetString(c.key("server_name"))
+	o.Domain = v.GetString(c.key("domain"))
+	o.Hostname = v.GetString(c.key("hostname"))
+	o.Port = v.GetInt(c.key("port"))
+	o.ProfPort = v.GetInt(c.key("profiler_port"))
+	o.DSN = v.GetString(c.key("dsn"))
+	o.RedisHostname = v.GetString(c.key("redis.hostname"))
+	o.RedisPort = v.GetInt(c.key("redis.port"))
+	o.RedisPassword = v.GetString(c.key("redis.password"))
+	o.RedisDatabase = v.GetInt(c.key("redis.database"))
+	o.RedisKeyLastDeploy = v.GetString(c.key("redis.key_last_deploy"))
+	o.RedisKeyQueue = v.GetString(c.key("redis.key_queue"))
+	o.RedisPollInt = v.GetInt(c.key("redis.poll_interval"))
+	o.RedisKeyRateLimit = v.GetString(c.key("redis.key_rate_limit"))
+	o.RedisKeyActive = v.GetString(c.key("redis.key_active"))
+	o.RedisKeyIdempotency = v.GetString(c.key("redis.key_idempotency"))
+	o.IdempotencyWindow = v.GetDuration(c.key("idempotency_window"))
+	o.ShutdownGrace = v.GetDuration(c.key("shutdown_grace"))
+	o.EnvironmentsRefresh = v.GetDuration(c.key("environments_refresh"))
+	o.DeploysPerMinute = v.GetInt(c.key("limits.deploys_per_minute"))
+	o.MaxActiveDeploys = v.GetInt(c.key("limits.max_active_deploys"))
+	o.TLSCertFile = v.GetString(c.key("tls.cert_file"))
+	o.TLSKeyFile = v.GetString(c.key("tls.key_file"))
+	o.TLSMinVersion = v.GetString(c.key("tls.min_version"))
+	o.TLSClientAuth = v.GetString(c.key("tls.client_auth"))
+	o.TLSClientCAFile = v.GetString(c.key("tls.client_ca_file"))
+	o.TLSClientIdentities = v.GetStringMapString(c.key("tls.client_identities"))
+	o.GitRoot = v.GetString(c.key("git.root"))
+	o.GitRepo = v.GetString(c.key("git.repo"))
+	o.Project = v.GetString(c.key("project"))
+	o.TempPath = v.GetString(c.key("temp_path"))
+	o.LogFormat = strings.ToLower(v.GetString(c.key("log_format")))
+	o.LogLevel = v.GetString(c.key("log_level"))
+	o.LogLevels = v.GetStringMapString(c.key("log_levels"))
+	o.RedactHeaders = v.GetStringSlice(c.key("redact.headers"))
+	o.RedactFields = v.GetStringSlice(c.key("redact.fields"))
+	o.RedactPatterns = v.GetStringSlice(c.key("redact.patterns"))
+	o.RedactMaxBody = v.GetInt(c.key("redact.max_body"))
+	o.TracingEndpoint = v.GetString(c.key("tracing.endpoint"))
+	o.TracingServiceName = v.GetString(c.key("tracing.service_name"))
+	o.TracingHeaders = v.GetStringMapString(c.key("tracing.headers"))
+	o.SyslogNetwork = v.GetString(c.key("syslog.network"))
+	o.SyslogAddress = v.GetString(c.key("syslog.address"))
+	o.SyslogFacility = v.GetString(c.key("syslog.facility"))
+	o.SyslogAppName = v.GetString(c.key("syslog.app_name"))
+	o.SyslogCAFile = v.GetString(c.key("syslog.ca_file"))
 
-	o.Environments = make(map[string]map[string]string)
+	o.FreezeWindows = v.GetStringMapStringSlice(c.key("freeze_windows"))
+
+	o.Environments = make(map[string]*EnvironmentConfig)
 	envs := v.GetStringMap("environments")
-	for env, tags := range envs {
-		for k, v := range tags.(map[interface{}]interface{}) {
-			if _, ok := o.Environments[env]; !ok {
-				o.Environments[env] = make(map[string]string)
-			}
-			var value string
-			switch v.(type) {
-			case int:
-				value = strconv.FormatInt(int64(v.(int)), 10)
-			case bool:
-				value = strconv.FormatBool(v.(bool))
-			default:
-				value = v.(string)
-			}
-			o.Environments[env][k.(string)] = value
+	names := make([]string, 0, len(envs))
+	for env := range envs {
+		names = append(names, env)
+	}
+	sort.Strings(names)
+	for _, env := range names {
+		tags, ok := envs[env].(map[interface{}]interface{})
+		if !ok {
+			problems = append(problems, fmt.Sprintf("environments.%s: must be a map of settings.", env))
+			continue
+		}
+		settings := make(map[string]string, len(tags))
+		for k, v := range tags {
+			settings[fmt.Sprint(k)] = settingString(v)
 		}
+		keys, p := c.environmentKeys(env, settings, sourceConfig)
+		c.sources["environments."+env] = sourceConfig
+		problems = append(problems, p...)
+		e, p := parseEnvironment(env, keys)
+		o.Environments[env] = e
+		problems = append(problems, p...)
+	}
+	o.Sources = c.sources
+
+	if len(problems) > 0 {
+		return fmt.Errorf("Invalid config:\n  %s", strings.Join(problems, "\n  "))
 	}
+	return nil
 }
 
 // String is an implentation of the Stringer interface so the structure is returned as a string
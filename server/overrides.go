@@ -0,0 +1,155 @@
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// Config keys that hold secrets. Each can be read from the file named by the key with a _file
+// suffix (ex: dsn_file: /run/secrets/dsn), so the secret is not kept in the config.
+var secretKeys = []string{"dsn", "redis.password"}
+
+// Environment settings that hold secrets and can also be read from a file.
+var secretEnvironmentKeys = []string{"registry_username", "registry_password", "etcd_password"}
+
+// Characters of an environment name that are not allowed in an environment variable name.
+var invalidEnvVarChars = regexp.MustCompile(`[^A-Z0-9]+`)
+
+// configSources reads config values and records where each one came from.
+type configSources struct {
+	v       *viper.Viper      // Config with the defaults and environment variable overrides.
+	file    *viper.Viper      // Config file only, to tell file values from defaults. Nil if no file.
+	sources map[string]string // Source by config key.
+}
+
+// optionSecrets returns the secret values resolved in the options, from the config, environment
+// variables, secret files or the DB: the DSN read from a file, the DSN password, the redis password
+// and the registry and etcd passwords of each environment.
+func optionSecrets(o *Options) []string {
+	secrets := []string{o.RedisPassword}
+	if strings.HasPrefix(o.Sources["dsn"], sourceFile) {
+		secrets = append(secrets, o.DSN)
+	}
+	// The password of a DSN is between the user and the last @. The default one is not a secret.
+	if i := strings.LastIndex(o.DSN, "@"); i > 0 && o.Sources["dsn"] != sourceDefault {
+		if j := strings.Index(o.DSN[:i], ":"); j >= 0 {
+			secrets = append(secrets, o.DSN[j+1:i])
+		}
+	}
+	for _, e := range o.Environments {
+		secrets = append(secrets, e.RegistryPassword, e.EtcdPassword)
+	}
+	return secrets
+}
+
+// newConfigSources is a factory function that returns a config reader. The config file is read
+// again on its own to tell which values it sets.
+func newConfigSources(v *viper.Viper) *configSources {
+	c := &configSources{v: v, sources: make(map[string]string)}
+	if name := v.ConfigFileUsed(); name != "" {
+		f := viper.New()
+		f.SetConfigFile(name)
+		if err := f.ReadInConfig(); err == nil {
+			c.file = f
+		}
+	}
+	return c
+}
+
+// key records the source of a config key and returns the key.
+func (c *configSources) key(k string) string {
+	if _, ok := c.sources[k]; ok {
+		return k
+	}
+	switch {
+	case os.Getenv(envVarName(k)) != "":
+		c.sources[k] = sourceEnv + envVarName(k)
+	case c.file != nil && c.file.IsSet(k):
+		c.sources[k] = sourceConfig
+	default:
+		c.sources[k] = sourceDefault
+	}
+	return k
+}
+
+// readSecretFiles sets each secret key that has a _file key from the contents of that file. A
+// value set directly by an environment variable takes precedence over the file.
+func (c *configSources) readSecretFiles() []string {
+	var problems []string
+	for _, k := range secretKeys {
+		if os.Getenv(envVarName(k)) != "" {
+			continue
+		}
+		path := c.v.GetString(k + secretFileSuffix)
+		if path == "" {
+			continue
+		}
+		value, err := readSecretFile(path)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s%s: %s", k, secretFileSuffix, err))
+			continue
+		}
+		c.v.Set(k, value)
+		c.sources[k] = sourceFile + path
+	}
+	return problems
+}
+
+// environmentKeys returns the settings of an environment from the given source (the config or the
+// DB), overridden by environment variables (ex: DDS_ENVIRONMENTS_PROD_MACHINE) and secret files.
+func (c *configSources) environmentKeys(env string, settings map[string]string, source string) (map[string]string,
+	[]string) {
+	var problems []string
+	keys := make(map[string]string, len(settings))
+	for k, v := range settings {
+		keys[k] = v
+		c.sources[fmt.Sprintf("environments.%s.%s", env, k)] = source
+	}
+	for _, k := range environmentSettings {
+		name := envVarName(fmt.Sprintf("environments.%s.%s", env, k))
+		if value := os.Getenv(name); value != "" {
+			keys[k] = value
+			c.sources[fmt.Sprintf("environments.%s.%s", env, k)] = sourceEnv + name
+		}
+	}
+	for _, k := range secretEnvironmentKeys {
+		fileKey := k + secretFileSuffix
+		path := keys[fileKey]
+		if name := envVarName(fmt.Sprintf("environments.%s.%s", env, fileKey)); os.Getenv(name) != "" {
+			path = os.Getenv(name)
+		}
+		delete(keys, fileKey)
+		delete(c.sources, fmt.Sprintf("environments.%s.%s", env, fileKey))
+		if path == "" || os.Getenv(envVarName(fmt.Sprintf("environments.%s.%s", env, k))) != "" {
+			continue
+		}
+		value, err := readSecretFile(path)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("environments.%s.%s: %s", env, fileKey, err))
+			continue
+		}
+		keys[k] = value
+		c.sources[fmt.Sprintf("environments.%s.%s", env, k)] = sourceFile + path
+	}
+	return keys, problems
+}
+
+// envVarName returns the environment variable that overrides a config key (ex: redis.password is
+// DDS_REDIS_PASSWORD).
+func envVarName(key string) string {
+	return configEnvPrefix + "_" + strings.Trim(invalidEnvVarChars.ReplaceAllString(strings.ToUpper(key), "_"), "_")
+}
+
+// readSecretFile returns the contents of a secret file without the trailing newline.
+func readSecretFile(path string) (string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(b), "\r\n"), nil
+}
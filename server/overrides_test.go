@@ -0,0 +1,94 @@
+package server
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestFillConfigOverrides(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, data string) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+			t.Fatalf("Unexpected error writing %s: %s", name, err)
+		}
+		return path
+	}
+	dsnFile := write("dsn", "user:secret@tcp(db:3306)/deploys\n")
+	registryFile := write("registry", "hunter2\n")
+	config := write("config.yml", `
+port: 9000
+dsn: "plain:text@tcp(db:3306)/deploys"
+dsn_file: `+dsnFile+`
+environments:
+  prod:
+    machine: prod-master
+    docker_registry: registry.example.com
+    registry_username: deployer
+    registry_password_file: `+registryFile+`
+`)
+	t.Setenv("DDS_REDIS_HOSTNAME", "redis.internal")
+	t.Setenv("DDS_ENVIRONMENTS_PROD_MACHINE", "prod-master-2")
+
+	fill := func() *Options {
+		o := &Options{}
+		v := viper.New()
+		o.SetConfigDefaults(v)
+		v.SetConfigFile(config)
+		if err := v.ReadInConfig(); err != nil {
+			t.Fatalf("Unexpected error reading config: %s", err)
+		}
+		if err := o.FillConfig(v); err != nil {
+			t.Fatalf("Unexpected error filling config: %s", err)
+		}
+		return o
+	}
+	o := fill()
+
+	if o.DSN != "user:secret@tcp(db:3306)/deploys" || o.RedisHostname != "redis.internal" || o.Port != 9000 {
+		t.Errorf("Unexpected options: dsn %s, redis %s, port %d", o.DSN, o.RedisHostname, o.Port)
+	}
+	prod := o.Environments["prod"]
+	if prod.Machine != "prod-master-2" || prod.RegistryPassword != "hunter2" {
+		t.Errorf("Unexpected prod environment: %+v", prod)
+	}
+	for key, source := range map[string]string{
+		"dsn":                                 sourceFile + dsnFile,
+		"redis.hostname":                      sourceEnv + "DDS_REDIS_HOSTNAME",
+		"port":                                sourceConfig,
+		"domain":                              sourceDefault,
+		"environments.prod.machine":           sourceEnv + "DDS_ENVIRONMENTS_PROD_MACHINE",
+		"environments.prod.registry_password": sourceFile + registryFile,
+		"environments.prod.docker_registry":   sourceConfig,
+	} {
+		if o.Sources[key] != source {
+			t.Errorf("Expected source of %s to be %s, received %s.", key, source, o.Sources[key])
+		}
+	}
+	if _, ok := o.Sources["environments.prod.registry_password_file"]; ok {
+		t.Errorf("A secret file key should not be reported as a setting.")
+	}
+
+	// A value set directly in the environment wins over its secret file.
+	t.Setenv("DDS_DSN", "env:dsn@tcp(db:3306)/deploys")
+	o = fill()
+	if o.DSN != "env:dsn@tcp(db:3306)/deploys" || o.Sources["dsn"] != sourceEnv+"DDS_DSN" {
+		t.Errorf("Expected the DSN from the environment, received %s from %s.", o.DSN, o.Sources["dsn"])
+	}
+}
+
+func TestEnvVarName(t *testing.T) {
+	t.Parallel()
+	for key, expected := range map[string]string{
+		"dsn":                                  "DDS_DSN",
+		"redis.password":                       "DDS_REDIS_PASSWORD",
+		"environments.us-east.docker_registry": "DDS_ENVIRONMENTS_US_EAST_DOCKER_REGISTRY",
+	} {
+		if name := envVarName(key); name != expected {
+			t.Errorf("Expected %s, received %s.", expected, name)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/composer22/docker-deploy-server/db"
+	"github.com/composer22/docker-deploy-server/metrics"
+)
+
+// serverMetrics holds the Prometheus metrics for the API and the deploy worker.
+type serverMetrics struct {
+	registry     *metrics.Registry     // Registry of all the metrics below.
+	requests     *metrics.CounterVec   // HTTP requests by route and status code.
+	latency      *metrics.HistogramVec // HTTP request latency by route and status code.
+	deploys      *metrics.CounterVec   // Deploys by environment, image and outcome.
+	stepDuration *metrics.HistogramVec // Deploy step duration by step and environment.
+	queueDepth   *metrics.Gauge        // Number of deploys waiting in the queue.
+	queueAge     *metrics.Gauge        // Age of the oldest deploy waiting in the queue.
+	workerBusy   *metrics.Gauge        // Is the deploy worker running a deploy?
+	redisErrors  *metrics.CounterVec   // Redis errors by component.
+	mu           sync.Mutex            // For locking access to the database connections.
+	dbs          []*db.DBConnect       // Database connections to count errors from.
+}
+
+// newServerMetrics is a factory function that returns the metrics for a server.
+func newServerMetrics() *serverMetrics {
+	r := metrics.NewRegistry()
+	m := &serverMetrics{
+		registry: r,
+		requests: r.NewCounterVec(metricsNamespace+"_http_requests_total",
+			"HTTP requests by route and status code.", "route", "code"),
+		latency: r.NewHistogramVec(metricsNamespace+"_http_request_duration_seconds",
+			"HTTP request latency by route and status code.", metrics.HTTPBuckets, "route", "code"),
+		deploys: r.NewCounterVec(metricsNamespace+"_deploys_total",
+			"Deploys by environment, image and outcome.", "environment", "image", "outcome"),
+		stepDuration: r.NewHistogramVec(metricsNamespace+"_deploy_step_duration_seconds",
+			"Deploy step duration by step and environment.", metrics.DeployBuckets, "step", "environment"),
+		queueDepth: r.NewGauge(metricsNamespace+"_queue_depth",
+			"Number of deploys waiting in the queue."),
+		queueAge: r.NewGauge(metricsNamespace+"_queue_oldest_age_seconds",
+			"Age of the oldest deploy waiting in the queue."),
+		workerBusy: r.NewGauge(metricsNamespace+"_worker_busy",
+			"1 if the deploy worker is running a deploy, 0 if idle."),
+		redisErrors: r.NewCounterVec(metricsNamespace+"_redis_errors_total",
+			"Redis errors by component.", "component"),
+	}
+	r.NewCounterFunc(metricsNamespace+"_db_errors_total", "Database errors.", m.dbErrors)
+	return m
+}
+
+// addDB adds a database connection to count errors from.
+func (m *serverMetrics) addDB(d *db.DBConnect) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.dbs = append(m.dbs, d)
+}
+
+// dbErrors returns the total errors of all database connections.
+func (m *serverMetrics) dbErrors() float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var total int64
+	for _, d := range m.dbs {
+		total += d.ErrorCount()
+	}
+	return float64(total)
+}
+
+// observeRequest records a completed HTTP request.
+func (m *serverMetrics) observeRequest(path string, code int, elapsed time.Duration) {
+	route, status := routeLabel(path), strconv.Itoa(code)
+	m.requests.Inc(route, status)
+	m.latency.Observe(elapsed.Seconds(), route, status)
+}
+
+// routeLabel returns the route pattern for a request path so IDs do not become labels.
+func routeLabel(path string) string {
+	switch path {
+	case httpRouteV1Health, httpRouteV1Ready, httpRouteV1Info, httpRouteV1Metrics, httpRouteV1Prometheus,
+		httpRouteV1Deploy, httpRouteV1Freeze, httpRouteV1LogLevel, httpRouteV1Stats, httpRouteV1Environments:
+		return path
+	}
+	for _, prefix := range []string{httpRouteV1DeployAction, httpRouteV1Status, httpRouteV1Environment} {
+		if strings.HasPrefix(path, prefix) {
+			return prefix
+		}
+	}
+	return "other"
+}
+
+// statusRecorder is a http.ResponseWriter that records the status code of the response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int // Status code written.
+}
+
+// WriteHeader records the status code before writing it.
+func (s *statusRecorder) WriteHeader(code int) {
+	s.status = code
+	s.ResponseWriter.WriteHeader(code)
+}
+
+// Write records an implicit 200 status before writing the body.
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	return s.ResponseWriter.Write(b)
+}
+
+// prometheusHandler handles a Prometheus scrape of the server metrics.
+func (s *Server) prometheusHandler(w http.ResponseWriter, r *http.Request) {
+	if s.invalidMethod(w, r, httpGet) || s.invalidAuth(w, r) {
+		return
+	}
+	s.updateQueueMetrics()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	s.metrics.registry.WriteTo(w)
+}
+
+// updateQueueMetrics reads the depth of the queue and the age of its oldest deploy from redis.
+func (s *Server) updateQueueMetrics() {
+	depth, err := s.redis.LLen(s.options().RedisKeyQueue).Result()
+	if err != nil {
+		s.metrics.redisErrors.Inc("api")
+		return
+	}
+	s.metrics.queueDepth.Set(float64(depth))
+
+	// Deploys are pushed on the right, so the oldest is on the left.
+	var age float64
+	if depth > 0 {
+		var q DeployRequest
+		item, err := s.redis.LIndex(s.options().RedisKeyQueue, 0).Result()
+		if err == nil && json.Unmarshal([]byte(item), &q) == nil && q.QueuedAt > 0 {
+			age = time.Since(time.Unix(q.QueuedAt, 0)).Seconds()
+		}
+	}
+	s.metrics.queueAge.Set(age)
+}
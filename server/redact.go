@@ -0,0 +1,198 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// redactor masks secrets in request logs and in script output stored in deploy logs.
+type redactor struct {
+	headers  map[string]bool  // Canonical header names whose values are masked.
+	fields   map[string]bool  // Lower case JSON body fields and query params whose values are masked.
+	patterns []*regexp.Regexp // Patterns masked in free text. Groups 1 and 2, if any, are kept around the mask.
+	maxBody  int              // Maximum body bytes logged (0 = unlimited).
+	keyValue *regexp.Regexp   // Matches key=value or key: value pairs of the masked fields.
+
+	mu      sync.RWMutex // For locking access to the secrets.
+	secrets []string     // Secret values of the config, masked wherever they appear. Longest first.
+}
+
+// Default secrets in free text: credentials in URLs, auth headers and password flags (ex: docker login -p).
+var defaultRedactPatterns = []string{
+	`(?i)(://[^/\s:@]+:)[^/\s@]+(@)`,
+	`(?i)(authorization:\s*(?:bearer|basic)\s+)\S+`,
+	`(?i)((?:^|\s)(?:-p|--password)(?:\s+|=))\S+`,
+}
+
+// newRedactor is a factory function that returns a redactor from the options.
+func newRedactor(o *Options) (*redactor, error) {
+	rd := &redactor{
+		headers: make(map[string]bool),
+		fields:  make(map[string]bool),
+		maxBody: o.RedactMaxBody,
+	}
+	for _, h := range append(strings.Split(DefaultRedactHeaders, ","), o.RedactHeaders...) {
+		if h = strings.TrimSpace(h); h != "" {
+			rd.headers[http.CanonicalHeaderKey(h)] = true
+		}
+	}
+	var names []string
+	for _, f := range append(strings.Split(DefaultRedactFields, ","), o.RedactFields...) {
+		if f = strings.ToLower(strings.TrimSpace(f)); f != "" && !rd.fields[f] {
+			rd.fields[f] = true
+			names = append(names, regexp.QuoteMeta(f))
+		}
+	}
+	rd.keyValue = regexp.MustCompile(fmt.Sprintf(`(?i)(\b[\w.-]*(?:%s)[\w.-]*["']?\s*[=:]\s*)("[^"]*"|'[^']*'|[^\s,;&"']+)`,
+		strings.Join(names, "|")))
+	for _, p := range append(defaultRedactPatterns, o.RedactPatterns...) {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid redact pattern '%s': %s", p, err)
+		}
+		rd.patterns = append(rd.patterns, re)
+	}
+	rd.setSecrets(o)
+	return rd, nil
+}
+
+// setSecrets replaces the secret values masked with those of the options. It is called whenever the
+// options change, as the environments and their passwords can.
+func (rd *redactor) setSecrets(o *Options) {
+	var secrets []string
+	seen := make(map[string]bool)
+	for _, s := range optionSecrets(o) {
+		// Very short values would mask ordinary text.
+		if len(s) >= minSecretLength && !seen[s] {
+			seen[s] = true
+			secrets = append(secrets, s)
+		}
+	}
+	// A secret that contains another is masked first.
+	sort.Slice(secrets, func(i, j int) bool { return len(secrets[i]) > len(secrets[j]) })
+	rd.mu.Lock()
+	rd.secrets = secrets
+	rd.mu.Unlock()
+}
+
+// text masks secrets in free text such as script output.
+func (rd *redactor) text(s string) string {
+	rd.mu.RLock()
+	for _, secret := range rd.secrets {
+		s = strings.Replace(s, secret, redactedValue, -1)
+	}
+	rd.mu.RUnlock()
+	s = rd.keyValue.ReplaceAllString(s, "${1}"+redactedValue)
+	for _, re := range rd.patterns {
+		switch re.NumSubexp() {
+		case 0:
+			s = re.ReplaceAllString(s, redactedValue)
+		case 1:
+			s = re.ReplaceAllString(s, "${1}"+redactedValue)
+		default:
+			s = re.ReplaceAllString(s, "${1}"+redactedValue+"${2}")
+		}
+	}
+	return s
+}
+
+// header returns a copy of the header with the values of masked headers replaced.
+func (rd *redactor) header(h http.Header) http.Header {
+	if h == nil {
+		return nil
+	}
+	c := make(http.Header, len(h))
+	for k, v := range h {
+		if rd.headers[http.CanonicalHeaderKey(k)] {
+			c[k] = []string{redactedValue}
+			continue
+		}
+		c[k] = v
+	}
+	return c
+}
+
+// url returns a copy of the URL with the values of masked query params replaced.
+func (rd *redactor) url(u *url.URL) *url.URL {
+	if u == nil || u.RawQuery == "" {
+		return u
+	}
+	c := *u
+	q := c.Query()
+	for k := range q {
+		if rd.fields[strings.ToLower(k)] {
+			q.Set(k, redactedValue)
+		}
+	}
+	c.RawQuery = q.Encode()
+	return &c
+}
+
+// body returns a request body that is safe to log. Binary bodies are replaced with their size,
+// masked JSON fields are replaced, and the result is capped at the maximum body size.
+func (rd *redactor) body(contentType string, b []byte) string {
+	if len(b) == 0 {
+		return ""
+	}
+	if isBinary(contentType, b) {
+		return fmt.Sprintf("[binary body %d bytes]", len(b))
+	}
+
+	var s string
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err == nil {
+		j, _ := json.Marshal(rd.jsonValue(v))
+		s = string(j)
+	} else {
+		s = rd.text(string(b))
+	}
+
+	if rd.maxBody > 0 && len(s) > rd.maxBody {
+		cut := rd.maxBody
+		for cut > 0 && !utf8.RuneStart(s[cut]) {
+			cut--
+		}
+		s = fmt.Sprintf("%s...[truncated %d bytes]", s[:cut], len(s)-cut)
+	}
+	return s
+}
+
+// jsonValue masks the values of masked fields anywhere in a decoded JSON value.
+func (rd *redactor) jsonValue(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for k, e := range t {
+			if rd.fields[strings.ToLower(k)] {
+				t[k] = redactedValue
+			} else {
+				t[k] = rd.jsonValue(e)
+			}
+		}
+	case []interface{}:
+		for i, e := range t {
+			t[i] = rd.jsonValue(e)
+		}
+	case string:
+		return rd.text(t)
+	}
+	return v
+}
+
+// isBinary returns true if a body should not be logged as text.
+func isBinary(contentType string, b []byte) bool {
+	ct := strings.ToLower(contentType)
+	switch {
+	case strings.HasPrefix(ct, "multipart/"), strings.HasPrefix(ct, "image/"),
+		strings.HasPrefix(ct, "audio/"), strings.HasPrefix(ct, "video/"),
+		strings.Contains(ct, "octet-stream"), strings.Contains(ct, "zip"):
+		return true
+	}
+	return !utf8.Valid(b) || strings.IndexByte(string(b), 0) >= 0
+}
@@ -0,0 +1,228 @@
+package server
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/spf13/viper"
+)
+
+// Options that are only read at startup. A reload keeps their current values and reports that a
+// restart is needed to change them.
+var restartOptions = map[string]bool{
+	"Hostname":            true,
+	"Port":                true,
+	"ProfPort":            true,
+	"DSN":                 true,
+	"RedisHostname":       true,
+	"RedisPort":           true,
+	"RedisPassword":       true,
+	"RedisDatabase":       true,
+	"RedisKeyLastDeploy":  true,
+	"RedisKeyQueue":       true,
+	"RedisKeyRateLimit":   true,
+	"RedisKeyActive":      true,
+	"RedisKeyIdempotency": true,
+	"EnvironmentsRefresh": true,
+	"TLSCertFile":         true,
+	"TLSKeyFile":          true,
+	"TLSMinVersion":       true,
+	"TLSClientAuth":       true,
+	"TLSClientCAFile":     true,
+	"LogFormat":           true,
+	"RedactHeaders":       true,
+	"RedactFields":        true,
+	"RedactPatterns":      true,
+	"RedactMaxBody":       true,
+	"TracingEndpoint":     true,
+	"TracingServiceName":  true,
+	"TracingHeaders":      true,
+	"SyslogNetwork":       true,
+	"SyslogAddress":       true,
+	"SyslogFacility":      true,
+	"SyslogAppName":       true,
+	"SyslogCAFile":        true,
+}
+
+// loadOptions reads the config file again into new options. The command line flags are kept from
+// the current options.
+func loadOptions(cur *Options) (*Options, error) {
+	o := &Options{ConfigPath: cur.ConfigPath, ConfigPrefix: cur.ConfigPrefix, Debug: cur.Debug}
+	v := viper.New()
+	o.SetConfigDefaults(v)
+	if err := v.ReadInConfig(); err != nil {
+		return nil, err
+	}
+	if err := o.FillConfig(v); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// reloadConfig reads and validates the config file, then swaps in the new options. Deploys already
+// running keep the options they started with. The result is logged and written to the audit log.
+func (s *Server) reloadConfig(actor string) error {
+	s.reload.Lock()
+	defer s.reload.Unlock()
+
+	cur := s.options()
+	o, err := loadOptions(cur)
+	var freezes map[string][]*freezeWindow
+	if err == nil {
+		freezes, err = parseFreezeWindows(o.FreezeWindows)
+	}
+	if err == nil {
+		_, _, err = parseLogLevels(o)
+	}
+	if err != nil {
+		s.log.Errorf("Config reload by %s failed. Keeping the current config: %s", actor, err)
+		s.db.Audit(auditConfigReload, actor, fmt.Sprintf("failed: %s", err))
+		return err
+	}
+
+	restart := keepRestartOptions(cur, o)
+	merged, err := s.dbEnvironments(o)
+	if err != nil {
+		s.log.Errorf("Config reload by %s failed reading the environments from the DB. Keeping the current config: %s",
+			actor, err)
+		s.db.Audit(auditConfigReload, actor, fmt.Sprintf("failed: %s", err))
+		return err
+	}
+	summary := configDiff(cur, merged)
+	s.mu.Lock()
+	s.opt, s.fileOpt, s.freezes = merged, o, freezes
+	s.redact.setSecrets(merged)
+	s.mu.Unlock()
+	if logLevelsChanged(cur, merged) {
+		s.applyLogLevels(merged) // Levels changed at runtime are kept unless the config changes them.
+	}
+
+	if len(restart) > 0 {
+		summary = append(summary, fmt.Sprintf("restart required for: %s", strings.Join(restart, ", ")))
+	}
+	if len(summary) == 0 {
+		summary = []string{"no changes"}
+	}
+	detail := strings.Join(summary, "; ")
+	s.log.Noticef("Config reloaded from %s by %s: %s", o.ConfigFile, actor, detail)
+	s.db.Audit(auditConfigReload, actor, fmt.Sprintf("ok: %s", detail))
+	return nil
+}
+
+// logLevelsChanged returns true if the configured base or module log levels differ.
+func logLevelsChanged(cur *Options, o *Options) bool {
+	return cur.LogLevel != o.LogLevel || cur.Debug != o.Debug || !reflect.DeepEqual(cur.LogLevels, o.LogLevels)
+}
+
+// keepRestartOptions copies the options only read at startup from the current options into the
+// new ones, and returns the names of those that were changed in the file.
+func keepRestartOptions(cur *Options, o *Options) []string {
+	var changed []string
+	c, n := reflect.ValueOf(cur).Elem(), reflect.ValueOf(o).Elem()
+	for i := 0; i < c.NumField(); i++ {
+		f := c.Type().Field(i)
+		if !restartOptions[f.Name] {
+			continue
+		}
+		if !reflect.DeepEqual(c.Field(i).Interface(), n.Field(i).Interface()) {
+			changed = append(changed, optionName(f))
+			n.Field(i).Set(c.Field(i))
+		}
+	}
+	return changed
+}
+
+// configDiff returns a summary of the settings changed between two options. Values are left out
+// because they can hold secrets.
+func configDiff(cur *Options, o *Options) []string {
+	var summary, settings []string
+	c, n := reflect.ValueOf(cur).Elem(), reflect.ValueOf(o).Elem()
+	for i := 0; i < c.NumField(); i++ {
+		f := c.Type().Field(i)
+		switch f.Name {
+		case "Environments", "Sources", "ConfigFile":
+			continue
+		}
+		if !reflect.DeepEqual(c.Field(i).Interface(), n.Field(i).Interface()) {
+			settings = append(settings, optionName(f))
+		}
+	}
+
+	var added, removed, changed []string
+	for name, e := range o.Environments {
+		if old, ok := cur.Environments[name]; !ok {
+			added = append(added, name)
+		} else if !reflect.DeepEqual(old, e) {
+			changed = append(changed, name)
+		}
+	}
+	for name := range cur.Environments {
+		if _, ok := o.Environments[name]; !ok {
+			removed = append(removed, name)
+		}
+	}
+	for _, l := range []struct {
+		label string
+		names []string
+	}{
+		{"environments added", added},
+		{"environments removed", removed},
+		{"environments changed", changed},
+		{"settings changed", settings},
+	} {
+		if len(l.names) > 0 {
+			sort.Strings(l.names)
+			summary = append(summary, fmt.Sprintf("%s: %s", l.label, strings.Join(l.names, ", ")))
+		}
+	}
+	return summary
+}
+
+// optionName returns the name of an option in messages: its JSON name, or the field name for
+// options hidden from JSON.
+func optionName(f reflect.StructField) string {
+	if name := strings.Split(f.Tag.Get("json"), ",")[0]; name != "" && name != "-" {
+		return name
+	}
+	return f.Name
+}
+
+// watchConfig reloads the config when its file is written or replaced, until the server stops.
+// The directory is watched so editors that save by renaming a new file are seen.
+func (s *Server) watchConfig(file string) {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		s.log.Errorf("Unable to watch the config file: %s", err)
+		return
+	}
+	file = filepath.Clean(file)
+	if err := w.Add(filepath.Dir(file)); err != nil {
+		s.log.Errorf("Unable to watch the config file: %s", err)
+		w.Close()
+		return
+	}
+	go func() {
+		defer w.Close()
+		var settle <-chan time.Time
+		for {
+			select {
+			case <-s.done:
+				return
+			case ev := <-w.Events:
+				if filepath.Clean(ev.Name) == file && ev.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) != 0 {
+					settle = time.After(configReloadDelay)
+				}
+			case err := <-w.Errors:
+				s.log.Errorf("Config file watch error: %s", err)
+			case <-settle:
+				settle = nil
+				s.reloadConfig(actorConfigWatch)
+			}
+		}
+	}()
+}
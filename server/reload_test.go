@@ -0,0 +1,106 @@
+package server
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/composer22/docker-deploy-server/db"
+	"github.com/composer22/docker-deploy-server/logger"
+)
+
+func TestKeepRestartOptions(t *testing.T) {
+	t.Parallel()
+	cur := &Options{Port: 8080, DSN: "old", ServerName: "a"}
+	o := &Options{Port: 9090, DSN: "new", ServerName: "b"}
+	restart := keepRestartOptions(cur, o)
+	if !reflect.DeepEqual(restart, []string{"port", "DSN"}) {
+		t.Errorf("Unexpected restart options: %v", restart)
+	}
+	if o.Port != 8080 || o.DSN != "old" || o.ServerName != "b" {
+		t.Errorf("Restart options should be kept and others replaced: %+v", o)
+	}
+}
+
+func TestConfigDiff(t *testing.T) {
+	t.Parallel()
+	cur := &Options{
+		LogLevel: "info",
+		Environments: map[string]*EnvironmentConfig{
+			"dev":  {Machine: "dev", NumContainers: 2},
+			"prod": {Machine: "prod", NumContainers: 2},
+			"old":  {Machine: "old"},
+		},
+	}
+	o := &Options{
+		LogLevel: "debug",
+		Environments: map[string]*EnvironmentConfig{
+			"dev":  {Machine: "dev", NumContainers: 2},
+			"prod": {Machine: "prod", NumContainers: 4},
+			"qa":   {Machine: "qa"},
+		},
+	}
+	expected := []string{
+		"environments added: qa",
+		"environments removed: old",
+		"environments changed: prod",
+		"settings changed: logLevel",
+	}
+	if summary := configDiff(cur, o); !reflect.DeepEqual(summary, expected) {
+		t.Errorf("Expected %v, received %v", expected, summary)
+	}
+	if summary := configDiff(o, o); len(summary) != 0 {
+		t.Errorf("Expected no changes, received %v", summary)
+	}
+}
+
+func TestReloadKeepsRuntimeLogLevels(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	write := func(config string) {
+		if err := ioutil.WriteFile(filepath.Join(dir, "config.yaml"), []byte(config), 0600); err != nil {
+			t.Fatalf("Unable to write the config: %s", err)
+		}
+	}
+	write("server_name: a\nlog_level: info\nlog_levels:\n  http: warning\n")
+	cur, err := loadOptions(&Options{ConfigPath: dir, ConfigPrefix: "config"})
+	if err != nil {
+		t.Fatalf("Unable to load the config: %s", err)
+	}
+	rd, _ := newRedactor(cur)
+	conn, mock, _ := sqlmock.New()
+	defer conn.Close()
+	s := &Server{opt: cur, fileOpt: cur, db: db.NewDBConnectFromDB(conn), redact: rd,
+		log: logger.New(logger.Info, false)}
+	s.applyLogLevels(cur)
+	reload := func() {
+		t.Helper()
+		mock.ExpectQuery("SELECT name, settings FROM environments").
+			WillReturnRows(sqlmock.NewRows([]string{"name", "settings"}))
+		mock.ExpectExec("INSERT INTO audit_log").WillReturnResult(sqlmock.NewResult(1, 1))
+		if err := s.reloadConfig("test"); err != nil {
+			t.Fatalf("Unable to reload: %s", err)
+		}
+	}
+
+	// Levels changed at runtime survive a reload that does not change them.
+	s.log.SetLogLevel(logger.Debug)
+	s.log.SetModuleLevel(moduleDeploy, logger.Debug)
+	write("server_name: b\nlog_level: info\nlog_levels:\n  http: warning\n")
+	reload()
+	if l := s.currentLogLevels(); l.Level != "debug" || l.Modules[moduleDeploy] != "debug" || l.Modules[moduleHTTP] != "warning" {
+		t.Errorf("Expected the runtime levels kept, received %+v", l)
+	}
+
+	// A change to the levels in the config applies them all.
+	write("server_name: b\nlog_level: info\nlog_levels:\n  http: error\n")
+	reload()
+	if l := s.currentLogLevels(); l.Level != "info" || len(l.Modules) != 1 || l.Modules[moduleHTTP] != "error" {
+		t.Errorf("Expected the configured levels, received %+v", l)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unexpected database calls: %s", err)
+	}
+}
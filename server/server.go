@@ -3,6 +3,7 @@ package server
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -13,31 +14,44 @@ import (
 	"os/signal"
 	"path/filepath"
 	"runtime"
-	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	// Allow dynamic profiling.
 	_ "net/http/pprof"
 
 	"github.com/composer22/docker-deploy-server/db"
+	"github.com/composer22/docker-deploy-server/etcd2"
 	"github.com/composer22/docker-deploy-server/logger"
+	"github.com/composer22/docker-deploy-server/tracing"
 	redis "gopkg.in/redis.v3"
 )
 
 // Server is the main structure that represents a server instance.
 type Server struct {
-	mu      sync.RWMutex   // For locking access to server attributes.
-	wg      sync.WaitGroup // Synchronize shutdown pending jobs.
-	running bool           // Is the server running?
-	opt     *Options       // Original options used to create the server.
-	db      *db.DBConnect  // Database connection.
-	redis   *redis.Client  // Redis connection.
-	stats   *Status        // Server statistics since it started.
-	srvr    *http.Server   // HTTP server.
-	done    chan bool      // A channel to signal to environments to close down.
-	log     *logger.Logger // Log instance for recording error and other messages.
+	mu      sync.RWMutex               // For locking access to server attributes.
+	reload  sync.Mutex                 // Serializes config reloads.
+	wg      sync.WaitGroup             // Synchronize shutdown pending jobs.
+	running bool                       // Is the server running?
+	opt     *Options                   // Original options used to create the server.
+	fileOpt *Options                   // Options from the config file, before the environments in the DB.
+	db      *db.DBConnect              // Database connection.
+	redis   *redis.Client              // Redis connection.
+	stats   *Status                    // Server statistics since it started.
+	metrics *serverMetrics             // Prometheus metrics for the API and deploys.
+	freezes map[string][]*freezeWindow // Configured deploy freeze windows per environment.
+	syslog  *logger.SyslogWriter       // Optional syslog sink for the log.
+	srvr    *http.Server               // HTTP server.
+	done    chan bool                  // A channel to signal to environments to close down.
+	stopped chan bool                  // Closed when shutdown has finished.
+	abort   context.CancelFunc         // Stops in-flight deploys when the shutdown grace period ends.
+	log     *logger.Logger             // Log instance for recording error and other messages.
+	httpLog *logger.Logger             // Log for http requests.
+	redact  *redactor                  // Masks secrets in request logs.
+	ready   readyCache                 // Last readiness result, shared by unauthenticated requests.
+	tracer  *tracing.Tracer            // Tracer for request and deploy spans.
 }
 
 // New is a factory function that returns a new server instance.
@@ -46,21 +60,34 @@ func New(o *Options, l *logger.Logger) *Server {
 		running: false,
 		opt:     o,
 		stats:   NewStatus(),
+		metrics: newServerMetrics(),
 		done:    make(chan bool),
+		stopped: make(chan bool),
 		log:     l,
 	}
 
 	if s.opt.Debug {
 		s.log.SetLogLevel(logger.Debug)
 	}
+	if s.opt.LogFormat == logFormatJSON {
+		s.log.SetFormat(logger.FormatJSON)
+	}
 
 	// Setup the routes and server.
 	mux := http.NewServeMux()
 	mux.HandleFunc(httpRouteV1Health, s.healthHandler)
+	mux.HandleFunc(httpRouteV1Ready, s.readyHandler)
 	mux.HandleFunc(httpRouteV1Info, s.infoHandler)
 	mux.HandleFunc(httpRouteV1Metrics, s.metricsHandler)
+	mux.HandleFunc(httpRouteV1Prometheus, s.prometheusHandler)
 	mux.HandleFunc(httpRouteV1Deploy, s.deployHandler)
+	mux.HandleFunc(httpRouteV1DeployAction, s.deployActionHandler)
 	mux.HandleFunc(httpRouteV1Status, s.statusHandler)
+	mux.HandleFunc(httpRouteV1Freeze, s.freezeHandler)
+	mux.HandleFunc(httpRouteV1LogLevel, s.logLevelHandler)
+	mux.HandleFunc(httpRouteV1Stats, s.statsHandler)
+	mux.HandleFunc(httpRouteV1Environments, s.environmentsHandler)
+	mux.HandleFunc(httpRouteV1Environment, s.environmentsHandler)
 	s.srvr = &http.Server{
 		Addr:         fmt.Sprintf("%s:%d", s.opt.Hostname, s.opt.Port),
 		Handler:      &Middleware{serv: s, handler: mux},
@@ -85,8 +112,44 @@ func (s *Server) Start() error {
 	s.handleSignals()
 	s.mu.Lock()
 
-	// Connect to DB and Redis.
+	// Send the log to syslog as well as stdout if configured.
 	var err error
+	if s.syslog, err = newSyslogWriter(s.opt); err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	if s.syslog != nil {
+		s.log.SetSyslog(s.syslog)
+	}
+	s.httpLog = s.log.Module(moduleHTTP)
+
+	// Set the configured log levels.
+	if err = s.applyLogLevels(s.opt); err != nil {
+		s.mu.Unlock()
+		return err
+	}
+
+	// Mask secrets in request and deploy logs.
+	if s.redact, err = newRedactor(s.opt); err != nil {
+		s.mu.Unlock()
+		return err
+	}
+
+	// Trace requests and deploys, exporting spans if a collector is configured.
+	s.tracer, err = newTracer(s.opt)
+	if err != nil {
+		s.mu.Unlock()
+		return err
+	}
+
+	// Validate the freeze windows.
+	s.freezes, err = parseFreezeWindows(s.opt.FreezeWindows)
+	if err != nil {
+		s.mu.Unlock()
+		return err
+	}
+
+	// Connect to DB and Redis.
 	s.db, err = db.NewDBConnect(s.opt.DSN)
 	if err != nil {
 		s.mu.Unlock()
@@ -109,19 +172,55 @@ func (s *Server) Start() error {
 		s.mu.Unlock()
 		return err
 	}
-	d := NewDeployService(s.opt, db, r, s.done, s.log, &s.wg)
+	s.db.SetLogger(s.log.Module(moduleDB))
+	db.SetLogger(s.log.Module(moduleDB))
+
+	// Add the environments managed in the DB, or run with those of the config file if unavailable.
+	s.fileOpt = s.opt
+	if o, err := s.dbEnvironments(s.opt); err != nil {
+		s.log.Errorf("Unable to read the environments from the DB. Using the config file: %s", err)
+	} else {
+		s.opt = o
+	}
+	s.redact.setSecrets(s.opt)
+	s.metrics.addDB(s.db)
+	s.metrics.addDB(db)
+	ctx, abort := context.WithCancel(context.Background())
+	s.abort = abort
+	d := NewDeployService(s.options, s.frozen, db, r, s.done, ctx, s.log.Module(moduleDeploy), &s.wg, s.metrics,
+		s.redact, s.tracer)
 	go d.Run()
 
+	// Reload the config when its file changes, and the environments when they change in the DB.
+	if s.opt.ConfigFile != "" {
+		s.watchConfig(s.opt.ConfigFile)
+	}
+	s.watchEnvironments(s.opt.EnvironmentsRefresh)
+
 	// Pprof http endpoint for the profiler.
 	if s.opt.ProfPort > 0 {
 		s.StartProfiler()
 	}
 
+	// Serve over TLS if a certificate is configured.
+	if s.opt.TLSCertFile != "" {
+		if s.srvr.TLSConfig, err = newTLSConfig(s.opt, s.log); err != nil {
+			s.mu.Unlock()
+			return err
+		}
+	}
+
 	s.stats.Start = time.Now()
 	s.running = true
 	s.mu.Unlock()
-	err = s.srvr.ListenAndServe()
-	if err != nil {
+	if s.srvr.TLSConfig != nil {
+		err = s.srvr.ListenAndServeTLS("", "")
+	} else {
+		err = s.srvr.ListenAndServe()
+	}
+	if err == http.ErrServerClosed {
+		<-s.stopped // Wait for Shutdown to drain the deploys.
+	} else if err != nil {
 		s.log.Emergencyf("Listen and Server Error: %s", err.Error())
 	}
 
@@ -150,10 +249,28 @@ func (s *Server) Shutdown() {
 		return
 	}
 	s.log.Infof("BEGIN server service stop.")
+
+	// Stop accepting requests and let those in progress finish within the grace period.
+	grace := s.options().ShutdownGrace
+	ctx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+	if err := s.srvr.Shutdown(ctx); err != nil {
+		s.log.Warningf("HTTP requests still open at shutdown: %s", err)
+	}
+
+	// Stop popping the queue and give the deploy in progress the rest of the grace period. After that
+	// its scripts are killed and it is requeued to run again after a restart. The lock is not held while
+	// waiting, so the options, /info and reloads are served meanwhile.
+	if !drainWorker(ctx, s.done, &s.wg, s.abort) {
+		s.log.Warningf("Shutdown grace period of %s ended. Stopped the deploy in progress.", grace)
+	}
+	s.abort()
+	if s.tracer != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), tracingShutdownTimeout)
+		s.tracer.Shutdown(ctx)
+		cancel()
+	}
 	s.mu.Lock()
-	s.srvr.SetKeepAlivesEnabled(false)
-	close(s.done)
-	s.wg.Wait()
 	if s.db != nil {
 		s.db.Close()
 	}
@@ -163,15 +280,48 @@ func (s *Server) Shutdown() {
 	s.running = false
 	s.mu.Unlock()
 	s.log.Infof("END server service stop.")
+	if s.syslog != nil {
+		s.syslog.Close()
+	}
+	close(s.stopped)
+}
+
+// drainWorker stops the worker popping the queue and waits for the deploy in progress. When the grace
+// period ends first, the deploy is aborted and waited for. Returns false if the grace period ended.
+func drainWorker(grace context.Context, done chan bool, wg *sync.WaitGroup, abort func()) bool {
+	close(done)
+	drained := make(chan bool)
+	go func() {
+		wg.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+		return true
+	case <-grace.Done():
+		abort()
+		<-drained
+		return false
+	}
 }
 
 // handleSignals responds to operating system interrupts such as application kills.
 func (s *Server) handleSignals() {
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGUSR1)
 	go func() {
 		for sig := range c {
 			s.log.Infof("Server received signal: %v\n", sig)
+			switch sig {
+			case syscall.SIGHUP: // Reload the config, then restore the configured log levels.
+				s.reloadConfig(actorSIGHUP)
+				s.applyLogLevels(s.options())
+				s.log.Noticef("Log levels restored: %s", s.currentLogLevels().Level)
+				continue
+			case syscall.SIGUSR1: // Toggle debug logging.
+				s.toggleDebug()
+				continue
+			}
 			s.Shutdown()
 			s.log.Infof("Server exiting.")
 			os.Exit(0)
@@ -198,9 +348,11 @@ func (s *Server) infoHandler(w http.ResponseWriter, r *http.Request) {
 	defer s.mu.RUnlock()
 	b, _ := json.Marshal(
 		&struct {
-			Options *Options `json:"options"`
+			Options   *Options   `json:"options"`
+			LogLevels *logLevels `json:"logLevels"`
 		}{
-			Options: s.opt,
+			Options:   s.opt,
+			LogLevels: s.currentLogLevels(),
 		})
 	w.Write(b)
 }
@@ -230,7 +382,8 @@ func (s *Server) metricsHandler(w http.ResponseWriter, r *http.Request) {
 
 // deployHandler handles a client request for deploying a service to the cluster.
 func (s *Server) deployHandler(w http.ResponseWriter, r *http.Request) {
-	if s.invalidHeader(w, r) || s.invalidMethod(w, r, httpPost) || s.invalidAuth(w, r) {
+	if s.invalidHeader(w, r) || s.invalidMethod(w, r, httpPost) || s.invalidAuth(w, r) ||
+		s.deployRateLimited(w, r) {
 		return
 	}
 	reqID := w.Header().Get("X-Request-ID")
@@ -246,8 +399,9 @@ func (s *Server) deployHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, InvalidJSONText, http.StatusBadRequest)
 		return
 	}
-	// Is environment deployable from this server?
-	if _, ok := s.opt.Environments[d.Environment]; !ok {
+	// Is environment deployable from this server? The request uses one snapshot of the config.
+	opt := s.options()
+	if _, ok := opt.Environments[d.Environment]; !ok {
 		http.Error(w, InvalidDeployEnv, http.StatusBadRequest)
 		return
 	}
@@ -255,6 +409,34 @@ func (s *Server) deployHandler(w http.ResponseWriter, r *http.Request) {
 	if s.authDeployEnvironment(w, r, d.Environment) {
 		return
 	}
+	// Is this a retry of a previous request? Return the original deploy.
+	idemKey, replayID, err := s.reserveIdempotencyKey(r, reqID, b)
+	if err == errIdempotencyMismatch {
+		http.Error(w, InvalidIdempotencyKey, http.StatusUnprocessableEntity)
+		return
+	}
+	if err != nil {
+		s.metrics.redisErrors.Inc("api")
+		http.Error(w, InvalidDeployCannotQueue, http.StatusServiceUnavailable)
+		return
+	}
+	if replayID != "" {
+		w.Header().Set("Idempotent-Replayed", "true")
+		w.Write([]byte(fmt.Sprintf(`{"deployID":"%s"}`, replayID)))
+		return
+	}
+	queued := false
+	defer func() {
+		if idemKey != "" && !queued {
+			s.redis.Del(idemKey)
+		}
+	}()
+
+	// Is the environment frozen? Only tokens with the override right can deploy.
+	override, blocked := s.freezeOverride(w, r, d.Environment, reqID)
+	if blocked {
+		return
+	}
 	// Is there an image to deploy in the payload?
 	if d.ImageName == "" {
 		http.Error(w, InvalidDeployImage, http.StatusBadRequest)
@@ -263,26 +445,298 @@ func (s *Server) deployHandler(w http.ResponseWriter, r *http.Request) {
 	if d.ImageTag == "" {
 		d.ImageTag = DefaultImageTag
 	}
-	// Format extra meta-data for the deploy.
-	var numCont int
-	if i, err := strconv.ParseInt(s.opt.Environments[d.Environment]["num_containers"], 10, 32); err == nil {
-		numCont = int(i)
+	// Is the environment or the token over its limits? The token's place is released unless the
+	// deploy is queued.
+	if s.envRateLimited(w, d.Environment) || s.activeLimited(w, r, reqID) {
+		return
 	}
-	if d.NumCont == 0 {
-		numCont = DefaultNumCont
+	tracked := false
+	defer func() {
+		if !tracked {
+			s.redis.ZRem(activeDeploysKey(opt.RedisKeyActive, tokenKey(s.authToken(r))), reqID)
+		}
+	}()
+	// Push the payload into the queue.
+	env := opt.environment(d.Environment)
+	payload := NewDeployRequest(reqID, d.ImageName, d.ImageTag, d.Environment, env.EnvTag,
+		strings.Join(env.EtcdEndpoints, ","), env.Machine, env.MetadataMount, env.NumContainers, env.DockerRegistry,
+		env.Swarm)
+	payload.Owner = tokenKey(s.authToken(r))
+	payload.Correlation = correlationID(r)
+	payload.FreezeOverride = override != ""
+
+	// The queue span carries the trace from this request to the worker.
+	qspan := s.startSpan(r, "deploy.queue", tracing.KindProducer)
+	qspan.SetAttribute("deploy.id", payload.DeployID)
+	qspan.SetAttribute("deploy.environment", payload.Environment)
+	qspan.SetAttribute("deploy.image", payload.ImageName)
+	qspan.SetAttribute("deploy.image_tag", payload.ImageTag)
+	defer qspan.Finish()
+	payload.Traceparent = qspan.Context.Traceparent()
+
+	// Protected environments hold the deploy until it is approved.
+	if env.RequiresApproval {
+		if !s.db.PendingDeploy(payload.DeployID, payload.Environment, payload.ImageName, payload.ImageTag,
+			payload.Correlation, fmt.Sprint(payload)) {
+			http.Error(w, InvalidDeployCannotQueue, http.StatusServiceUnavailable)
+			return
+		}
+		queued = true
+		if override != "" {
+			s.db.AppendDeployLog(reqID, fmt.Sprintln(override))
+		}
+		w.Write([]byte(fmt.Sprintf(`{"deployID":"%s","status":%d}`, reqID, db.PendingApproval)))
+		return
 	}
-	swarm, _ := strconv.ParseBool(s.opt.Environments[d.Environment]["swarm"])
 
-	// Push the payload into the queue.
-	payload := NewDeployRequest(reqID, d.ImageName, d.ImageTag, d.Environment, s.opt.Environments[d.Environment]["env_tag"],
-		s.opt.Environments[d.Environment]["etcd_endpoint"], s.opt.Environments[d.Environment]["machine"],
-		s.opt.Environments[d.Environment]["metadata_mount"], numCont, s.opt.Environments[d.Environment]["docker_registry"], swarm)
-	if _, err := s.redis.RPush(s.opt.RedisKeyQueue, fmt.Sprint(payload)).Result(); err != nil {
+	payload.QueuedAt = time.Now().Unix()
+	if _, err := s.redis.RPush(opt.RedisKeyQueue, fmt.Sprint(payload)).Result(); err != nil {
+		s.metrics.redisErrors.Inc("api")
 		http.Error(w, InvalidDeployCannotQueue, http.StatusServiceUnavailable)
 		return
 	}
-	s.db.QueueDeploy(payload.DeployID, payload.Environment, payload.ImageName, payload.ImageTag)
-	w.Write([]byte(fmt.Sprintf(`{"deployID":"%s"}`, reqID)))
+	queued = true
+	tracked = true
+	s.db.QueueDeploy(payload.DeployID, payload.Environment, payload.ImageName, payload.ImageTag, payload.Correlation)
+	if override != "" {
+		s.db.AppendDeployLog(reqID, fmt.Sprintln(override))
+	}
+
+	// Replace older requests for this image that have not started yet.
+	var supersedes []string
+	if env.Coalesce {
+		supersedes = s.coalesceQueued(payload)
+	}
+	b, _ = json.Marshal(
+		&struct {
+			DeployID   string   `json:"deployID"`
+			Supersedes []string `json:"supersedes,omitempty"`
+		}{
+			DeployID:   reqID,
+			Supersedes: supersedes,
+		})
+	w.Write(b)
+}
+
+// deployActionHandler handles a client request to approve or reject a deploy pending approval.
+func (s *Server) deployActionHandler(w http.ResponseWriter, r *http.Request) {
+	if s.invalidHeader(w, r) || s.invalidMethod(w, r, httpPost) || s.invalidAuth(w, r) {
+		return
+	}
+
+	// Path is :id/:action
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, httpRouteV1DeployAction), "/")
+	if len(parts) != 2 || parts[0] == "" ||
+		(parts[1] != deployActionApprove && parts[1] != deployActionReject && parts[1] != deployActionEtcdRollback) {
+		http.Error(w, InvalidDeployAction, http.StatusNotFound)
+		return
+	}
+	deployID, action := parts[0], parts[1]
+	if action == deployActionEtcdRollback {
+		s.rollbackEtcd(w, r, deployID)
+		return
+	}
+
+	// Does the user have the right to approve deploys to this env?
+	if s.authRight(w, r, rightApprove) {
+		return
+	}
+	row, err := s.db.QueryDeploy(deployID)
+	if err != nil {
+		http.Error(w, InvalidDeployID, http.StatusNotFound)
+		return
+	}
+	if s.authDeployEnvironment(w, r, row.Environment) {
+		return
+	}
+	if row.Status != db.PendingApproval {
+		http.Error(w, InvalidDeployNotPending, http.StatusConflict)
+		return
+	}
+
+	switch action {
+	case deployActionApprove:
+		s.approveDeploy(w, r, row)
+	case deployActionReject:
+		s.rejectDeploy(w, r, row)
+	}
+}
+
+// approveDeploy records an approval for a pending deploy and queues the deploy once enough
+// distinct tokens have approved it.
+func (s *Server) approveDeploy(w http.ResponseWriter, r *http.Request, row *db.DeployStatus) {
+	request, err := s.db.QueryDeployRequest(row.DeployID)
+	var queued DeployRequest
+	if err != nil || json.Unmarshal([]byte(request), &queued) != nil {
+		http.Error(w, InvalidDeployCannotApprove, http.StatusServiceUnavailable)
+		return
+	}
+	// The token that requested the deploy cannot approve it.
+	token := s.authToken(r)
+	if queued.Owner == tokenKey(token) {
+		http.Error(w, InvalidDeploySelfApproval, http.StatusForbidden)
+		return
+	}
+	count, err := s.db.ApproveDeploy(row.DeployID, token)
+	if err != nil {
+		http.Error(w, InvalidDeployCannotApprove, http.StatusServiceUnavailable)
+		return
+	}
+	required := s.options().environment(row.Environment).ApprovalsRequired
+	msg := fmt.Sprintf("Approval %d of %d received.", count, required)
+	s.db.AppendDeployLog(row.DeployID, fmt.Sprintf("Approval %d of %d received from '%s'.\n", count, required,
+		s.db.AuthTokenName(token)))
+	status := db.PendingApproval
+
+	if count < required {
+		if !s.db.TransitionDeploy(row.DeployID, db.PendingApproval, db.PendingApproval, msg, "") {
+			http.Error(w, InvalidDeployNotPending, http.StatusConflict)
+			return
+		}
+	} else {
+		// A freeze that started while the deploy waited holds it, unless the last approver can override.
+		// The approval is kept: approving again once the freeze ends queues the deploy.
+		override, blocked := s.freezeOverride(w, r, row.Environment, row.DeployID)
+		if blocked {
+			return
+		}
+		var log string
+		if override != "" {
+			queued.FreezeOverride = true
+			log += fmt.Sprintln(override)
+		}
+		queued.QueuedAt = time.Now().Unix()
+		if sc, err := tracing.ParseTraceparent(queued.Traceparent); err == nil {
+			if span := tracing.SpanFromContext(r.Context()); span != nil {
+				span.AddLink(sc)
+			}
+		}
+		msg = "Deploy approved and queued."
+		if !s.db.TransitionDeploy(row.DeployID, db.PendingApproval, db.Queued, msg, log+fmt.Sprintln(msg)) {
+			http.Error(w, InvalidDeployNotPending, http.StatusConflict)
+			return
+		}
+		if _, err := s.redis.RPush(s.options().RedisKeyQueue, fmt.Sprint(&queued)).Result(); err != nil {
+			s.metrics.redisErrors.Inc("api")
+			msg = "Unable to queue the approved deploy. Approve it again to queue it."
+			s.db.TransitionDeploy(row.DeployID, db.Queued, db.PendingApproval, msg, fmt.Sprintf("ERR: %s\n", msg))
+			http.Error(w, InvalidDeployCannotQueue, http.StatusServiceUnavailable)
+			return
+		}
+		s.trackActive(&queued)
+		status = db.Queued
+	}
+
+	b, _ := json.Marshal(
+		&struct {
+			DeployID          string `json:"deployID"`
+			Status            int    `json:"status"`
+			Approvals         int    `json:"approvals"`
+			ApprovalsRequired int    `json:"approvalsRequired"`
+		}{
+			DeployID:          row.DeployID,
+			Status:            status,
+			Approvals:         count,
+			ApprovalsRequired: required,
+		})
+	w.Write(b)
+}
+
+// rejectDeploy rejects a pending deploy so it is never queued. An optional reason can be passed in
+// the body: {"reason":"..."}
+func (s *Server) rejectDeploy(w http.ResponseWriter, r *http.Request, row *db.DeployStatus) {
+	var rj struct {
+		Reason string `json:"reason"`
+	}
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, InvalidBody, http.StatusBadRequest)
+		return
+	}
+	if len(bytes.TrimSpace(b)) > 0 {
+		if err := json.Unmarshal(b, &rj); err != nil {
+			http.Error(w, InvalidJSONText, http.StatusBadRequest)
+			return
+		}
+	}
+
+	msg := "Deploy rejected."
+	log := fmt.Sprintln(msg)
+	if rj.Reason != "" {
+		log += fmt.Sprintf("Reason: %s\n", rj.Reason)
+	}
+	if !s.db.TransitionDeploy(row.DeployID, db.PendingApproval, db.Rejected, msg, log) {
+		http.Error(w, InvalidDeployNotPending, http.StatusConflict)
+		return
+	}
+	s.metrics.deploys.Inc(row.Environment, row.ImageName, outcomeRejected)
+	w.Write([]byte(fmt.Sprintf(`{"deployID":"%s","status":%d}`, row.DeployID, db.Rejected)))
+}
+
+// rollbackEtcd puts back the etcd keys of a finished deploy as they were before it changed them, from
+// the snapshot saved with the deploy. Keys the deploy added are removed. Keys changed by someone else
+// since the deploy wrote them are kept and listed in the response.
+func (s *Server) rollbackEtcd(w http.ResponseWriter, r *http.Request, deployID string) {
+	if s.authRight(w, r, rightAdmin) {
+		return
+	}
+	row, err := s.db.QueryDeploy(deployID)
+	if err != nil {
+		http.Error(w, InvalidDeployID, http.StatusNotFound)
+		return
+	}
+	if s.authDeployEnvironment(w, r, row.Environment) {
+		return
+	}
+	if row.Status != db.Success && row.Status != db.Failed {
+		http.Error(w, InvalidDeployNotFinished, http.StatusConflict)
+		return
+	}
+	saved, err := s.db.EtcdSnapshot(deployID)
+	if err != nil {
+		http.Error(w, InvalidDeployUnavailable, http.StatusServiceUnavailable)
+		return
+	}
+	var snapshot etcd2.Snapshot
+	if saved == "" || json.Unmarshal([]byte(saved), &snapshot) != nil || len(snapshot.Written) == 0 {
+		http.Error(w, InvalidDeployNoSnapshot, http.StatusNotFound)
+		return
+	}
+
+	actor := s.db.AuthTokenName(s.authToken(r))
+	kv, err := newEtcdKV(s.options().environment(row.Environment))
+	var skipped []string
+	if err == nil {
+		skipped, err = kv.Restore(&snapshot)
+		kv.Close()
+	}
+	if err != nil {
+		s.log.With(logger.Fields{"deployID": deployID, "environment": row.Environment}).
+			Errorf("Unable to roll back the etcd keys: %s", err)
+		s.db.Audit(auditEtcdRollback, actor, fmt.Sprintf("%s: failed: %s", deployID, err))
+		http.Error(w, InvalidEtcdRollback+err.Error(), http.StatusBadGateway)
+		return
+	}
+	restored, removed := snapshot.Restored(skipped)
+	msg := fmt.Sprintf("Rolled back the etcd keys: restored %d and removed %d added by the deploy.",
+		restored, removed)
+	s.db.AppendDeployLog(deployID, fmt.Sprintln(msg)+skippedEtcdKeys(skipped))
+	s.db.Audit(auditEtcdRollback, actor, deployID)
+	s.log.With(logger.Fields{"deployID": deployID, "environment": row.Environment}).Infof(msg)
+
+	b, _ := json.Marshal(
+		&struct {
+			DeployID string   `json:"deployID"`
+			Restored int      `json:"restored"`
+			Removed  int      `json:"removed"`
+			Skipped  []string `json:"skipped"`
+		}{
+			DeployID: deployID,
+			Restored: restored,
+			Removed:  removed,
+			Skipped:  append([]string{}, skipped...),
+		})
+	w.Write(b)
 }
 
 // statusHandler handles a client request for checking on a previous deploy status.
@@ -304,13 +758,157 @@ func (s *Server) statusHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write(b)
 }
 
+// freezeHandler handles a client request to list, set or lift ad-hoc deploy freezes.
+func (s *Server) freezeHandler(w http.ResponseWriter, r *http.Request) {
+	if s.invalidHeader(w, r) || s.invalidMethod(w, r, httpGet, httpPost, httpDelete) || s.invalidAuth(w, r) {
+		return
+	}
+
+	// List the freezes in effect.
+	if r.Method == httpGet {
+		s.listFreezes(w, r)
+		return
+	}
+
+	// Set or lift a freeze.
+	var f struct {
+		Environment string `json:"environment"`
+		Reason      string `json:"reason"`
+		Until       string `json:"until"`
+	}
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, InvalidBody, http.StatusBadRequest)
+		return
+	}
+	if err := json.Unmarshal(b, &f); err != nil {
+		http.Error(w, InvalidJSONText, http.StatusBadRequest)
+		return
+	}
+	if _, ok := s.options().Environments[f.Environment]; !ok {
+		http.Error(w, InvalidDeployEnv, http.StatusBadRequest)
+		return
+	}
+	if s.authRight(w, r, rightFreeze) || s.authDeployEnvironment(w, r, f.Environment) {
+		return
+	}
+	name := s.db.AuthTokenName(s.authToken(r))
+
+	if r.Method == httpDelete {
+		n, err := s.db.LiftFreeze(f.Environment)
+		if err != nil {
+			http.Error(w, InvalidFreezeCannotSet, http.StatusServiceUnavailable)
+			return
+		}
+		s.log.Noticef("Freeze on %s lifted by '%s'.", f.Environment, name)
+		w.Write([]byte(fmt.Sprintf(`{"environment":"%s","lifted":%d}`, f.Environment, n)))
+		return
+	}
+
+	if f.Reason == "" {
+		http.Error(w, InvalidFreezeReason, http.StatusBadRequest)
+		return
+	}
+	var until time.Time
+	if f.Until != "" {
+		if until, err = time.Parse(time.RFC3339, f.Until); err != nil || !until.After(time.Now()) {
+			http.Error(w, InvalidFreezeUntil, http.StatusBadRequest)
+			return
+		}
+	}
+	id, err := s.db.SetFreeze(f.Environment, f.Reason, until, s.authToken(r))
+	if err != nil {
+		http.Error(w, InvalidFreezeCannotSet, http.StatusServiceUnavailable)
+		return
+	}
+	s.log.Noticef("Freeze on %s set by '%s': %s", f.Environment, name, f.Reason)
+	w.Write([]byte(fmt.Sprintf(`{"id":%d,"environment":"%s"}`, id, f.Environment)))
+}
+
+// listFreezes returns the ad-hoc freezes in effect and the state of the configured freeze windows.
+func (s *Server) listFreezes(w http.ResponseWriter, r *http.Request) {
+	freezes, err := s.db.ActiveFreezes("")
+	if err != nil {
+		http.Error(w, InvalidFreezeCannotSet, http.StatusServiceUnavailable)
+		return
+	}
+
+	type window struct {
+		Rule   string `json:"rule"`
+		Active bool   `json:"active"`
+	}
+	now := time.Now()
+	windows := make(map[string][]window)
+	s.mu.RLock()
+	for env, list := range s.freezes {
+		for _, fw := range list {
+			windows[env] = append(windows[env], window{Rule: fw.rule, Active: fw.active(now)})
+		}
+	}
+	s.mu.RUnlock()
+
+	b, _ := json.Marshal(
+		&struct {
+			Freezes []*db.Freeze        `json:"freezes"`
+			Windows map[string][]window `json:"windows"`
+		}{
+			Freezes: freezes,
+			Windows: windows,
+		})
+	w.Write(b)
+}
+
+// freezeOverride checks whether deploys to an environment are frozen. If they are, a token with the
+// override right gets the override message for the deploy log; any other token gets a 423. If the
+// freezes cannot be read the deploy is blocked with a 503. Returns true if the deploy is blocked.
+func (s *Server) freezeOverride(w http.ResponseWriter, r *http.Request, env string, deployID string) (string, bool) {
+	reason, frozen, err := s.frozen(env, time.Now())
+	if err != nil {
+		http.Error(w, InvalidFreezeUnavailable, http.StatusServiceUnavailable)
+		return "", true
+	}
+	if !frozen {
+		return "", false
+	}
+	if !s.db.AuthRight(s.authToken(r), rightOverride) {
+		http.Error(w, InvalidDeployFrozen+reason, http.StatusLocked)
+		return "", true
+	}
+	override := fmt.Sprintf("Freeze override by '%s': %s", s.db.AuthTokenName(s.authToken(r)), reason)
+	s.log.With(logger.Fields{"deployID": deployID, "environment": env}).Warningf("%s", override)
+	return override, false
+}
+
+// frozen returns true and a reason if deploys to an environment are blocked by a configured freeze
+// window or an ad-hoc freeze. Returns an error if the ad-hoc freezes cannot be read.
+func (s *Server) frozen(env string, t time.Time) (string, bool, error) {
+	s.mu.RLock()
+	windows := s.freezes[env]
+	s.mu.RUnlock()
+	for _, fw := range windows {
+		if fw.active(t) {
+			return fmt.Sprintf("freeze window '%s'", fw), true, nil
+		}
+	}
+
+	freezes, err := s.db.ActiveFreezes(env)
+	if err != nil {
+		s.log.Errorf("Unable to read freezes for %s: %s", env, err)
+		return "", false, err
+	}
+	if len(freezes) > 0 {
+		return freezes[0].Reason, true, nil
+	}
+	return "", false, nil
+}
+
 // initResponseHeader sets up the common http response headers for the return of all json calls.
 func (s *Server) initResponseHeader(w http.ResponseWriter) {
 	h := w.Header()
 	h.Add("Content-Type", "application/json;charset=utf-8")
 	h.Add("Date", time.Now().UTC().Format(time.RFC1123Z))
-	if s.opt.ServerName != "" {
-		h.Add("Server", s.opt.ServerName)
+	if name := s.options().ServerName; name != "" {
+		h.Add("Server", name)
 	}
 	h.Add("X-Request-ID", createV4UUID())
 }
@@ -335,19 +933,34 @@ func (s *Server) invalidHeader(w http.ResponseWriter, r *http.Request) bool {
 }
 
 // invalidMethod validates that the http method is acceptable for processing this route.
-func (s *Server) invalidMethod(w http.ResponseWriter, r *http.Request, method string) bool {
-	if r.Method != method {
-		http.Error(w, InvalidMethod, http.StatusMethodNotAllowed)
-		return true
+func (s *Server) invalidMethod(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, method := range methods {
+		if r.Method == method {
+			return false
+		}
 	}
-	return false
+	http.Error(w, InvalidMethod, http.StatusMethodNotAllowed)
+	return true
+}
+
+// authToken returns the API token of a request. This is the bearer token from the Authorization
+// header or, without one, the token of the identity mapped to a verified client certificate.
+func (s *Server) authToken(r *http.Request) string {
+	if token := bearerToken(r); token != "" {
+		return token
+	}
+	if identity := s.clientCertIdentity(r); identity != "" {
+		return s.db.AuthTokenByCertIdentity(identity)
+	}
+	return ""
 }
 
 // invalidAuth validates that the Authorization token is valid for using the API
 func (s *Server) invalidAuth(w http.ResponseWriter, r *http.Request) bool {
+	token := s.authToken(r) // Not under the lock: mapping a client certificate reads the options.
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	if !s.db.ValidAuth(strings.Replace(r.Header.Get("Authorization"), "Bearer ", "", -1)) {
+	if !s.db.ValidAuth(token) {
 		http.Error(w, InvalidAuthorization, http.StatusUnauthorized)
 		return true
 	}
@@ -356,15 +969,36 @@ func (s *Server) invalidAuth(w http.ResponseWriter, r *http.Request) bool {
 
 // invalidAuth validates that the Authorization token can deploy to the environment.
 func (s *Server) authDeployEnvironment(w http.ResponseWriter, r *http.Request, env string) bool {
+	token := s.authToken(r)
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	if !s.db.AuthDeployEnv(strings.Replace(r.Header.Get("Authorization"), "Bearer ", "", -1), env) {
+	if !s.db.AuthDeployEnv(token, env) {
 		http.Error(w, InvalidEnvAuthorization, http.StatusUnauthorized)
 		return true
 	}
 	return false
 }
 
+// authRight validates that the Authorization token has been granted a named right.
+func (s *Server) authRight(w http.ResponseWriter, r *http.Request, right string) bool {
+	token := s.authToken(r)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.db.AuthRight(token, right) {
+		http.Error(w, InvalidRightAuthorization, http.StatusForbidden)
+		return true
+	}
+	return false
+}
+
+// options returns the current options. A config reload replaces them, so callers that read
+// several settings should hold on to one snapshot.
+func (s *Server) options() *Options {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.opt
+}
+
 // isRunning returns a boolean representing whether the server is running or not.
 func (s *Server) isRunning() bool {
 	s.mu.RLock()
@@ -384,6 +1018,7 @@ type requestLogEntry struct {
 	RemoteAddr    string      `json:"remoteAddr"`
 	RequestURI    string      `json:"requestURI"`
 	Trailer       http.Header `json:"trailer"`
+	Correlation   string      `json:"correlationID,omitempty"`
 }
 
 // LogRequest logs the http request information into the logger.
@@ -400,17 +1035,25 @@ func (s *Server) LogRequest(r *http.Request) {
 	}
 	r.Body = ioutil.NopCloser(bytes.NewBuffer(bd)) // We need to set the body back after we read it.
 
-	b, _ := json.Marshal(&requestLogEntry{
+	// Mask secrets before anything is logged.
+	u := s.redact.url(r.URL)
+	entry := &requestLogEntry{
 		Method:        r.Method,
-		URL:           r.URL,
+		URL:           u,
 		Proto:         r.Proto,
-		Header:        r.Header,
-		Body:          string(bd),
+		Header:        s.redact.header(r.Header),
+		Body:          s.redact.body(r.Header.Get("Content-Type"), bd),
 		ContentLength: cl,
 		Host:          r.Host,
 		RemoteAddr:    r.RemoteAddr,
-		RequestURI:    r.RequestURI,
-		Trailer:       r.Trailer,
-	})
-	s.log.Infof(`{"request":%s}`, string(b))
+		RequestURI:    u.RequestURI(),
+		Trailer:       s.redact.header(r.Trailer),
+		Correlation:   correlationID(r),
+	}
+	if s.httpLog.GetFormat() == logger.FormatJSON {
+		s.httpLog.With(logger.Fields{"request": entry}).Infof("HTTP request.")
+		return
+	}
+	b, _ := json.Marshal(entry)
+	s.httpLog.Infof(`{"request":%s}`, string(b))
 }
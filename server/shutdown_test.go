@@ -0,0 +1,63 @@
+package server
+
+import (
+	"context"
+	"os/exec"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDrainWorkerWithinGrace(t *testing.T) {
+	t.Parallel()
+	done := make(chan bool)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		<-done // The worker stops once it sees the shutdown.
+	}()
+	grace, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	aborted := false
+	if !drainWorker(grace, done, &wg, func() { aborted = true }) || aborted {
+		t.Errorf("Expected the worker drained within the grace period without an abort.")
+	}
+}
+
+func TestDrainWorkerAbortsAfterGrace(t *testing.T) {
+	t.Parallel()
+	done := make(chan bool)
+	abortCtx, abort := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		<-abortCtx.Done() // A deploy that only stops when aborted.
+	}()
+	grace, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if drainWorker(grace, done, &wg, abort) {
+		t.Errorf("Expected the grace period to end.")
+	}
+	if abortCtx.Err() == nil {
+		t.Errorf("Expected the deploy in progress to be aborted.")
+	}
+}
+
+func TestExecuteCommandAborted(t *testing.T) {
+	t.Parallel()
+	ctx, abort := context.WithCancel(context.Background())
+	d := &deployService{abort: ctx}
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		abort()
+	}()
+	log, err := d.executeCommand(exec.CommandContext(ctx, "sleep", "5"), &DeployRequest{}, "Sleeping.", "Started.\n")
+	if err != errDeployAborted {
+		t.Errorf("Expected the deploy to be requeued, received: %v", err)
+	}
+	if log != "Started.\n" {
+		t.Errorf("An aborted step should not be logged as failed, received: %s", log)
+	}
+}
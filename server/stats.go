@@ -0,0 +1,202 @@
+package server
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/composer22/docker-deploy-server/db"
+)
+
+// Windows for deploy frequency, in seconds.
+var statsWindows = []struct {
+	name    string
+	seconds int64
+}{
+	{"1d", 24 * 60 * 60},
+	{"7d", 7 * 24 * 60 * 60},
+	{"30d", 30 * 24 * 60 * 60},
+	{"90d", 90 * 24 * 60 * 60},
+}
+
+// deployStats is the datastructure of deploy statistics for an environment or an image.
+type deployStats struct {
+	Deploys        int                     `json:"deploys"`                  // Deploys requested.
+	Succeeded      int                     `json:"succeeded"`                // Deploys that succeeded.
+	Failed         int                     `json:"failed"`                   // Deploys that failed.
+	Rejected       int                     `json:"rejected"`                 // Deploys rejected by an approver.
+	Expired        int                     `json:"expired"`                  // Deploys that expired waiting for approval.
+	Superseded     int                     `json:"superseded"`               // Deploys replaced by a newer request.
+	InProgress     int                     `json:"inProgress"`               // Deploys pending, queued or running.
+	SuccessRate    *float64                `json:"successRate"`              // Succeeded / (succeeded + failed).
+	FailureRate    *float64                `json:"failureRate"`              // Failed / (succeeded + failed).
+	MeanDuration   *float64                `json:"meanDurationSeconds"`      // Mean start to finish time.
+	P95Duration    *float64                `json:"p95DurationSeconds"`       // 95th percentile start to finish time.
+	LastSuccess    *int64                  `json:"secondsSinceLastSuccess"`  // Time since the last successful deploy, ever.
+	TopFailingStep string                  `json:"topFailingStep,omitempty"` // Step that failed most often.
+	Frequency      map[string]int          `json:"successfulDeploys"`        // Successful deploys per window.
+	PerDay         float64                 `json:"successfulDeploysPerDay"`  // Successful deploys per day over the period.
+	Images         map[string]*deployStats `json:"images,omitempty"`         // Statistics per image of an environment.
+	durations      []float64               // Durations of finished deploys.
+	failedSteps    map[string]int          // Failures per step.
+}
+
+// newDeployStats is a factory function that returns empty statistics.
+func newDeployStats() *deployStats {
+	return &deployStats{
+		Frequency:   make(map[string]int),
+		failedSteps: make(map[string]int),
+	}
+}
+
+// add counts a deploy in the statistics.
+func (s *deployStats) add(r *db.DeployRecord, days int) {
+	s.Deploys++
+	switch r.Status {
+	case db.Success:
+		s.Succeeded++
+		for _, w := range statsWindows {
+			if w.seconds <= int64(days)*24*60*60 && r.Age < w.seconds {
+				s.Frequency[w.name]++
+			}
+		}
+	case db.Failed:
+		s.Failed++
+		if r.FailedStep != "" {
+			s.failedSteps[r.FailedStep]++
+		}
+	case db.Rejected:
+		s.Rejected++
+	case db.Expired:
+		s.Expired++
+	case db.Superseded:
+		s.Superseded++
+	default:
+		s.InProgress++
+	}
+	if (r.Status == db.Success || r.Status == db.Failed) && r.Duration >= 0 {
+		s.durations = append(s.durations, float64(r.Duration))
+	}
+}
+
+// finish computes the rates, durations and top failing step once every deploy is added.
+func (s *deployStats) finish(days int) {
+	for _, w := range statsWindows {
+		if _, ok := s.Frequency[w.name]; !ok && w.seconds <= int64(days)*24*60*60 {
+			s.Frequency[w.name] = 0
+		}
+	}
+	s.PerDay = float64(s.Succeeded) / float64(days)
+	if finished := s.Succeeded + s.Failed; finished > 0 {
+		success := float64(s.Succeeded) / float64(finished)
+		failure := 1 - success
+		s.SuccessRate, s.FailureRate = &success, &failure
+	}
+	if n := len(s.durations); n > 0 {
+		sort.Float64s(s.durations)
+		var sum float64
+		for _, d := range s.durations {
+			sum += d
+		}
+		mean := sum / float64(n)
+		p95 := s.durations[int(math.Ceil(0.95*float64(n)))-1]
+		s.MeanDuration, s.P95Duration = &mean, &p95
+	}
+	var top int
+	for step, count := range s.failedSteps {
+		if count > top || (count == top && step < s.TopFailingStep) {
+			s.TopFailingStep, top = step, count
+		}
+	}
+	for _, img := range s.Images {
+		img.finish(days)
+	}
+}
+
+// addLastSuccess records a successful deploy finished some seconds ago, if it is the latest.
+func (s *deployStats) addLastSuccess(age int64) {
+	if s.LastSuccess == nil || age < *s.LastSuccess {
+		s.LastSuccess = &age
+	}
+}
+
+// summarizeDeploys returns the statistics of deploys per environment, with a breakdown per image. The
+// time since the last success is taken from the last successes, which are not limited to the period.
+func summarizeDeploys(records []*db.DeployRecord, last []*db.LastSuccess, days int) map[string]*deployStats {
+	envs := make(map[string]*deployStats)
+	stats := func(environment string, image string) (*deployStats, *deployStats) {
+		env, ok := envs[environment]
+		if !ok {
+			env = newDeployStats()
+			env.Images = make(map[string]*deployStats)
+			envs[environment] = env
+		}
+		img, ok := env.Images[image]
+		if !ok {
+			img = newDeployStats()
+			env.Images[image] = img
+		}
+		return env, img
+	}
+	for _, r := range records {
+		env, img := stats(r.Environment, r.ImageName)
+		env.add(r, days)
+		img.add(r, days)
+	}
+	for _, l := range last {
+		env, img := stats(l.Environment, l.ImageName)
+		env.addLastSuccess(l.Age)
+		img.addLastSuccess(l.Age)
+	}
+	for _, env := range envs {
+		env.finish(days)
+	}
+	return envs
+}
+
+// statsHandler handles a client request for deploy statistics from the deploy history.
+func (s *Server) statsHandler(w http.ResponseWriter, r *http.Request) {
+	if s.invalidHeader(w, r) || s.invalidMethod(w, r, httpGet) || s.invalidAuth(w, r) {
+		return
+	}
+
+	q := r.URL.Query()
+	days := DefaultStatsDays
+	if v := q.Get("days"); v != "" {
+		d, err := strconv.Atoi(v)
+		if err != nil || d < 1 || d > maxStatsDays {
+			http.Error(w, InvalidStatsDays, http.StatusBadRequest)
+			return
+		}
+		days = d
+	}
+	env, image := q.Get("environment"), q.Get("image")
+	if env != "" {
+		if _, ok := s.options().Environments[env]; !ok {
+			http.Error(w, InvalidDeployEnv, http.StatusBadRequest)
+			return
+		}
+	}
+
+	records, err := s.db.DeployHistory(days, env, image)
+	if err != nil {
+		http.Error(w, InvalidStatsUnavailable, http.StatusServiceUnavailable)
+		return
+	}
+	last, err := s.db.LastSuccesses(env, image)
+	if err != nil {
+		http.Error(w, InvalidStatsUnavailable, http.StatusServiceUnavailable)
+		return
+	}
+	b, _ := json.Marshal(
+		&struct {
+			Days         int                     `json:"days"`
+			Environments map[string]*deployStats `json:"environments"`
+		}{
+			Days:         days,
+			Environments: summarizeDeploys(records, last, days),
+		})
+	w.Write(b)
+}
@@ -0,0 +1,69 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/composer22/docker-deploy-server/db"
+)
+
+func TestSummarizeDeploys(t *testing.T) {
+	t.Parallel()
+	day := int64(24 * 60 * 60)
+	records := []*db.DeployRecord{
+		{Environment: "prod", ImageName: "api", Status: db.Success, Duration: 10, Age: 3600, FinishedAge: 3500},
+		{Environment: "prod", ImageName: "api", Status: db.Success, Duration: 30, Age: 3 * day, FinishedAge: 3 * day},
+		{Environment: "prod", ImageName: "api", Status: db.Failed, FailedStep: stepDeployContainers, Duration: 20,
+			Age: 10 * day, FinishedAge: 10 * day},
+		{Environment: "prod", ImageName: "web", Status: db.Failed, FailedStep: stepDeployContainers, Duration: 100,
+			Age: 40 * day, FinishedAge: 40 * day},
+		{Environment: "prod", ImageName: "web", Status: db.Failed, FailedStep: stepDownloadMetadata, Duration: 5,
+			Age: 41 * day, FinishedAge: 41 * day},
+		{Environment: "prod", ImageName: "web", Status: db.Started, Duration: -1, Age: 60, FinishedAge: -1},
+		{Environment: "dev", ImageName: "api", Status: db.Rejected, Duration: -1, Age: day, FinishedAge: -1},
+	}
+	last := []*db.LastSuccess{
+		{Environment: "prod", ImageName: "api", Age: 3500},
+		{Environment: "prod", ImageName: "web", Age: 200 * day},
+		{Environment: "qa", ImageName: "api", Age: 120 * day},
+	}
+	envs := summarizeDeploys(records, last, 90)
+
+	prod := envs["prod"]
+	if prod.Deploys != 6 || prod.Succeeded != 2 || prod.Failed != 3 || prod.InProgress != 1 {
+		t.Fatalf("Unexpected prod counts: %+v", prod)
+	}
+	if *prod.SuccessRate != 0.4 || *prod.FailureRate != 0.6 {
+		t.Errorf("Unexpected prod rates: %f %f", *prod.SuccessRate, *prod.FailureRate)
+	}
+	if *prod.MeanDuration != 33 || *prod.P95Duration != 100 {
+		t.Errorf("Unexpected prod durations: %f %f", *prod.MeanDuration, *prod.P95Duration)
+	}
+	if *prod.LastSuccess != 3500 {
+		t.Errorf("Expected last success 3500s ago, received %d.", *prod.LastSuccess)
+	}
+	if prod.TopFailingStep != stepDeployContainers {
+		t.Errorf("Expected top failing step %s, received %s.", stepDeployContainers, prod.TopFailingStep)
+	}
+	if prod.Frequency["1d"] != 1 || prod.Frequency["7d"] != 2 || prod.Frequency["90d"] != 2 {
+		t.Errorf("Unexpected prod frequency: %v", prod.Frequency)
+	}
+
+	web := prod.Images["web"]
+	if web.SuccessRate == nil || *web.SuccessRate != 0 || *web.LastSuccess != 200*day {
+		t.Errorf("Unexpected web stats: %+v", web)
+	}
+
+	dev := envs["dev"]
+	if dev.Rejected != 1 || dev.SuccessRate != nil || dev.MeanDuration != nil || dev.Frequency["30d"] != 0 {
+		t.Errorf("Unexpected dev stats: %+v", dev)
+	}
+	if qa := envs["qa"]; qa == nil || qa.Deploys != 0 || *qa.LastSuccess != 120*day {
+		t.Errorf("Expected a success older than the period to be reported, received: %+v", qa)
+	}
+	if dev.LastSuccess != nil {
+		t.Errorf("Expected no last success for dev, received %d.", *dev.LastSuccess)
+	}
+	if _, ok := summarizeDeploys(records, nil, 7)["prod"].Frequency["30d"]; ok {
+		t.Errorf("Windows longer than the period should not be reported.")
+	}
+}
@@ -0,0 +1,44 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/composer22/docker-deploy-server/logger"
+)
+
+// newSyslogWriter returns a syslog sink from the options, or nil if syslog.network is not set.
+func newSyslogWriter(o *Options) (*logger.SyslogWriter, error) {
+	if o.SyslogNetwork == "" {
+		return nil, nil
+	}
+	facility, ok := logger.Facilities[strings.ToLower(o.SyslogFacility)]
+	if !ok {
+		return nil, fmt.Errorf("Invalid syslog.facility '%s'.", o.SyslogFacility)
+	}
+	cfg := logger.SyslogConfig{
+		Network:  strings.ToLower(o.SyslogNetwork),
+		Address:  o.SyslogAddress,
+		Facility: facility,
+		AppName:  o.SyslogAppName,
+	}
+	if cfg.Network == logger.SyslogTLS {
+		cfg.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+		if o.SyslogCAFile != "" {
+			pem, err := ioutil.ReadFile(o.SyslogCAFile)
+			if err != nil {
+				return nil, err
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, errors.New("No certificates found in syslog.ca_file.")
+			}
+			cfg.TLSConfig.RootCAs = pool
+		}
+	}
+	return logger.NewSyslogWriter(cfg)
+}
@@ -0,0 +1,144 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/composer22/docker-deploy-server/logger"
+)
+
+// tlsVersions maps the configured minimum TLS version to its protocol value.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// tlsClientAuth maps the configured client certificate policy to its tls value.
+var tlsClientAuth = map[string]tls.ClientAuthType{
+	"none":    tls.NoClientCert,
+	"request": tls.VerifyClientCertIfGiven,
+	"require": tls.RequireAndVerifyClientCert,
+}
+
+// certReloader serves the server certificate and reloads it when the cert or key file changes.
+type certReloader struct {
+	mu       sync.Mutex       // For locking access to the certificate.
+	certFile string           // Path to the PEM certificate.
+	keyFile  string           // Path to the PEM key.
+	cert     *tls.Certificate // The current certificate.
+	modTime  time.Time        // Latest modification time of the files loaded.
+	checked  time.Time        // Last time the files were checked for changes.
+	log      *logger.Logger   // Log instance for recording reloads.
+}
+
+// newCertReloader is a factory function that returns a certReloader with the certificate loaded.
+func newCertReloader(certFile string, keyFile string, l *logger.Logger) (*certReloader, error) {
+	c := &certReloader{certFile: certFile, keyFile: keyFile, log: l}
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// GetCertificate returns the current certificate, reloading it first if the files have changed.
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if time.Since(c.checked) >= certCheckInterval {
+		c.checked = time.Now()
+		if c.latestModTime().After(c.modTime) {
+			if err := c.reload(); err != nil {
+				c.log.Errorf("Unable to reload TLS certificate, keeping the previous one: %s", err)
+			} else {
+				c.log.Noticef("Reloaded TLS certificate %s.", c.certFile)
+			}
+		}
+	}
+	return c.cert, nil
+}
+
+// reload reads the certificate and key from disk.
+func (c *certReloader) reload() error {
+	modTime := c.latestModTime()
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	c.cert, c.modTime = &cert, modTime
+	return nil
+}
+
+// latestModTime returns the most recent modification time of the cert and key files.
+func (c *certReloader) latestModTime() time.Time {
+	var latest time.Time
+	for _, f := range []string{c.certFile, c.keyFile} {
+		if fi, err := os.Stat(f); err == nil && fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest
+}
+
+// newTLSConfig returns the TLS configuration for the API listener from the options.
+func newTLSConfig(o *Options, l *logger.Logger) (*tls.Config, error) {
+	if o.TLSCertFile == "" || o.TLSKeyFile == "" {
+		return nil, errors.New("TLS requires both tls.cert_file and tls.key_file.")
+	}
+	minVersion, ok := tlsVersions[o.TLSMinVersion]
+	if !ok {
+		return nil, fmt.Errorf("Invalid tls.min_version '%s'.", o.TLSMinVersion)
+	}
+	clientAuth, ok := tlsClientAuth[strings.ToLower(o.TLSClientAuth)]
+	if !ok {
+		return nil, fmt.Errorf("Invalid tls.client_auth '%s'.", o.TLSClientAuth)
+	}
+	reloader, err := newCertReloader(o.TLSCertFile, o.TLSKeyFile, l)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &tls.Config{
+		MinVersion:     minVersion,
+		GetCertificate: reloader.GetCertificate,
+		ClientAuth:     clientAuth,
+	}
+	if clientAuth != tls.NoClientCert {
+		if o.TLSClientCAFile == "" {
+			return nil, errors.New("tls.client_auth requires tls.client_ca_file.")
+		}
+		pem, err := ioutil.ReadFile(o.TLSClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in %s.", o.TLSClientCAFile)
+		}
+		cfg.ClientCAs = pool
+	}
+	return cfg, nil
+}
+
+// clientCertIdentity returns the identity mapped to the verified client certificate of a request.
+// The full subject (ex: CN=ci,O=Acme) is matched first, then the common name.
+func (s *Server) clientCertIdentity(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	subject := r.TLS.VerifiedChains[0][0].Subject
+	ids := s.options().TLSClientIdentities
+	if name, ok := ids[strings.ToLower(subject.String())]; ok {
+		return name
+	}
+	return ids[strings.ToLower(subject.CommonName)]
+}
@@ -0,0 +1,122 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/composer22/docker-deploy-server/logger"
+)
+
+// newTestCert returns a self-signed certificate for a subject, and its PEM cert and key.
+func newTestCert(t *testing.T, subject pkix.Name) (*x509.Certificate, []byte, []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Unable to generate a key: %s", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      subject,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Unable to create a certificate: %s", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	return cert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func TestCertReloader(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key")
+	write := func(cn string, modTime time.Time) []byte {
+		_, c, k := newTestCert(t, pkix.Name{CommonName: cn})
+		ioutil.WriteFile(certFile, c, 0600)
+		ioutil.WriteFile(keyFile, k, 0600)
+		os.Chtimes(certFile, modTime, modTime)
+		os.Chtimes(keyFile, modTime, modTime)
+		return c
+	}
+	start := time.Now().Add(-time.Hour)
+	first := write("first", start)
+	r, err := newCertReloader(certFile, keyFile, logger.New(logger.Error, false))
+	if err != nil {
+		t.Fatalf("Unable to load the certificate: %s", err)
+	}
+	leaf := func() string {
+		c, _ := r.GetCertificate(&tls.ClientHelloInfo{})
+		x, _ := x509.ParseCertificate(c.Certificate[0])
+		return x.Subject.CommonName
+	}
+	if cn := leaf(); cn != "first" {
+		t.Fatalf("Expected the first certificate, received %s.", cn)
+	}
+
+	// A renewed certificate is served once the files are checked again.
+	write("second", start.Add(time.Minute))
+	if cn := leaf(); cn != "first" {
+		t.Errorf("Expected the files checked at most every %s, received %s.", certCheckInterval, cn)
+	}
+	r.checked = time.Time{}
+	if cn := leaf(); cn != "second" {
+		t.Errorf("Expected the renewed certificate, received %s.", cn)
+	}
+
+	// A bad file keeps the current certificate.
+	ioutil.WriteFile(keyFile, first, 0600)
+	later := start.Add(2 * time.Minute)
+	os.Chtimes(keyFile, later, later)
+	r.checked = time.Time{}
+	if cn := leaf(); cn != "second" {
+		t.Errorf("Expected the current certificate kept, received %s.", cn)
+	}
+}
+
+func TestClientCertIdentity(t *testing.T) {
+	t.Parallel()
+	s := &Server{opt: &Options{TLSClientIdentities: map[string]string{
+		"cn=ci-runner,o=acme": "ci",
+		"deploy-bot":          "bot",
+	}}}
+	request := func(subject *pkix.Name) string {
+		r := httptest.NewRequest("GET", httpRouteV1Deploy, nil)
+		if subject != nil {
+			cert, _, _ := newTestCert(t, *subject)
+			r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+		}
+		return s.clientCertIdentity(r)
+	}
+	tests := []struct {
+		subject  *pkix.Name
+		identity string
+	}{
+		{&pkix.Name{CommonName: "ci-runner", Organization: []string{"Acme"}}, "ci"},
+		{&pkix.Name{CommonName: "ci-runner", Organization: []string{"Other"}}, ""},
+		{&pkix.Name{CommonName: "deploy-bot", Organization: []string{"Acme"}}, "bot"},
+		{&pkix.Name{CommonName: "Deploy-Bot"}, "bot"},
+		{&pkix.Name{CommonName: "unknown"}, ""},
+		{nil, ""},
+	}
+	for _, tc := range tests {
+		if identity := request(tc.subject); identity != tc.identity {
+			t.Errorf("Expected identity %q for %v, received %q.", tc.identity, tc.subject, identity)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/composer22/docker-deploy-server/tracing"
+)
+
+// newTracer returns a tracer that exports spans to the OTLP/HTTP endpoint in the options, or
+// only propagates trace context if no endpoint is set.
+func newTracer(o *Options) (*tracing.Tracer, error) {
+	if o.TracingEndpoint == "" {
+		return tracing.NewTracer(o.TracingServiceName, nil), nil
+	}
+	u, err := url.Parse(o.TracingEndpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("Invalid tracing.endpoint '%s'.", o.TracingEndpoint)
+	}
+	e := tracing.NewOTLPExporter(o.TracingEndpoint, o.TracingServiceName, o.TracingHeaders)
+	return tracing.NewTracer(o.TracingServiceName, e), nil
+}
+
+// startSpan starts a span that is a child of the request span.
+func (s *Server) startSpan(r *http.Request, name string, kind int) *tracing.Span {
+	var parent tracing.SpanContext
+	if span := tracing.SpanFromContext(r.Context()); span != nil {
+		parent = span.Context
+	}
+	return s.tracer.Start(name, kind, parent)
+}
+
+// startRequestSpan starts the server span of a request, continuing the client's trace if it sent
+// a valid traceparent header.
+func (s *Server) startRequestSpan(r *http.Request) (*tracing.Span, *http.Request) {
+	parent, _ := tracing.ParseTraceparent(r.Header.Get("traceparent"))
+	span := s.tracer.Start(fmt.Sprintf("%s %s", r.Method, routeLabel(r.URL.Path)), tracing.KindServer, parent)
+	span.SetAttribute("http.method", r.Method)
+	span.SetAttribute("http.route", routeLabel(r.URL.Path))
+	span.SetAttribute("http.user_agent", r.UserAgent())
+	return span, r.WithContext(tracing.ContextWithSpan(r.Context(), span))
+}
+
+// finishRequestSpan records the response status and ends the server span of a request.
+func finishRequestSpan(span *tracing.Span, w http.ResponseWriter, status int) {
+	span.SetAttribute("http.status_code", status)
+	span.SetAttribute("http.request_id", w.Header().Get("X-Request-ID"))
+	if id := w.Header().Get("X-Correlation-ID"); id != "" {
+		span.SetAttribute("correlation.id", id)
+	}
+	if status >= http.StatusInternalServerError {
+		span.SetError(fmt.Errorf("%d %s", status, http.StatusText(status)))
+	}
+	span.Finish()
+}
@@ -9,7 +9,14 @@ const usageText = `
 Description: docker-deploy-server is a server for deploying services to one or more
 Docker nodes. It can be used for single nodes or across a Docker Swarm cluster.
 
-Usage: docker-deploy-server [options...]
+Usage: docker-deploy-server [options...] [command]
+
+Commands:
+    check-config                     Validate the config file, then exit (non-zero if invalid).
+    doctor                           Validate the config and test the connection to MySQL, Redis,
+                                     git and every environment's machine, registry and etcd.
+    version                          Show version.
+    help                             Show this message.
 
 Server options:
     -p, --config-path PATH           PATH to the config.yml file (default: "~/.docker-deploy-server").
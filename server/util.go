@@ -3,6 +3,8 @@ package server
 import (
 	"bytes"
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
@@ -10,6 +12,7 @@ import (
 	"net/http"
 	"os"
 	"os/exec"
+	"strings"
 	"time"
 )
 
@@ -23,6 +26,17 @@ func createV4UUID() string {
 	return fmt.Sprintf("%X-%X-%X-%X-%X", u[0:4], u[4:6], u[6:8], u[8:10], u[10:])
 }
 
+// bearerToken returns the token from the Authorization header of a request.
+func bearerToken(r *http.Request) string {
+	return strings.Replace(r.Header.Get("Authorization"), "Bearer ", "", -1)
+}
+
+// tokenKey returns a hash of an API token that is safe to use in redis keys and queue payloads.
+func tokenKey(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:16])
+}
+
 // randomString returns a random string for n characters.
 func randomString(n int) string {
 	const chars = "abcdefghijklmnopqrstuvwxyz0123456789"
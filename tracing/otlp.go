@@ -0,0 +1,303 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Export defaults.
+const (
+	DefaultBatchSize     = 256
+	DefaultQueueSize     = 2048
+	DefaultFlushInterval = 5 * time.Second
+	DefaultExportTimeout = 10 * time.Second
+)
+
+// OTLPExporter batches spans and posts them as OTLP/HTTP JSON to a collector (ex:
+// http://localhost:4318/v1/traces).
+type OTLPExporter struct {
+	endpoint string             // Collector traces URL.
+	headers  map[string]string  // Extra request headers (ex: an API key).
+	service  string             // service.name resource attribute.
+	client   *http.Client       // Client used to post batches.
+	queue    chan *Span         // Ended spans waiting to be exported.
+	flush    chan chan struct{} // Requests an immediate flush.
+	done     chan struct{}      // Closed to stop the exporter.
+	stopped  chan struct{}      // Closed when the exporter has stopped.
+	once     sync.Once
+	mu       sync.Mutex // For locking access to the counters.
+	dropped  int64      // Spans dropped because the queue was full or export failed.
+	lastErr  error      // Last export error.
+}
+
+// NewOTLPExporter is a factory function that returns an exporter posting to the endpoint.
+func NewOTLPExporter(endpoint string, service string, headers map[string]string) *OTLPExporter {
+	e := &OTLPExporter{
+		endpoint: endpoint,
+		headers:  headers,
+		service:  service,
+		client:   &http.Client{Timeout: DefaultExportTimeout},
+		queue:    make(chan *Span, DefaultQueueSize),
+		flush:    make(chan chan struct{}),
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	go e.run()
+	return e
+}
+
+// Export queues a span. If the queue is full the span is dropped.
+func (e *OTLPExporter) Export(s *Span) {
+	select {
+	case e.queue <- s:
+	default:
+		e.mu.Lock()
+		e.dropped++
+		e.mu.Unlock()
+	}
+}
+
+// Flush exports the queued spans now and waits until done or the context ends.
+func (e *OTLPExporter) Flush(ctx context.Context) {
+	c := make(chan struct{})
+	select {
+	case e.flush <- c:
+	case <-e.stopped:
+		return
+	case <-ctx.Done():
+		return
+	}
+	select {
+	case <-c:
+	case <-ctx.Done():
+	}
+}
+
+// Shutdown exports the queued spans and stops the exporter.
+func (e *OTLPExporter) Shutdown(ctx context.Context) {
+	e.once.Do(func() { close(e.done) })
+	select {
+	case <-e.stopped:
+	case <-ctx.Done():
+	}
+}
+
+// Dropped returns the number of spans that were not exported.
+func (e *OTLPExporter) Dropped() int64 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.dropped
+}
+
+// LastError returns the last export error, or nil.
+func (e *OTLPExporter) LastError() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.lastErr
+}
+
+// run batches queued spans and posts them when the batch is full or on the flush interval.
+func (e *OTLPExporter) run() {
+	defer close(e.stopped)
+	ticker := time.NewTicker(DefaultFlushInterval)
+	defer ticker.Stop()
+	batch := make([]*Span, 0, DefaultBatchSize)
+	send := func() {
+		if len(batch) > 0 {
+			e.post(batch)
+			batch = batch[:0]
+		}
+	}
+	for {
+		select {
+		case s := <-e.queue:
+			if batch = append(batch, s); len(batch) >= DefaultBatchSize {
+				send()
+			}
+		case <-ticker.C:
+			send()
+		case c := <-e.flush:
+			batch = e.drain(batch)
+			send()
+			close(c)
+		case <-e.done:
+			batch = e.drain(batch)
+			send()
+			return
+		}
+	}
+}
+
+// drain moves every queued span into the batch.
+func (e *OTLPExporter) drain(batch []*Span) []*Span {
+	for {
+		select {
+		case s := <-e.queue:
+			batch = append(batch, s)
+		default:
+			return batch
+		}
+	}
+}
+
+// post sends a batch to the collector.
+func (e *OTLPExporter) post(batch []*Span) {
+	b, _ := json.Marshal(otlpRequest(e.service, batch))
+	req, err := http.NewRequest("POST", e.endpoint, bytes.NewReader(b))
+	if err == nil {
+		req.Header.Set("Content-Type", "application/json")
+		for k, v := range e.headers {
+			req.Header.Set(k, v)
+		}
+		var resp *http.Response
+		if resp, err = e.client.Do(req); err == nil {
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode/100 != 2 {
+				err = fmt.Errorf("OTLP export returned status %d.", resp.StatusCode)
+			}
+		}
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.lastErr = err
+	if err != nil {
+		e.dropped += int64(len(batch))
+	}
+}
+
+// The following types are the OTLP/HTTP JSON encoding of an ExportTraceServiceRequest.
+
+type otlpExport struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Links             []otlpLink     `json:"links,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpLink struct {
+	TraceID string `json:"traceId"`
+	SpanID  string `json:"spanId"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+// otlpRequest returns the export request for a batch of spans.
+func otlpRequest(service string, batch []*Span) *otlpExport {
+	spans := make([]otlpSpan, 0, len(batch))
+	for _, s := range batch {
+		s.mu.Lock()
+		o := otlpSpan{
+			TraceID:           hex.EncodeToString(s.Context.TraceID[:]),
+			SpanID:            hex.EncodeToString(s.Context.SpanID[:]),
+			Name:              s.Name,
+			Kind:              s.Kind,
+			StartTimeUnixNano: strconv.FormatInt(s.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.End.UnixNano(), 10),
+			Attributes:        otlpAttributes(s.Attrs),
+			Status:            otlpStatus{Code: s.Status, Message: s.StatusMsg},
+		}
+		if s.Parent != [8]byte{} {
+			o.ParentSpanID = hex.EncodeToString(s.Parent[:])
+		}
+		for _, l := range s.Links {
+			o.Links = append(o.Links, otlpLink{
+				TraceID: hex.EncodeToString(l.TraceID[:]),
+				SpanID:  hex.EncodeToString(l.SpanID[:]),
+			})
+		}
+		s.mu.Unlock()
+		spans = append(spans, o)
+	}
+	return &otlpExport{
+		ResourceSpans: []otlpResourceSpans{{
+			Resource:   otlpResource{Attributes: otlpAttributes(map[string]interface{}{"service.name": service})},
+			ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: service}, Spans: spans}},
+		}},
+	}
+}
+
+// otlpAttributes returns attributes as sorted OTLP key/values. Unknown types are sent as strings.
+func otlpAttributes(attrs map[string]interface{}) []otlpKeyValue {
+	keys := make([]string, 0, len(attrs))
+	for k := range attrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	kvs := make([]otlpKeyValue, 0, len(keys))
+	for _, k := range keys {
+		var v otlpValue
+		switch t := attrs[k].(type) {
+		case string:
+			v.StringValue = &t
+		case bool:
+			v.BoolValue = &t
+		case int:
+			i := strconv.Itoa(t)
+			v.IntValue = &i
+		case int64:
+			i := strconv.FormatInt(t, 10)
+			v.IntValue = &i
+		case float64:
+			v.DoubleValue = &t
+		default:
+			str := fmt.Sprint(t)
+			v.StringValue = &str
+		}
+		kvs = append(kvs, otlpKeyValue{Key: k, Value: v})
+	}
+	return kvs
+}
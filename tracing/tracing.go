@@ -0,0 +1,211 @@
+// Package tracing provides spans with W3C trace context propagation that are exported to an
+// OpenTelemetry collector over OTLP/HTTP: https://opentelemetry.io/docs/specs/otlp/
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Span kinds from the OTLP spec.
+const (
+	KindInternal = iota + 1
+	KindServer
+	KindClient
+	KindProducer
+	KindConsumer
+)
+
+// Span status codes from the OTLP spec.
+const (
+	StatusUnset = iota
+	StatusOK
+	StatusError
+)
+
+// traceparentVersion is the only W3C trace context version supported.
+const traceparentVersion = "00"
+
+// SpanContext identifies a span within a trace.
+type SpanContext struct {
+	TraceID [16]byte // Trace the span belongs to.
+	SpanID  [8]byte  // The span.
+	Sampled bool     // Should the trace be recorded?
+}
+
+// IsValid returns true if the trace and span IDs are not all zeros.
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != [16]byte{} && sc.SpanID != [8]byte{}
+}
+
+// Traceparent returns the span context as a W3C traceparent header value.
+func (sc SpanContext) Traceparent() string {
+	if !sc.IsValid() {
+		return ""
+	}
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("%s-%s-%s-%s", traceparentVersion, hex.EncodeToString(sc.TraceID[:]),
+		hex.EncodeToString(sc.SpanID[:]), flags)
+}
+
+// ParseTraceparent returns the span context of a W3C traceparent header value.
+func ParseTraceparent(s string) (SpanContext, error) {
+	var sc SpanContext
+	parts := strings.Split(strings.TrimSpace(s), "-")
+	if len(parts) != 4 || parts[0] != traceparentVersion || len(parts[1]) != 32 || len(parts[2]) != 16 ||
+		len(parts[3]) != 2 || strings.ToLower(s) != s {
+		return sc, errors.New("Invalid traceparent.")
+	}
+	if _, err := hex.Decode(sc.TraceID[:], []byte(parts[1])); err != nil {
+		return sc, errors.New("Invalid traceparent trace ID.")
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(parts[2])); err != nil {
+		return sc, errors.New("Invalid traceparent span ID.")
+	}
+	var flags [1]byte
+	if _, err := hex.Decode(flags[:], []byte(parts[3])); err != nil {
+		return sc, errors.New("Invalid traceparent flags.")
+	}
+	if !sc.IsValid() {
+		return sc, errors.New("Invalid traceparent: all zero ID.")
+	}
+	sc.Sampled = flags[0]&1 == 1
+	return sc, nil
+}
+
+// Exporter sends ended spans to a tracing backend.
+type Exporter interface {
+	Export(s *Span)               // Queues a span for export. Must not block.
+	Shutdown(ctx context.Context) // Flushes queued spans and stops the exporter.
+}
+
+// Tracer starts spans for a service.
+type Tracer struct {
+	service  string   // Name of the service reported to the backend.
+	exporter Exporter // Destination of ended spans. Nil drops them.
+}
+
+// NewTracer is a factory function that returns a new Tracer. Spans are still created and propagated
+// when the exporter is nil so trace context passes through, but they are not sent anywhere.
+func NewTracer(service string, e Exporter) *Tracer {
+	return &Tracer{service: service, exporter: e}
+}
+
+// Service returns the service name of the tracer.
+func (t *Tracer) Service() string {
+	return t.service
+}
+
+// Start starts a span. A valid parent makes it a child span in the same trace, otherwise it starts
+// a new trace.
+func (t *Tracer) Start(name string, kind int, parent SpanContext) *Span {
+	s := &Span{
+		tracer: t,
+		Name:   name,
+		Kind:   kind,
+		Start:  time.Now(),
+		Attrs:  make(map[string]interface{}),
+	}
+	if parent.IsValid() {
+		s.Context = SpanContext{TraceID: parent.TraceID, Sampled: parent.Sampled}
+		s.Parent = parent.SpanID
+	} else {
+		rand.Read(s.Context.TraceID[:])
+		s.Context.Sampled = true
+	}
+	rand.Read(s.Context.SpanID[:])
+	return s
+}
+
+// Shutdown flushes and stops the exporter.
+func (t *Tracer) Shutdown(ctx context.Context) {
+	if t.exporter != nil {
+		t.exporter.Shutdown(ctx)
+	}
+}
+
+// Span is a timed operation within a trace.
+type Span struct {
+	tracer    *Tracer
+	mu        sync.Mutex             // For locking access to the span attributes.
+	Name      string                 // Operation name.
+	Kind      int                    // Span kind.
+	Context   SpanContext            // IDs of this span.
+	Parent    [8]byte                // Parent span ID. Zero for a root span.
+	Start     time.Time              // Start time.
+	End       time.Time              // End time. Zero until ended.
+	Attrs     map[string]interface{} // Attributes (string, bool, int, int64 or float64 values).
+	Links     []SpanContext          // Related spans in this or other traces.
+	Status    int                    // Status code.
+	StatusMsg string                 // Status description for an error.
+}
+
+// SetAttribute sets an attribute of the span.
+func (s *Span) SetAttribute(k string, v interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Attrs[k] = v
+}
+
+// AddLink links the span to another span (ex: the request that queued a deploy).
+func (s *Span) AddLink(sc SpanContext) {
+	if !sc.IsValid() {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Links = append(s.Links, sc)
+}
+
+// SetError marks the span as failed. A nil error does nothing.
+func (s *Span) SetError(err error) {
+	if err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Status, s.StatusMsg = StatusError, err.Error()
+}
+
+// SetOK marks the span as successful.
+func (s *Span) SetOK() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Status, s.StatusMsg = StatusOK, ""
+}
+
+// Finish ends the span and queues it for export. Only the first call has an effect.
+func (s *Span) Finish() {
+	s.mu.Lock()
+	if !s.End.IsZero() {
+		s.mu.Unlock()
+		return
+	}
+	s.End = time.Now()
+	s.mu.Unlock()
+	if s.tracer.exporter != nil && s.Context.Sampled {
+		s.tracer.exporter.Export(s)
+	}
+}
+
+type spanKey struct{}
+
+// ContextWithSpan returns a copy of the context that carries the span.
+func ContextWithSpan(ctx context.Context, s *Span) context.Context {
+	return context.WithValue(ctx, spanKey{}, s)
+}
+
+// SpanFromContext returns the span carried by the context, or nil.
+func SpanFromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanKey{}).(*Span)
+	return s
+}
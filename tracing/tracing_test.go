@@ -0,0 +1,120 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTraceparent(t *testing.T) {
+	t.Parallel()
+	tp := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	sc, err := ParseTraceparent(tp)
+	if err != nil {
+		t.Fatalf("Unexpected error parsing traceparent: %s", err)
+	}
+	if !sc.Sampled || sc.Traceparent() != tp {
+		t.Errorf("Expected '%s', received '%s'.", tp, sc.Traceparent())
+	}
+
+	for _, bad := range []string{
+		"",
+		"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-4bf92f3577b34da6a3ce929d0e0e47zz-00f067aa0ba902b7-01",
+	} {
+		if _, err := ParseTraceparent(bad); err == nil {
+			t.Errorf("Invalid traceparent '%s' should fail.", bad)
+		}
+	}
+}
+
+func TestStartSpan(t *testing.T) {
+	t.Parallel()
+	tr := NewTracer("test", nil)
+	root := tr.Start("root", KindServer, SpanContext{})
+	if !root.Context.IsValid() || root.Parent != [8]byte{} {
+		t.Errorf("Root span should start a new trace.")
+	}
+	child := tr.Start("child", KindInternal, root.Context)
+	if child.Context.TraceID != root.Context.TraceID || child.Parent != root.Context.SpanID {
+		t.Errorf("Child span should be in the parent's trace.")
+	}
+	if child.Context.SpanID == root.Context.SpanID {
+		t.Errorf("Child span should have its own ID.")
+	}
+	child.Finish()
+	end := child.End
+	child.Finish()
+	if child.End != end {
+		t.Errorf("Finish should only end a span once.")
+	}
+	ctx := ContextWithSpan(context.Background(), root)
+	if SpanFromContext(ctx) != root || SpanFromContext(context.Background()) != nil {
+		t.Errorf("Span should be carried by the context.")
+	}
+}
+
+func TestOTLPExport(t *testing.T) {
+	t.Parallel()
+	received := make(chan otlpExport, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" || r.Header.Get("Content-Type") != "application/json" ||
+			r.Header.Get("X-Api-Key") != "k" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var req otlpExport
+		b, _ := ioutil.ReadAll(r.Body)
+		json.Unmarshal(b, &req)
+		received <- req
+	}))
+	defer collector.Close()
+
+	e := NewOTLPExporter(collector.URL+"/v1/traces", "deployer", map[string]string{"X-Api-Key": "k"})
+	tr := NewTracer("deployer", e)
+	parent := tr.Start("HTTP POST", KindServer, SpanContext{})
+	s := tr.Start("deploy", KindConsumer, parent.Context)
+	s.SetAttribute("deployID", "ABC")
+	s.SetAttribute("containers", 3)
+	s.AddLink(parent.Context)
+	s.SetError(errTest("boom"))
+	s.Finish()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	e.Flush(ctx)
+
+	select {
+	case req := <-received:
+		rs := req.ResourceSpans[0]
+		if v := rs.Resource.Attributes[0]; v.Key != "service.name" || *v.Value.StringValue != "deployer" {
+			t.Errorf("Unexpected resource: %+v", rs.Resource)
+		}
+		span := rs.ScopeSpans[0].Spans[0]
+		if span.Name != "deploy" || span.Kind != KindConsumer || span.Status.Code != StatusError ||
+			span.ParentSpanID != strings.Split(parent.Context.Traceparent(), "-")[2] || len(span.Links) != 1 {
+			t.Errorf("Unexpected span: %+v", span)
+		}
+		if len(span.Attributes) != 2 || span.Attributes[0].Key != "containers" || *span.Attributes[0].Value.IntValue != "3" {
+			t.Errorf("Unexpected attributes: %+v", span.Attributes)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Collector did not receive the span.")
+	}
+	e.Shutdown(ctx)
+	if e.Dropped() != 0 || e.LastError() != nil {
+		t.Errorf("Unexpected export failure: %d dropped, %v", e.Dropped(), e.LastError())
+	}
+}
+
+type errTest string
+
+func (e errTest) Error() string { return string(e) }